@@ -44,7 +44,8 @@ func (m *SipServer) start() {
 	}
 	s := &sip.Stack{Listens: []*sip.ListeningPoint{udp, udp2, tcp}, EventListener: m,
 		Options: sip.Options{
-			UserAgent: "gsip test",
+			UserAgent:      "gsip test",
+			SessionExpires: 1800,
 		}}
 
 	m.stack = s
@@ -186,6 +187,11 @@ func (m *SipServer) OnRequest(event *sip.RequestEvent) {
 	}
 }
 
+// OnSessionExpired 设备没有刷新会话, 对话已经删除, 释放媒体资源
+func (m *SipServer) OnSessionExpired(dialog *sip.Dialog) {
+	println("会话超时:" + dialog.GetDialogId())
+}
+
 func StartServer(config examples.ServerConfig) {
 	SipAgent = &SipServer{
 		listIP:   config.ListenIP,
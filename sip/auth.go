@@ -99,7 +99,7 @@ func DoAuthenticatePlainTextPassword(request *Request, password string) bool {
 			return false
 		}
 
-		response := calculateResponse(authorizationHeader.Username(), authorizationHeader.Realm(), authorizationHeader.Nonce(), authorizationHeader.Uri().ToString(), password)
+		response := calculateResponse(authorizationHeader.Username(), authorizationHeader.Realm(), authorizationHeader.Nonce(), authorizationHeader.GetParameter(URI), password)
 		return response == authorizationHeader.Response()
 	}
 
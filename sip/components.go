@@ -2,9 +2,16 @@ package sip
 
 import (
 	"bytes"
-	"fmt"
+	"strings"
 )
 
+const (
+	SipScheme  = "sip"
+	SipsScheme = "sips"
+)
+
+// SipUri sip、sips或者tel URI. User、Password、Params和Headers是还原转义之后的值, 序列化时转义.
+// tel URI的User是电话号码, 没有HostPort和Headers. 地址中其他scheme的absoluteURI只保存scheme和冒号之后的内容
 type SipUri struct {
 	User     string //userInfo part
 	Password string //userInfo part. if the uri contains `@`, the user info cannot null.
@@ -14,6 +21,7 @@ type SipUri struct {
 	Headers map[string]string
 
 	scheme string
+	opaque string
 }
 
 func (uri *SipUri) Clone() *SipUri {
@@ -31,46 +39,69 @@ func (uri *SipUri) Clone() *SipUri {
 
 func (uri *SipUri) ToString() string {
 	var buffer bytes.Buffer
-	if uri.HostPort.Host == "" {
-		panic("the SIP URI must contain HOST")
-	}
+	uri.writeTo(&buffer)
+	return buffer.String()
+}
 
-	buffer.WriteString("sip:")
+func (uri *SipUri) writeTo(buffer *bytes.Buffer) {
+	if uri.IsTel() {
+		buffer.WriteString("tel:")
+		(&TelUri{Number: uri.User, Params: uri.Params}).writeSubscriber(buffer)
+		return
+	} else if uri.IsAbsolute() {
+		buffer.WriteString(uri.scheme)
+		buffer.WriteString(":")
+		buffer.WriteString(uri.opaque)
+		return
+	} else if uri.IsSecure() {
+		buffer.WriteString("sips:")
+	} else {
+		buffer.WriteString("sip:")
+	}
 	if uri.User != "" {
-		buffer.WriteString(uri.User)
+		writeEscaped(buffer, uri.User, userUnreserved)
 		if uri.Password != "" {
 			buffer.WriteString(":")
-			buffer.WriteString(uri.Password)
+			writeEscaped(buffer, uri.Password, passUnreserved)
 		}
 		buffer.WriteString("@")
 	}
 
-	buffer.WriteString(uri.HostPort.ToString())
+	uri.HostPort.writeTo(buffer)
 
-	if uri.Params != nil && len(uri.Params) > 0 {
+	if len(uri.Params) > 0 {
 		buffer.WriteString(";")
-		params := mapToParamsStr(uri.Params, ";")
-		buffer.WriteString(params)
+		writeEscapedParams(buffer, uri.Params, ";", paramUnreserved)
 	}
 
-	if uri.Headers != nil && len(uri.Headers) > 0 {
+	if len(uri.Headers) > 0 {
 		buffer.WriteString("?")
-		params := mapToParamsStr(uri.Params, "&")
-		buffer.WriteString(params)
+		writeEscapedParams(buffer, uri.Headers, "&", hnvUnreserved)
 	}
-
-	return buffer.String()
 }
 
 func (uri *SipUri) GetScheme() string {
+	if uri.scheme == "" {
+		return SipScheme
+	}
 	return uri.scheme
 }
 
+func (uri *SipUri) SetScheme(scheme string) {
+	uri.scheme = scheme
+}
+
+// IsSecure sips URI要求到达目标的每一跳都使用TLS
+func (uri *SipUri) IsSecure() bool {
+	return uri.scheme == SipsScheme
+}
+
 func NewSipUri(user string, host string, port int) *SipUri {
-	return &SipUri{User: user, HostPort: HostPort{Host: host, Port: port}}
+	return &SipUri{User: user, HostPort: HostPort{Host: host, Port: port}, scheme: SipScheme}
 }
 
-type TelUri struct {
+func NewSipsUri(user string, host string, port int) *SipUri {
+	return &SipUri{User: user, HostPort: HostPort{Host: host, Port: port}, scheme: SipsScheme}
 }
 
 type HostPort struct {
@@ -78,11 +109,25 @@ type HostPort struct {
 	Port int
 }
 
+// ToString IPv6地址使用IPv6 reference格式 [2001:db8::1]:5060
 func (h *HostPort) ToString() string {
-	if h.Port > 0 {
-		return fmt.Sprintf("%s:%d", h.Host, h.Port)
+	var buffer bytes.Buffer
+	h.writeTo(&buffer)
+	return buffer.String()
+}
+
+func (h *HostPort) writeTo(buffer *bytes.Buffer) {
+	if strings.Contains(h.Host, ":") && !strings.HasPrefix(h.Host, "[") {
+		buffer.WriteString("[")
+		buffer.WriteString(h.Host)
+		buffer.WriteString("]")
 	} else {
-		return h.Host
+		buffer.WriteString(h.Host)
+	}
+
+	if h.Port > 0 {
+		buffer.WriteString(":")
+		writeInt(buffer, h.Port)
 	}
 }
 
@@ -117,14 +162,21 @@ func deepCopy(src map[string]string) map[string]string {
 
 func mapToParamsStr(m map[string]string, separator string) string {
 	var buffer bytes.Buffer
+	writeParams(&buffer, m, separator)
+	return buffer.String()
+}
+
+func writeParams(buffer *bytes.Buffer, m map[string]string, separator string) {
+	first := true
 	for k, v := range m {
+		if !first {
+			buffer.WriteString(separator)
+		}
+		first = false
 		buffer.WriteString(k)
 		if v != "" {
 			buffer.WriteString("=")
 			buffer.WriteString(v)
 		}
-		buffer.WriteString(separator)
 	}
-
-	return buffer.String()[0 : buffer.Len()-1]
 }
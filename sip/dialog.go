@@ -2,7 +2,10 @@ package sip
 
 import (
 	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -54,14 +57,48 @@ type Dialog struct {
 	localUri        *SipUri    //UAS:TO uri
 	remoteUri       *SipUri    //UAS:From uri
 	remoteTarget    *SipUri    //UAS:设置为请求Contact头的uri
-	secure          bool       //UAS:请求通过TLS传输 并且Request-uri是sips uri. secure设置为true
+	secure          bool       //UAS:请求通过TLS/WSS传输 并且Request-uri是sips uri. secure设置为true
 	isUAC           bool
 	state           int
 	sipStack        *Stack
 	listeningPoint  *ListeningPoint
-	routeSet        []*SipUri
+	routeSet        []*SipUri //UAS:请求的Record-Route. UAC:应答的Record-Route逆序
 	via             *Via
-	//route set
+	outboundProxy   *SipUri //UAC:建立对话的请求指定的出站代理, 对话内的请求继续使用
+
+	ackMutex   sync.Mutex
+	pendingAck *pendingAck //UAS:等待ACK的2xx应答
+	lastAck    *Request    //UAC:最后发送的ACK, 收到重传的2xx时重发
+	//UAS:发送可靠临时应答的INVITE事务, 用于匹配PRACK
+	reliableTransaction *ServerTransaction
+
+	//UPDATE/re-INVITE 未完成的会话修改
+	sessionMutex    sync.Mutex
+	outgoingPending bool
+	incomingPending bool
+
+	//RFC 4028 会话定时器
+	timerMutex       sync.Mutex
+	sessionInterval  time.Duration
+	sessionRefresher bool //本端负责刷新
+	sessionTimer     TimerHandle
+	remoteUpdate     bool         //对端的Allow包含UPDATE, 使用UPDATE刷新会话
+	localContentType *ContentType //re-INVITE刷新会话时携带的本端会话描述
+	localContent     []byte
+}
+
+// pendingAck UAS发送INVITE的2xx后, 由UAS core而不是事务负责重传, 直到收到ACK
+type pendingAck struct {
+	cSeqNumber int
+	retransmit *timerG
+	timeout    *timerH
+}
+
+func (p *pendingAck) stop() {
+	if p.retransmit != nil {
+		p.retransmit.stop()
+	}
+	p.timeout.stop()
 }
 
 //type Dialog struct {
@@ -75,12 +112,35 @@ type Dialog struct {
 //}
 //re-Invite 刷新target要修改 remoteTag
 
+// createRouteSet RFC 3261 12.1.1/12.1.2 根据Record-Route建立route set, UAC需要逆序
+func createRouteSet(msg Message, uas bool) []*SipUri {
+	var routeSet []*SipUri
+	for _, header := range msg.GetHeader(RecordRouteName) {
+		recordRoute, ok := header.(*RecordRoute)
+		if !ok {
+			continue
+		}
+		for _, uri := range recordRoute.Address {
+			routeSet = append(routeSet, uri.Clone())
+		}
+	}
+
+	if !uas {
+		for i, j := 0, len(routeSet)-1; i < j; i, j = i+1, j-1 {
+			routeSet[i], routeSet[j] = routeSet[j], routeSet[i]
+		}
+	}
+	return routeSet
+}
+
 func createDialog(stack *Stack, listeningPoint *ListeningPoint, request *Request, response *Response, uas bool) *Dialog {
 	var dialog *Dialog
 	cSeqHeader := request.CSeq()
 	fromHeader := request.From()
 	toHeader := response.To()
 	number := seqNumber(cSeqHeader.Number)
+	//请求通过TLS/WSS传输并且Request-URI是sips uri
+	secure := isSecure(listeningPoint.Transport) && request.GetRequestLine().RequestUri.IsSecure()
 
 	if uas {
 		contactHeader := request.Contact()
@@ -90,7 +150,7 @@ func createDialog(stack *Stack, listeningPoint *ListeningPoint, request *Request
 			dialogId:        DialogId(response.GetDialogId(true)),
 			remoteUri:       fromHeader.Address.Uri,
 			localUri:        toHeader.Address.Uri,
-			secure:          false,
+			secure:          secure,
 		}
 
 	} else {
@@ -101,20 +161,129 @@ func createDialog(stack *Stack, listeningPoint *ListeningPoint, request *Request
 			dialogId:       DialogId(response.GetDialogId(false)),
 			remoteUri:      toHeader.Address.Uri,
 			localUri:       fromHeader.Address.Uri,
-			secure:         false,
+			secure:         secure,
 		}
 	}
 
+	if uas {
+		dialog.routeSet = createRouteSet(request, true)
+		dialog.remoteUpdate = hasOptionTag(request, UPDATE, AllowName)
+		dialog.setLocalContent(response.ContentType(), response.Content())
+	} else {
+		dialog.routeSet = createRouteSet(response, false)
+		dialog.outboundProxy = request.outboundProxy
+		dialog.remoteUpdate = hasOptionTag(response, UPDATE, AllowName)
+		dialog.setLocalContent(request.ContentType(), request.Content())
+	}
+	dialog.isUAC = !uas
 	dialog.via = response.via
 	dialog.sipStack = stack
 	dialog.listeningPoint = listeningPoint
 	return dialog
 }
 
+// waitAck RFC 3261 13.3.1.4 不可靠传输上以T1开始翻倍到T2重传2xx, 64*T1后没有收到ACK发送BYE结束会话
+func (d *Dialog) waitAck(cSeqNumber int, data []byte, conn net.Conn, reliable bool, timers *Timers) {
+	d.ackMutex.Lock()
+	defer d.ackMutex.Unlock()
+	if d.pendingAck != nil {
+		d.pendingAck.stop()
+	}
+
+	pending := &pendingAck{cSeqNumber: cSeqNumber, timeout: &timerH{}}
+	if !reliable {
+		pending.retransmit = &timerG{}
+		pending.retransmit.start(d.sipStack.timerService(), timers, func() bool {
+			d.ackMutex.Lock()
+			defer d.ackMutex.Unlock()
+			if d.pendingAck != pending {
+				return true
+			}
+			_, err := conn.Write(data)
+			return err != nil
+		})
+	}
+	pending.timeout.start(d.sipStack.timerService(), timers, func() {
+		d.onAckTimeout(pending)
+	})
+	d.pendingAck = pending
+}
+
+func (d *Dialog) onAckTimeout(pending *pendingAck) {
+	d.ackMutex.Lock()
+	if d.pendingAck != pending {
+		d.ackMutex.Unlock()
+		return
+	}
+	d.pendingAck.stop()
+	d.pendingAck = nil
+	d.ackMutex.Unlock()
+
+	//对话已经确认, 但是会话应该结束
+	if bye, err := d.CreateRequest(BYE); err == nil {
+		if transaction, err := d.listeningPoint.NewClientTransaction(bye); err == nil {
+			go transaction.Execute()
+		}
+	}
+	d.Delete()
+}
+
+func (d *Dialog) stopAck() {
+	d.ackMutex.Lock()
+	defer d.ackMutex.Unlock()
+	if d.pendingAck != nil {
+		d.pendingAck.stop()
+		d.pendingAck = nil
+	}
+}
+
+// onAck 收到2xx的ACK停止重传. 重复的ACK返回false
+func (d *Dialog) onAck(ack *Request) bool {
+	d.ackMutex.Lock()
+	defer d.ackMutex.Unlock()
+	if d.pendingAck == nil || d.pendingAck.cSeqNumber != ack.CSeq().Number {
+		return false
+	}
+
+	d.pendingAck.stop()
+	d.pendingAck = nil
+	return true
+}
+
+// processAck 2xx的ACK是一个单独的事务, 不创建服务端事务, 交给对应的对话并通知TU
+func (stack *Stack) processAck(ack *Request) error {
+	dialog, ok := stack.findDialog(ack.GetDialogId(true))
+	if !ok {
+		return fmt.Errorf("the dialog of the ACK does not exist")
+	} else if !dialog.onAck(ack) {
+		return nil
+	}
+
+	if listener, ok := stack.EventListener.(AckListener); ok {
+		go listener.OnAck(&AckEvent{ack, dialog})
+	} else {
+		go stack.EventListener.OnRequest(&RequestEvent{ack, dialog, nil})
+	}
+	return nil
+}
+
 func (d *Dialog) SendAck(request *Request) error {
+	d.ackMutex.Lock()
+	d.lastAck = request
+	d.ackMutex.Unlock()
 	return d.listeningPoint.SendRequest(request)
 }
 
+// resendAck RFC 3261 13.2.2.4 重传的2xx不会交给TU, 由对话重发对应的ACK
+func (d *Dialog) resendAck(cSeqNumber int) {
+	d.ackMutex.Lock()
+	ack := d.lastAck
+	d.ackMutex.Unlock()
+	if ack != nil && ack.CSeq().Number == cSeqNumber {
+		d.listeningPoint.SendRequest(ack)
+	}
+}
+
 func (d *Dialog) CreateAck(cSeqNumber int) *Request {
 	ack := d.createRequest(ACK, cSeqNumber)
 	ack.Via().setBranch(generateBranchId())
@@ -129,11 +298,32 @@ func (d *Dialog) createRequest(method string, cSeqNumber int) *Request {
 	callIdHeader := CallID(d.dialogId.CallId())
 
 	cSeqHeader := &CSeq{Method: method, Number: cSeqNumber}
-	requestLine := &RequestLine{Method: method, RequestUri: d.remoteTarget, SipVersion: SipVersion}
+	requestUri := d.remoteTarget
+	if d.secure && !requestUri.IsSecure() {
+		requestUri = requestUri.Clone()
+		requestUri.SetScheme(SipsScheme)
+	}
+
+	//RFC 3261 12.2.1.1 第一个route是strict router时, 它作为Request-URI, remote target放到Route最后
+	var route []*SipUri
+	if len(d.routeSet) > 0 && isLooseRouter(d.routeSet[0]) {
+		route = d.routeSet
+	} else if len(d.routeSet) > 0 {
+		route = append(append(route, d.routeSet[1:]...), requestUri)
+		requestUri = d.routeSet[0].Clone()
+		//Request-URI不允许包含method参数和headers
+		delete(requestUri.Params, "method")
+		requestUri.Headers = nil
+	}
+	requestLine := &RequestLine{Method: method, RequestUri: requestUri, SipVersion: SipVersion}
 
 	request := NewRequest()
 	request.line = requestLine
+	request.outboundProxy = d.outboundProxy
 	request.SetHeader(d.listeningPoint.CreateViaHeader())
+	if len(route) > 0 {
+		request.SetHeader((&Route{Address: route}).Clone())
+	}
 	request.SetHeader(toHeader)
 	request.SetHeader(fromHeader)
 	request.SetHeader(&callIdHeader)
@@ -155,6 +345,9 @@ func (d *Dialog) CreateRequest(method string) (*Request, error) {
 	if ACK == method || CANCEL == method {
 		return nil, fmt.Errorf("disable creat %s requests", method)
 	}
+	if d.secure && !isSecure(d.listeningPoint.Transport) {
+		return nil, fmt.Errorf("the secure dialog cannot be downgraded to %s", d.listeningPoint.Transport)
+	}
 	if d.localSeqNumber == nil {
 		d.localSeqNumber = newSeqNumber(0)
 	}
@@ -167,11 +360,19 @@ func (d *Dialog) GetDialogId() string {
 	return string(d.dialogId)
 }
 
+func (d *Dialog) IsSecure() bool {
+	return d.secure
+}
+
 func (d *Dialog) Terminated() {
 	d.state = dialogStateTerminated
+	d.stopAck()
+	d.stopSessionTimer()
 }
 
 func (d *Dialog) Delete() {
 	d.state = dialogStateTerminated
+	d.stopAck()
+	d.stopSessionTimer()
 	d.sipStack.removeDialog(d.GetDialogId())
 }
@@ -0,0 +1,681 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseTestDialog(t *testing.T, recordRoute string) *Dialog {
+	invite := "INVITE sip:34020000001320000001@192.168.1.108:5060 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000001320000001@3402000000>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:34020000002000000001@192.168.1.100:5060>\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	ok := "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1\r\n" +
+		"Record-Route: " + recordRoute + "\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000001320000001@3402000000>;tag=2\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:34020000001320000001@192.168.1.108:5060>\r\n" +
+		"Content-Length: 0\r\n\r\n"
+
+	request, _, err := parseMessage([]byte(invite), len(invite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := parseMessage([]byte(ok), len(ok))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stack := &Stack{}
+	listen := &ListeningPoint{IP: "192.168.1.100", Port: 5060, Transport: UDP, sipStack: stack}
+	return createDialog(stack, listen, request.(*Request), response.(*Response), false)
+}
+
+func TestDialogRouteSet(t *testing.T) {
+	//UAC的route set是Record-Route的逆序
+	dialog := parseTestDialog(t, "<sip:p1.example.com;lr>,<sip:p2.example.com;lr>")
+	bye, err := dialog.CreateRequest(BYE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route := bye.GetHeader(RouteName)[0].(*Route)
+	if len(route.Address) != 2 || route.Address[0].HostPort.Host != "p2.example.com" || route.Address[1].HostPort.Host != "p1.example.com" {
+		t.Fatalf("bad route %s", route.Value())
+	}
+	if bye.GetRequestLine().RequestUri.HostPort.Host != "192.168.1.108" || nextHopUri(bye).HostPort.Host != "p2.example.com" {
+		t.Fatalf("bad loose routing %s", bye.GetRequestLine().RequestUri.ToString())
+	}
+
+	//strict router作为Request-URI, remote target放到Route最后
+	dialog = parseTestDialog(t, "<sip:p1.example.com>")
+	bye, err = dialog.CreateRequest(BYE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route = bye.GetHeader(RouteName)[0].(*Route)
+	if len(route.Address) != 1 || route.Address[0].HostPort.Host != "192.168.1.108" {
+		t.Fatalf("bad route %s", route.Value())
+	}
+	if bye.GetRequestLine().RequestUri.HostPort.Host != "p1.example.com" || nextHopUri(bye).HostPort.Host != "p1.example.com" {
+		t.Fatalf("bad strict routing %s", bye.GetRequestLine().RequestUri.ToString())
+	}
+}
+
+func TestOutboundProxy(t *testing.T) {
+	dialog := parseTestDialog(t, "<sip:p1.example.com;lr>")
+	proxy, _ := parseUri("sip:proxy.example.com;lr")
+	dialog.sipStack.Options.OutboundProxy = proxy
+
+	//loose router作为第一个Route, 不重复插入
+	bye, _ := dialog.CreateRequest(BYE)
+	dialog.listeningPoint.applyOutboundProxy(bye)
+	if uri := dialog.listeningPoint.applyOutboundProxy(bye); uri.HostPort.Host != "proxy.example.com" {
+		t.Fatalf("bad next hop %s", uri.ToString())
+	}
+	route := bye.GetHeader(RouteName)[0].(*Route)
+	if len(route.Address) != 2 || route.Address[0].HostPort.Host != "proxy.example.com" || route.Address[1].HostPort.Host != "p1.example.com" {
+		t.Fatalf("bad route %s", route.Value())
+	}
+
+	//请求指定的strict router只替换下一跳
+	strict, _ := parseUri("sip:10.0.0.1:5080")
+	bye, _ = dialog.CreateRequest(BYE)
+	bye.SetOutboundProxy(strict)
+	if uri := dialog.listeningPoint.applyOutboundProxy(bye); uri != strict {
+		t.Fatalf("bad next hop %s", uri.ToString())
+	}
+	if route = bye.GetHeader(RouteName)[0].(*Route); len(route.Address) != 1 {
+		t.Fatalf("bad route %s", route.Value())
+	}
+}
+
+func TestRefresherOutboundProxy(t *testing.T) {
+	stack := newTestStack(t)
+	proxy, _ := parseUri("sip:192.168.1.1:5080;lr")
+	results := make(chan error, 1)
+
+	//刷新的请求经过出站代理, 出站代理作为第一个Route
+	refreshed := func(msg string) {
+		request := parseTestRequest(t, msg)
+		if route := request.GetHeader(RouteName); len(route) != 1 || route[0].(*Route).Address[0].ToString() != proxy.ToString() {
+			t.Fatalf("the refresh should be routed through the outbound proxy %s", msg)
+		} else if sentTo := stack.conn.sentTo(); sentTo[len(sentTo)-1] != "192.168.1.1:5080" {
+			t.Fatalf("bad next hop %s", sentTo[len(sentTo)-1])
+		}
+		response := stack.response(msg, OK, "2")
+		response.SetExpires(60)
+		stack.process(response.ToString())
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//注册刷新复制原请求的出站代理
+	register := stack.newRequest(REGISTER)
+	register.SetExpires(60)
+	register.SetOutboundProxy(proxy)
+	refresher := stack.StartAutoRefreshWithRegister(register, func(status bool, err error) {
+		results <- err
+	})
+	defer refresher.Stop()
+	go stack.clock.Advance(55 * time.Second)
+	refreshed(stack.next())
+
+	//订阅刷新使用对话的出站代理
+	subscribe := stack.newRequest(SUBSCRIBE)
+	subscribe.SetExpires(60)
+	subscribe.SetHeader(&Event{Type: "presence"})
+	subscribe.SetOutboundProxy(proxy)
+	dialog := createDialog(stack.Stack, stack.listen, subscribe, stack.response(subscribe.ToString(), OK, "2"), false)
+	refresher = stack.StartAutoRefreshWithSubscribe(subscribe, dialog, 10*time.Second, func(status, terminated bool, err error) {
+		results <- err
+	})
+	defer refresher.Stop()
+	go stack.clock.Advance(10 * time.Second)
+	refreshed(stack.next())
+}
+
+func TestDialogAck(t *testing.T) {
+	dialog := parseTestDialog(t, "<sip:p1.example.com;lr>")
+	dialog.waitAck(1, nil, nil, true, &DefaultTimers)
+	defer dialog.stopAck()
+
+	ack := dialog.CreateAck(2)
+	if dialog.onAck(ack) {
+		t.Fatalf("the ACK of other CSeq should be ignored")
+	}
+
+	ack = dialog.CreateAck(1)
+	if !dialog.onAck(ack) || dialog.onAck(ack) {
+		t.Fatalf("the retransmitted ACK should be absorbed")
+	}
+}
+
+func TestDialogGlare(t *testing.T) {
+	dialog := parseTestDialog(t, "<sip:p1.example.com;lr>")
+	if err := dialog.beginOutgoing(); err != nil {
+		t.Fatal(err)
+	}
+	if code := dialog.beginIncoming(); code != RequestPending {
+		t.Fatalf("the glare should be rejected with 491, got %d", code)
+	}
+	if err := dialog.beginOutgoing(); err == nil {
+		t.Fatalf("only one outgoing session modification is allowed")
+	}
+
+	dialog.endOutgoing()
+	if code := dialog.beginIncoming(); code != 0 {
+		t.Fatalf("bad code %d", code)
+	}
+	if code := dialog.beginIncoming(); code != ServerInternalError {
+		t.Fatalf("the overlapping UPDATE should be rejected with 500, got %d", code)
+	}
+
+	//UAC等待2.1-4秒
+	if interval := dialog.glareRetryInterval(); interval < 2100*time.Millisecond || interval >= 4*time.Second {
+		t.Fatalf("bad retry interval %s", interval)
+	}
+}
+
+func TestDialogReInvite(t *testing.T) {
+	dialog := parseTestDialog(t, "<sip:p1.example.com;lr>")
+	if _, err := dialog.SendReInvite(nil, nil); err == nil {
+		t.Fatalf("re-INVITE requires a confirmed dialog")
+	}
+
+	dialog.state = dialogStateConfirmed
+	request, err := dialog.CreateRequest(INVITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetHeader(&Contact{Address: &Address{Uri: NewSipUri("34020000001320000001", "192.168.1.109", 5070)}})
+	dialog.refreshTarget(request)
+	if uri := dialog.createRequest(BYE, 3).GetRequestLine().RequestUri.ToString(); uri != "sip:34020000001320000001@192.168.1.109:5070" {
+		t.Fatalf("the remote target should be refreshed, got %s", uri)
+	}
+}
+
+func TestDialogSessionTimer(t *testing.T) {
+	dialog := parseTestDialog(t, "<sip:p1.example.com;lr>")
+	dialog.state = dialogStateConfirmed
+	dialog.sipStack.Options.SessionExpires = 1800
+	dialog.sipStack.dialogs = CreateSafeMap(1)
+	dialog.sipStack.addDialog(dialog.GetDialogId(), dialog)
+
+	//对端不支持timer, 本端刷新
+	request, err := dialog.CreateRequest(INVITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction := &ServerTransaction{transaction: transaction{sipStack: dialog.sipStack, originalRequest: request}}
+	response := request.CreateResponse(OK)
+	transaction.negotiateSessionTimer(response, dialog)
+	if se := getSessionExpires(response); se == nil || se.Value() != "1800;refresher=uas" || !dialog.sessionRefresher {
+		t.Fatalf("the UAS should be the refresher")
+	} else if hasOptionTag(response, OptionTagTimer, RequireName) {
+		t.Fatalf("Require: timer is not allowed when the UAC does not support timer")
+	}
+
+	//TU设置的Session-Expires不修改
+	request, _ = dialog.CreateRequest(INVITE)
+	request.SetHeader(&SessionExpires{Delta: 600})
+	dialog.sipStack.addSessionTimer(request)
+	if se := getSessionExpires(request); se.Delta != 600 {
+		t.Fatalf("the Session-Expires of the TU should be kept")
+	}
+
+	request, _ = dialog.CreateRequest(UPDATE)
+	dialog.sipStack.addSessionTimer(request)
+	if se := getSessionExpires(request); se == nil || se.Value() != "1800;refresher=uac" || !hasOptionTag(request, OptionTagTimer, SupportedName) {
+		t.Fatalf("the refresher should refresh the session with refresher=uac")
+	}
+	transaction.originalRequest = request
+	response = request.CreateResponse(OK)
+	transaction.negotiateSessionTimer(response, dialog)
+	if !hasOptionTag(response, OptionTagTimer, RequireName) || dialog.sessionRefresher {
+		t.Fatalf("the UAC should be the refresher")
+	}
+	dialog.stopSessionTimer()
+}
+
+func TestSessionRefreshTimeout(t *testing.T) {
+	stack := newTestStack(t)
+	dialog := stack.newUASDialog("")
+	dialog.remoteUpdate = true
+
+	go dialog.refreshSession()
+	if update := stack.next(); !strings.HasPrefix(update, "UPDATE ") {
+		t.Fatalf("the session should be refreshed with UPDATE %s", update)
+	}
+
+	//对端没有应答, Timer F超时后发送BYE结束会话
+	for bye := false; !bye; {
+		msg, _ := stack.advanceUntilSent(time.Second, 100)
+		bye = strings.HasPrefix(msg, "BYE ")
+	}
+	//BYE在另一个协程中发送, 等待删除对话
+	for i := 0; ; i++ {
+		if _, ok := stack.findDialog(dialog.GetDialogId()); !ok {
+			break
+		} else if i > 100 {
+			t.Fatalf("the dialog should be deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionIntervalTooSmall(t *testing.T) {
+	stack := newTestStack(t)
+	stack.Options.SessionExpires = 90
+	transaction, err := stack.listen.NewClientTransaction(stack.newRequest(INVITE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan *ResponseEvent, 1)
+	go func() {
+		event, err := transaction.Execute()
+		if err != nil {
+			t.Error(err)
+		}
+		results <- event
+	}()
+
+	//RFC 4028 7.4 422之后使用对端的Min-SE重新发送初始INVITE
+	invite := stack.next()
+	response := stack.response(invite, SessionIntervalTooSmall, "2")
+	minSE := MinSE(1800)
+	response.SetHeader(&minSE)
+	stack.process(response.ToString())
+
+	var retry string
+	for i := 0; i < 2; i++ {
+		if msg := stack.next(); strings.HasPrefix(msg, "INVITE ") {
+			retry = msg
+		}
+	}
+	request := parseTestRequest(t, retry)
+	if se := getSessionExpires(request); se == nil || se.Delta != 1800 || getMinSE(request) != 1800 {
+		t.Fatalf("the INVITE should be retried with the Min-SE of the peer %s", retry)
+	} else if request.CSeq().Number != transaction.originalRequest.CSeq().Number+1 || request.Via().branch == transaction.originalRequest.Via().branch {
+		t.Fatalf("the retried INVITE should be a new transaction %s", retry)
+	}
+
+	stack.process(stack.response(retry, OK, "3").ToString())
+	if event := <-results; event == nil || event.Response.GetStatusCode() != OK {
+		t.Fatalf("the response of the retried INVITE should be returned")
+	}
+
+	//重试后依然太小, 不再重试
+	transaction, _ = stack.listen.NewClientTransaction(stack.newRequest(INVITE))
+	transaction.originalRequest.SetHeader(&SessionExpires{Delta: 1800})
+	go func() {
+		event, _ := transaction.Execute()
+		results <- event
+	}()
+	invite = stack.next()
+	response = stack.response(invite, SessionIntervalTooSmall, "2")
+	response.SetHeader(&minSE)
+	stack.process(response.ToString())
+	if event := <-results; event == nil || event.Response.GetStatusCode() != SessionIntervalTooSmall {
+		t.Fatalf("the 422 should be returned when the Min-SE is not larger")
+	}
+}
+
+func TestDialogForks(t *testing.T) {
+	confirmed := parseTestDialog(t, "<sip:p1.example.com;lr>")
+	confirmed.state = dialogStateConfirmed
+	early := parseTestDialog(t, "<sip:p2.example.com;lr>")
+	early.state = dialogStateEarly
+	early.dialogId = "1:3:1"
+
+	stack := confirmed.sipStack
+	stack.dialogs = CreateSafeMap(2)
+	early.sipStack = stack
+	stack.addDialog(confirmed.GetDialogId(), confirmed)
+	stack.addDialog(early.GetDialogId(), early)
+
+	transaction := &ClientTransaction{transaction: transaction{sipStack: stack}}
+	transaction.addFork(confirmed.dialogId.RemoteTag(), confirmed)
+	transaction.addFork(early.dialogId.RemoteTag(), early)
+	if len(transaction.Dialogs()) != 2 || transaction.findFork("3") != early {
+		t.Fatalf("each To tag should have its own dialog")
+	}
+
+	//事务结束时早期对话随之结束
+	transaction.terminateEarlyForks()
+	if _, ok := stack.findDialog(early.GetDialogId()); ok || early.state != dialogStateTerminated {
+		t.Fatalf("the early dialog should be terminated")
+	}
+	if _, ok := stack.findDialog(confirmed.GetDialogId()); !ok {
+		t.Fatalf("the confirmed dialog should be kept")
+	}
+}
+
+func TestSecureDialog(t *testing.T) {
+	invite := "INVITE sips:34020000001320000001@192.168.1.108:5061 SIP/2.0\r\n" +
+		"Via: SIP/2.0/TLS 192.168.1.100:5061;branch=z9hG4bK-1\r\n" +
+		"From: <sips:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sips:34020000001320000001@3402000000>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:34020000002000000001@192.168.1.100:5061;transport=tls>\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	request := parseTestRequest(t, invite)
+	response := request.CreateResponse(OK)
+	response.To().Tag = "2"
+
+	stack := newTestStack(t)
+	tlsListen := &ListeningPoint{IP: "192.168.1.108", Port: 5061, Transport: TLS, sipStack: stack.Stack}
+	dialog := createDialog(stack.Stack, tlsListen, request, response, true)
+	dialog.state = dialogStateConfirmed
+	stack.addDialog(dialog.GetDialogId(), dialog)
+	if !dialog.IsSecure() {
+		t.Fatalf("the dialog created by a sips request over TLS should be secure")
+	}
+
+	//remote target使用sips
+	bye, err := dialog.CreateRequest(BYE)
+	if err != nil {
+		t.Fatal(err)
+	} else if uri := bye.GetRequestLine().RequestUri; !uri.IsSecure() {
+		t.Fatalf("the request of the secure dialog should use sips %s", uri.ToString())
+	}
+
+	//不能通过非TLS监听点发送
+	dialog.listeningPoint = stack.listen
+	if _, err = dialog.CreateRequest(BYE); err == nil {
+		t.Fatalf("the secure dialog should not be downgraded to UDP")
+	}
+
+	//对端通过UDP发送的对话内请求响应403
+	stack.process("BYE sips:34020000001320000001@192.168.1.108:5061 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-2\r\n" +
+		"From: <sips:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sips:34020000001320000001@3402000000>;tag=2\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 2 BYE\r\n" +
+		"Content-Length: 0\r\n\r\n")
+	if len(stack.conn.messages) != 1 || !strings.HasPrefix(stack.conn.messages[0], "SIP/2.0 403") {
+		t.Fatalf("the downgraded request should be rejected %v", stack.conn.messages)
+	}
+	if _, ok := stack.findDialog(dialog.GetDialogId()); !ok || len(stack.recorder.requests) != 0 {
+		t.Fatalf("the downgraded BYE should not terminate the dialog")
+	}
+
+	//RFC 7118 WSS和TLS一样是安全的传输
+	dialog.listeningPoint = &ListeningPoint{IP: "192.168.1.108", Port: 443, Transport: WSS, sipStack: stack.Stack, tcpSessions: CreateSafeMap(1)}
+	if wss := createDialog(stack.Stack, dialog.listeningPoint, request, response, true); !wss.IsSecure() {
+		t.Fatalf("the dialog created by a sips request over WSS should be secure")
+	} else if _, err = dialog.CreateRequest(BYE); err != nil {
+		t.Fatalf("the secure dialog should be allowed over WSS %v", err)
+	}
+	msg := "BYE sips:34020000001320000001@192.168.1.108:5061 SIP/2.0\r\n" +
+		"Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK-3\r\n" +
+		"From: <sips:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sips:34020000001320000001@3402000000>;tag=2\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 3 BYE\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if err = processMessage(dialog.listeningPoint, stack.Stack, &recordConn{}, true, []byte(msg), len(msg)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-stack.recorder.requests:
+		if event.Request.GetRequestMethod() != BYE {
+			t.Fatalf("bad request %s", event.Request.GetRequestMethod())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the BYE over WSS should be accepted by the secure dialog")
+	}
+}
+
+// newUASDialog 对端发送INVITE, 本端应答200建立的对话. 本端的tag为2
+func (s *testStack) newUASDialog(headers string) *Dialog {
+	s.process(peerRequest(INVITE, "z9hG4bK-invite", "", 1, headers))
+	event := <-s.recorder.requests
+	ok := event.Request.CreateResponse(OK)
+	ok.To().Tag = "2"
+	ok.SetHeader(&Contact{Address: &Address{Uri: NewSipUri("34020000001320000001", "192.168.1.108", 5060)}})
+	event.ServerTransaction.SendResponse(ok)
+	s.process(peerRequest(ACK, "z9hG4bK-ack", "2", 1, ""))
+	<-s.recorder.requests
+	<-s.conn.written
+
+	dialog, ok2 := s.findDialog(ok.GetDialogId(true))
+	if !ok2 || dialog.state != dialogStateConfirmed {
+		s.t.Fatalf("the dialog should be confirmed")
+	}
+	return dialog
+}
+
+// advanceUntilSent 在另一个协程中发送的消息可能依赖还没有创建的定时器, 逐步推进时钟直到发送消息
+func (s *testStack) advanceUntilSent(step time.Duration, limit int) (string, time.Duration) {
+	for i := 1; i <= limit; i++ {
+		s.clock.Advance(step)
+		select {
+		case msg := <-s.conn.written:
+			return msg, time.Duration(i) * step
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	s.t.Fatalf("no message was sent in %s", time.Duration(limit)*step)
+	return "", 0
+}
+
+func TestDialogGlareRetry(t *testing.T) {
+	stack := newTestStack(t)
+	dialog := stack.newUASDialog("")
+
+	results := make(chan *ResponseEvent, 1)
+	go func() {
+		event, err := dialog.SendUpdate(nil, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- event
+	}()
+
+	//491之后由Stack的定时器驱动重试, 非Call-ID的生成者等待0-2秒
+	update := stack.next()
+	stack.process(stack.response(update, RequestPending, "").ToString())
+	retry, elapsed := stack.advanceUntilSent(10*time.Millisecond, 300)
+	if !strings.HasPrefix(retry, "UPDATE ") || retry == update || elapsed > 2*time.Second {
+		t.Fatalf("the UPDATE should be retried in 2 seconds, elapsed %s %s", elapsed, retry)
+	}
+
+	stack.process(stack.response(retry, OK, "").ToString())
+	if event := <-results; event == nil || event.Response.GetStatusCode() != OK {
+		t.Fatalf("the response of the retried UPDATE should be returned")
+	}
+
+	//等待重试时Stack停止, 返回错误
+	errs := make(chan error, 1)
+	go func() {
+		_, err := dialog.SendUpdate(nil, nil)
+		errs <- err
+	}()
+	stack.process(stack.response(stack.next(), RequestPending, "").ToString())
+	stack.Stop()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("the glare retry should fail after the stack stops")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the glare retry should not wait after the stack stops")
+	}
+}
+
+func TestSessionModificationTerminated(t *testing.T) {
+	stack := newTestStack(t)
+	dialog := stack.newUASDialog("")
+
+	stack.process(peerRequest(UPDATE, "z9hG4bK-update", "2", 2, ""))
+	event := <-stack.recorder.requests
+	if err := dialog.beginOutgoing(); err == nil {
+		t.Fatalf("the UPDATE of the peer is pending")
+	}
+
+	//TU没有应答, 事务因为传输错误结束
+	event.ServerTransaction.terminated()
+	if err := dialog.beginOutgoing(); err != nil {
+		t.Fatalf("the terminated transaction should end the session modification: %v", err)
+	}
+	dialog.endOutgoing()
+
+	//之后的re-INVITE正常通知TU
+	stack.process(peerRequest(INVITE, "z9hG4bK-reinvite", "2", 3, ""))
+	if event = <-stack.recorder.requests; event.Request.GetRequestMethod() != INVITE || len(stack.conn.sent()) != 1 {
+		t.Fatalf("the re-INVITE should be accepted %v", stack.conn.sent())
+	}
+}
+
+func TestRejectedOffer(t *testing.T) {
+	stack := newTestStack(t)
+	dialog := stack.newUASDialog("")
+	contentType := ContentType("application/sdp")
+	dialog.setLocalContent(&contentType, []byte("v=0\r\no=- 1 1 IN IP4 192.168.1.108\r\n"))
+
+	results := make(chan *ResponseEvent, 1)
+	update := func(body string) {
+		go func() {
+			event, err := dialog.SendUpdate(&contentType, []byte(body))
+			if err != nil {
+				t.Error(err)
+			}
+			results <- event
+		}()
+	}
+
+	//被拒绝的offer不能保存为本端的会话描述
+	update("v=0\r\no=- 1 2 IN IP4 192.168.1.108\r\n")
+	stack.process(stack.response(stack.next(), NotAcceptableHere, "").ToString())
+	<-results
+	if content := string(dialog.localContent); content != "v=0\r\no=- 1 1 IN IP4 192.168.1.108\r\n" {
+		t.Fatalf("the rejected offer should not replace the local session description %s", content)
+	}
+
+	update("v=0\r\no=- 1 3 IN IP4 192.168.1.108\r\n")
+	stack.process(stack.response(stack.next(), OK, "").ToString())
+	<-results
+	if content := string(dialog.localContent); content != "v=0\r\no=- 1 3 IN IP4 192.168.1.108\r\n" {
+		t.Fatalf("the accepted offer should be the local session description %s", content)
+	}
+}
+
+func TestSessionRequestWithProvisional(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		stack := newTestStack(t)
+		stack.Options.RequestTimeout = timeout
+		stack.listen.SetGlobalContact(&Contact{Address: &Address{Uri: NewSipUri("34020000001320000001", "192.168.1.108", 5060)}})
+		dialog := stack.newUASDialog("")
+
+		results := make(chan *ResponseEvent, 1)
+		go func() {
+			event, err := dialog.SendReInvite(nil, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- event
+		}()
+
+		//100和200先后到达, 只能返回最终应答, 并且发送ACK
+		reInvite := stack.next()
+		stack.process(stack.response(reInvite, Trying, "").ToString())
+		stack.process(stack.response(reInvite, OK, "").ToString())
+		if event := <-results; event == nil || event.Response.GetStatusCode() != OK {
+			t.Fatalf("the final response should be returned, timeout %s", timeout)
+		}
+		if ack := stack.next(); !strings.HasPrefix(ack, "ACK ") {
+			t.Fatalf("the 2xx of the re-INVITE should be acknowledged %s", ack)
+		}
+	}
+}
+
+type forkRecorder struct {
+	*requestRecorder
+	forks chan *ResponseEvent
+}
+
+func (r *forkRecorder) OnForkedResponse(event *ResponseEvent) {
+	r.forks <- event
+}
+
+// sendForkedInvite 发送INVITE, 对端返回两个不同To tag的2xx. 返回事务, 第一个2xx的结果和第二个2xx之后发送的消息
+func (s *testStack) sendForkedInvite(sent int) (*ClientTransaction, *ResponseEvent, []string) {
+	transaction, err := s.listen.NewClientTransaction(s.newRequest(INVITE))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	results := make(chan *ResponseEvent, 1)
+	go func() {
+		event, _ := transaction.Execute()
+		results <- event
+	}()
+
+	invite := s.next()
+	s.process(s.response(invite, OK, "2").ToString())
+	event := <-results
+	if event == nil || event.Response.To().Tag != "2" {
+		s.t.Fatalf("the first 2xx should be returned to the caller")
+	}
+
+	s.process(s.response(invite, OK, "3").ToString())
+	messages := make([]string, sent)
+	for i := range messages {
+		messages[i] = s.next()
+	}
+	return transaction, event, messages
+}
+
+func TestForkedResponse(t *testing.T) {
+	//没有ForkListener, 第二个2xx自动ACK并且BYE
+	stack := newTestStack(t)
+	_, _, messages := stack.sendForkedInvite(2)
+	var ack, bye *Request
+	for _, msg := range messages {
+		if request := parseTestRequest(t, msg); request.GetRequestMethod() == ACK {
+			ack = request
+		} else if request.GetRequestMethod() == BYE {
+			bye = request
+		}
+	}
+	if ack == nil || ack.To().Tag != "3" || bye == nil || bye.To().Tag != "3" {
+		t.Fatalf("the forked 2xx should be acknowledged and terminated %v", messages)
+	}
+	if _, ok := stack.findDialog(ack.GetDialogId(false)); ok {
+		t.Fatalf("the forked dialog should be deleted")
+	}
+
+	//ForkListener收到第二个2xx, TU选择保留的对话后丢弃其他对话
+	stack = newTestStack(t)
+	listener := &forkRecorder{requestRecorder: stack.recorder, forks: make(chan *ResponseEvent, 1)}
+	stack.EventListener = listener
+	transaction, first, _ := stack.sendForkedInvite(0)
+	forked := <-listener.forks
+	if forked.Response.To().Tag != "3" || forked.Dialog == nil || forked.Dialog.state != dialogStateConfirmed || len(transaction.Dialogs()) != 2 {
+		t.Fatalf("the forked 2xx should be delivered to the ForkListener")
+	}
+
+	transaction.DiscardForks(first.Dialog)
+	if ack := stack.next(); !strings.HasPrefix(ack, "ACK ") || parseTestRequest(t, ack).To().Tag != "3" {
+		t.Fatalf("the discarded fork should be acknowledged %s", ack)
+	}
+	if bye := stack.next(); !strings.HasPrefix(bye, "BYE ") || parseTestRequest(t, bye).To().Tag != "3" {
+		t.Fatalf("the discarded fork should be terminated %s", bye)
+	}
+	if forked.Dialog.state != dialogStateTerminated || first.Dialog.state != dialogStateConfirmed {
+		t.Fatalf("only the discarded fork should be terminated")
+	}
+}
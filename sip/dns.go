@@ -0,0 +1,270 @@
+package sip
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// 标准库不支持NAPTR查询, 这里实现一个最小的DNS客户端, 只用于RFC 3263的NAPTR记录
+
+const (
+	dnsTypeNAPTR  = 35
+	dnsClassINET  = 1
+	dnsRcodeNoErr = 0
+	dnsRcodeNX    = 3
+)
+
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// systemNameServers 读取/etc/resolv.conf, 不存在时(windows)返回空
+func systemNameServers() []string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, joinHostPort(fields[1], 53))
+		}
+	}
+	return servers
+}
+
+func appendDNSName(msg []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0), nil
+}
+
+// readDNSName 读取域名, 支持压缩指针. 返回域名和名字之后的偏移
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("bad dns name")
+		}
+
+		length := int(msg[offset])
+		if length == 0 {
+			offset++
+			break
+		} else if length&0xC0 == 0xC0 {
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, fmt.Errorf("bad dns name pointer")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+			continue
+		}
+
+		offset++
+		if offset+length > len(msg) {
+			return "", 0, fmt.Errorf("bad dns label")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+
+	if next >= 0 {
+		offset = next
+	}
+	return strings.Join(labels, "."), offset, nil
+}
+
+func readCharacterString(msg []byte, offset int) (string, int, error) {
+	if offset >= len(msg) || offset+1+int(msg[offset]) > len(msg) {
+		return "", 0, fmt.Errorf("bad dns character-string")
+	}
+	length := int(msg[offset])
+	return string(msg[offset+1 : offset+1+length]), offset + 1 + length, nil
+}
+
+func parseNAPTR(msg []byte, offset, end int) (*NAPTR, error) {
+	if offset+4 > end {
+		return nil, fmt.Errorf("bad NAPTR record")
+	}
+
+	record := &NAPTR{
+		Order:      binary.BigEndian.Uint16(msg[offset:]),
+		Preference: binary.BigEndian.Uint16(msg[offset+2:]),
+	}
+	offset += 4
+
+	var err error
+	if record.Flags, offset, err = readCharacterString(msg, offset); err != nil {
+		return nil, err
+	}
+	if record.Service, offset, err = readCharacterString(msg, offset); err != nil {
+		return nil, err
+	}
+	if record.Regexp, offset, err = readCharacterString(msg, offset); err != nil {
+		return nil, err
+	}
+	if record.Replacement, _, err = readDNSName(msg, offset); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// newDNSID 随机的事务ID, 使用crypto/rand避免被猜测后伪造应答
+func newDNSID() (uint16, error) {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// exchangeDNS 发送查询并读取应答. TCP的消息前有2字节长度(RFC 1035 4.2.2)
+func exchangeDNS(network, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		msg := make([]byte, 4096)
+		n, err := conn.Read(msg)
+		if err != nil {
+			return nil, err
+		}
+		return msg[:n], nil
+	}
+
+	data := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(data, uint16(len(query)))
+	copy(data[2:], query)
+	if _, err = conn.Write(data); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, data[:2]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(data))
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// checkDNSResponse 应答的ID和问题必须与查询一致, 返回问题之后的偏移
+func checkDNSResponse(msg []byte, id uint16, domain string) (int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return 0, fmt.Errorf("bad dns response")
+	} else if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return 0, fmt.Errorf("the dns response does not match the question")
+	}
+
+	name, offset, err := readDNSName(msg, 12)
+	if err != nil {
+		return 0, err
+	} else if offset+4 > len(msg) || !strings.EqualFold(name, strings.TrimSuffix(domain, ".")) ||
+		binary.BigEndian.Uint16(msg[offset:]) != dnsTypeNAPTR || binary.BigEndian.Uint16(msg[offset+2:]) != dnsClassINET {
+		return 0, fmt.Errorf("the dns response does not match the question")
+	}
+	return offset + 4, nil
+}
+
+func queryNAPTR(server, domain string, timeout time.Duration) ([]*NAPTR, error) {
+	id, err := newDNSID()
+	if err != nil {
+		return nil, err
+	}
+	//header: id, RD, 1 question
+	query := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	query, err = appendDNSName(query, domain)
+	if err != nil {
+		return nil, err
+	}
+	query = append(query, 0, dnsTypeNAPTR, 0, dnsClassINET)
+
+	msg, err := exchangeDNS("udp", server, query, timeout)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := checkDNSResponse(msg, id, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	//TC 应答被截断, 使用TCP重新查询
+	if msg[2]&0x02 != 0 {
+		if msg, err = exchangeDNS("tcp", server, query, timeout); err != nil {
+			return nil, err
+		} else if offset, err = checkDNSResponse(msg, id, domain); err != nil {
+			return nil, err
+		}
+	}
+
+	rcode := msg[3] & 0x0F
+	if rcode == dnsRcodeNX {
+		return nil, nil
+	} else if rcode != dnsRcodeNoErr {
+		return nil, fmt.Errorf("dns query failed rcode:%d", rcode)
+	}
+
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	var records []*NAPTR
+	for i := 0; i < answers; i++ {
+		if _, offset, err = readDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, fmt.Errorf("bad dns answer")
+		}
+
+		rrType := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, fmt.Errorf("bad dns answer")
+		}
+
+		if rrType == dnsTypeNAPTR {
+			record, err := parseNAPTR(msg, offset, offset+length)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		offset += length
+	}
+
+	return records, nil
+}
@@ -1,6 +1,7 @@
 package sip
 
 // RequestEvent Event和事务可以获得Dialog
+//2xx的ACK没有服务端事务, ServerTransaction为空
 //在首次创建Dialog,例如Invite响应2xx后，可以从事务中获取Dialog
 //在后续的对话中请求，使用Event的dialog
 type RequestEvent struct {
@@ -14,3 +15,16 @@ type ResponseEvent struct {
 	Dialog            *Dialog
 	ClientTransaction *ClientTransaction
 }
+
+// CancelEvent 对端取消了INVITE请求, 协议栈已经对CANCEL响应200, 对INVITE响应487.
+// ServerTransaction是被取消的INVITE事务
+type CancelEvent struct {
+	Request           *Request
+	ServerTransaction *ServerTransaction
+}
+
+// AckEvent 收到INVITE 2xx应答的ACK, 协议栈已经停止重传2xx
+type AckEvent struct {
+	Request *Request
+	Dialog  *Dialog
+}
@@ -0,0 +1,94 @@
+package sip
+
+// RFC 3261 13.2.2.4 INVITE被代理分叉后, 每个响应的To tag建立一个早期或者确认的对话.
+// 第一个2xx交给事务的调用者, 之后的2xx通过ForkListener通知TU或者自动ACK和BYE
+
+func (t *ClientTransaction) findFork(tag string) *Dialog {
+	t.forkMutex.Lock()
+	defer t.forkMutex.Unlock()
+	return t.forks[tag]
+}
+
+func (t *ClientTransaction) addFork(tag string, dialog *Dialog) {
+	t.forkMutex.Lock()
+	defer t.forkMutex.Unlock()
+	if t.forks == nil {
+		t.forks = make(map[string]*Dialog, 2)
+	}
+	t.forks[tag] = dialog
+}
+
+// Dialogs INVITE分叉后建立的所有早期和确认的对话
+func (t *ClientTransaction) Dialogs() []*Dialog {
+	t.forkMutex.Lock()
+	defer t.forkMutex.Unlock()
+	dialogs := make([]*Dialog, 0, len(t.forks))
+	for _, dialog := range t.forks {
+		dialogs = append(dialogs, dialog)
+	}
+	return dialogs
+}
+
+// DiscardForks 对keep以外已经确认的对话发送ACK和BYE, 之后收到的其他分叉的2xx也自动ACK和BYE
+func (t *ClientTransaction) DiscardForks(keep *Dialog) {
+	t.forkMutex.Lock()
+	t.discardForks = true
+	var discards []*Dialog
+	for _, dialog := range t.forks {
+		if dialog != keep && dialog.state == dialogStateConfirmed {
+			discards = append(discards, dialog)
+		}
+	}
+	t.forkMutex.Unlock()
+
+	for _, dialog := range discards {
+		t.discardFork(dialog)
+	}
+}
+
+// discardFork 2xx必须ACK, 不需要的对话随后发送BYE
+func (t *ClientTransaction) discardFork(dialog *Dialog) {
+	dialog.SendAck(dialog.CreateAck(t.originalRequest.CSeq().Number))
+	if bye, err := dialog.CreateRequest(BYE); err == nil {
+		if transaction, err := dialog.listeningPoint.NewClientTransaction(bye); err == nil {
+			go transaction.Execute()
+		}
+	}
+	dialog.Delete()
+}
+
+// processForkedResponse Accepted状态收到的2xx. 已经确认或者结束的对话只重发ACK
+func (t *ClientTransaction) processForkedResponse(response *Response, dialog *Dialog) {
+	if dialog == nil {
+		return
+	} else if dialog.state == dialogStateConfirmed || dialog.state == dialogStateTerminated {
+		dialog.resendAck(response.CSeq().Number)
+		return
+	}
+
+	dialog.state = dialogStateConfirmed
+	t.forkMutex.Lock()
+	discard := t.discardForks
+	t.forkMutex.Unlock()
+
+	listener, ok := t.sipStack.EventListener.(ForkListener)
+	if discard || !ok {
+		t.discardFork(dialog)
+		return
+	}
+
+	dialog.updateSessionTimer(response)
+	go listener.OnForkedResponse(&ResponseEvent{response, dialog, t})
+}
+
+// terminateEarlyForks 事务结束时还没有确认的早期对话随之结束
+func (t *ClientTransaction) terminateEarlyForks() {
+	t.forkMutex.Lock()
+	defer t.forkMutex.Unlock()
+	for _, dialog := range t.forks {
+		if dialog.state == dialogStateEarly {
+			t.sipStack.removeDialog(dialog.GetDialogId())
+			dialog.Terminated()
+		}
+	}
+}
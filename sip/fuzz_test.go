@@ -0,0 +1,101 @@
+//go:build go1.18
+// +build go1.18
+
+package sip
+
+import (
+	"testing"
+)
+
+// go test -fuzz=FuzzParseMessage ./sip
+
+func FuzzParseMessage(f *testing.F) {
+	for _, c := range tortureMessages {
+		f.Add([]byte(c.message))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		//能够解析的消息可以再次序列化
+		if msg, _, err := parseMessage(data, len(data)); err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("the parse error should be structured: %v", err)
+			}
+		} else {
+			msg.ToString()
+		}
+
+		//延迟解析的消息访问所有消息头
+		msg, _, err := parseMessageLazy(data, len(data))
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("the parse error should be structured: %v", err)
+			}
+			return
+		}
+		var order []string
+		switch m := msg.(type) {
+		case *Request:
+			order = m.order
+		case *Response:
+			order = m.order
+		}
+		for _, name := range order {
+			msg.GetHeader(name)
+		}
+		msg.ToBytes()
+	})
+}
+
+func FuzzParseUri(f *testing.F) {
+	for _, uri := range []string{
+		"sip:34020000001320000001@192.168.1.108:5060",
+		"sips:alice@example.com;transport=tls?subject=project",
+		"sip:[2001:db8::1]:5060;lr",
+		"sip:user:password@host;maddr=239.255.255.1;ttl=15",
+		"sip:@",
+		"sip:a?b;c",
+		"sip:%61lice@atlanta.com?subject=project%20x",
+		"tel:+358-555-1234567;postd=pp22",
+		"tel:7042;phone-context=example.com",
+	} {
+		f.Add(uri)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		if uri, err := parseUri(str); err == nil {
+			//序列化之后可以还原为相等的URI
+			if parsed, err := parseUri(uri.ToString()); err != nil || !parsed.Equals(uri) {
+				t.Fatalf("%s: the formatted URI %s is different: %v", str, uri.ToString(), err)
+			}
+			uri.Clone()
+			uri.TelUri()
+		}
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	for _, header := range [][2]string{
+		{ViaName, "SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1;rport"},
+		{ContactName, "\"Doe, John\" <sip:alice@example.com>;expires=60, *"},
+		{FromName, "<sip:alice@example.com;lr>;tag=1"},
+		{CSeqName, "1 INVITE"},
+		{RAckName, "1 1 INVITE"},
+		{AuthorizationName, "Digest username=\"a\", realm=\"b\", nonce=\"c==\", uri=\"sip:a@b\""},
+		{SessionExpiresName, "1800;refresher=uac"},
+		{RouteName, "<sip:p1.example.com;lr>, <sip:p2.example.com;lr>"},
+		{"X-Unknown", "value"},
+	} {
+		f.Add(header[0], header[1])
+	}
+	f.Fuzz(func(t *testing.T, name, value string) {
+		msg := NewRequest()
+		if err := parseHeader(msg, name, value); err != nil {
+			return
+		}
+		for _, headers := range msg.headers {
+			for _, header := range headers {
+				header.Name()
+				header.Value()
+				header.Clone()
+			}
+		}
+	})
+}
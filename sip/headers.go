@@ -50,7 +50,12 @@ const (
 	RequireName              = "Require"
 	RetryAfterName           = "Retry-After"
 	RouteName                = "Route"
+	RSeqName                 = "RSeq"
+	RAckName                 = "RAck"
 	ServerName               = "Server"
+	SessionExpiresName       = "Session-Expires"
+	SessionExpiresShortName  = "x"
+	MinSEName                = "Min-SE"
 	SubjectName              = "Subject"
 	SubjectShortname         = "s"
 	SupportedName            = "Supported"
@@ -67,6 +72,26 @@ const (
 	WWWAuthenticateName      = "WWW-Authenticate"
 )
 
+// 扩展消息头的紧凑形式 https://www.iana.org/assignments/sip-parameters
+const (
+	AcceptContactName           = "Accept-Contact"
+	AcceptContactShortName      = "a"
+	AllowEventsShortName        = "u"
+	EventShortName              = "o"
+	IdentityName                = "Identity"
+	IdentityShortName           = "y"
+	IdentityInfoName            = "Identity-Info"
+	IdentityInfoShortName       = "n"
+	ReferToName                 = "Refer-To"
+	ReferToShortName            = "r"
+	ReferredByName              = "Referred-By"
+	ReferredByShortName         = "b"
+	RejectContactName           = "Reject-Contact"
+	RejectContactShortName      = "j"
+	RequestDispositionName      = "Request-Disposition"
+	RequestDispositionShortName = "d"
+)
+
 var (
 	defaultContentLengthHeader = ContentLength(0)
 	defaultMaxForwardsHeader   = MaxForwards(70)
@@ -78,11 +103,16 @@ type Header interface {
 	Clone() Header
 }
 
+// StrHeader 没有注册解析器的消息头, 保存原始的名称和值
 type StrHeader struct {
 	n string
 	v string
 }
 
+func NewStrHeader(name, value string) *StrHeader {
+	return &StrHeader{n: name, v: value}
+}
+
 func (h *StrHeader) Value() string {
 	return h.v
 }
@@ -92,7 +122,8 @@ func (h *StrHeader) Name() string {
 }
 
 func (h *StrHeader) Clone() Header {
-	return &*h
+	clone := *h
+	return &clone
 }
 
 type Via struct {
@@ -114,6 +145,9 @@ func (via *Via) FindFiled(key string) (string, bool) {
 }
 
 func (via *Via) Value() string {
+	if len(via.files) == 0 {
+		return fmt.Sprintf("%s/%s %s", SipVersion, via.transport, via.sendBy.ToString())
+	}
 	return fmt.Sprintf("%s/%s %s;%s", SipVersion, via.transport, via.sendBy.ToString(), mapToParamsStr(via.files, ";"))
 }
 
@@ -267,6 +301,97 @@ func (r *Route) Clone() Header {
 	return &clone
 }
 
+// RecordRoute 代理插入的Record-Route, 用于建立对话的route set
+type RecordRoute struct {
+	Address []*SipUri
+}
+
+func (r *RecordRoute) Name() string {
+	return RecordRouteName
+}
+
+func (r *RecordRoute) Value() string {
+	return (&Route{Address: r.Address}).Value()
+}
+
+func (r *RecordRoute) Clone() Header {
+	return &RecordRoute{Address: (&Route{Address: r.Address}).Clone().(*Route).Address}
+}
+
+// RSeq RFC 3262 可靠临时应答的序号
+type RSeq uint32
+
+func (r *RSeq) Value() string {
+	return strconv.FormatUint(uint64(*r), 10)
+}
+
+func (r *RSeq) Name() string {
+	return RSeqName
+}
+
+func (r *RSeq) Clone() Header {
+	clone := *r
+	return &clone
+}
+
+// RAck RFC 3262 PRACK确认的可靠临时应答: RSeq CSeq-number Method
+type RAck struct {
+	RSeq   uint32
+	CSeq   int
+	Method string
+}
+
+func (r *RAck) Value() string {
+	return fmt.Sprintf("%d %d %s", r.RSeq, r.CSeq, r.Method)
+}
+
+func (r *RAck) Name() string {
+	return RAckName
+}
+
+func (r *RAck) Clone() Header {
+	clone := *r
+	return &clone
+}
+
+// SessionExpires RFC 4028 会话间隔(秒)和负责刷新的一方: uac/uas
+type SessionExpires struct {
+	Delta     int
+	Refresher string
+}
+
+func (s *SessionExpires) Value() string {
+	if s.Refresher == "" {
+		return strconv.Itoa(s.Delta)
+	}
+	return fmt.Sprintf("%d;refresher=%s", s.Delta, s.Refresher)
+}
+
+func (s *SessionExpires) Name() string {
+	return SessionExpiresName
+}
+
+func (s *SessionExpires) Clone() Header {
+	clone := *s
+	return &clone
+}
+
+// MinSE RFC 4028 允许的最小会话间隔(秒)
+type MinSE int
+
+func (m *MinSE) Value() string {
+	return strconv.Itoa(int(*m))
+}
+
+func (m *MinSE) Name() string {
+	return MinSEName
+}
+
+func (m *MinSE) Clone() Header {
+	clone := *m
+	return &clone
+}
+
 type CallID string
 
 func (c *CallID) Value() string {
@@ -377,9 +502,15 @@ type Contact struct {
 	Address *Address
 	Q       float32
 	Expires int
+	//Wildcard REGISTER删除所有绑定的Contact: *(RFC 3261 10.2.2), 此时Address为空
+	Wildcard bool
 }
 
 func (c *Contact) Value() string {
+	if c.Wildcard {
+		return "*"
+	}
+
 	var buffer bytes.Buffer
 	if c.Address.DisPlayName != "" {
 		buffer.WriteString(c.Address.DisPlayName)
@@ -405,7 +536,9 @@ func (c *Contact) Name() string {
 
 func (c *Contact) Clone() Header {
 	clone := *c
-	clone.Address = c.Address.Clone()
+	if c.Address != nil {
+		clone.Address = c.Address.Clone()
+	}
 	return &clone
 }
 
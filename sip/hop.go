@@ -1,28 +1,78 @@
 package sip
 
+import (
+	"strings"
+)
+
 type Hop struct {
 	IP        string
 	Port      int
 	Transport string
+	//Host DNS解析前URI中的域名, TLS/WSS使用它作为SNI和校验证书的名称
+	Host string
 }
 
 func (h *Hop) isTCP() bool {
 	return h.Transport == TCP
 }
 
-func findNextHop(request *Request) (*Hop, error) {
-	header := request.GetHeader(RouteName)
-	var hostPort HostPort
-	if header != nil {
-		hostPort = header[0].(*Route).Address[0].HostPort
-	} else {
-		hostPort = request.GetRequestLine().RequestUri.HostPort
+// serverName TLS连接校验证书的名称, 目标是IP地址时为IP
+func (h *Hop) serverName() string {
+	if h.Host != "" {
+		return h.Host
+	}
+	return h.IP
+}
+
+// uriTransport 根据URI的transport参数确定传输方式, 没有transport参数使用默认传输方式.
+// RFC 7118 WS和WSS都使用transport=ws, sips uri对应WSS
+func uriTransport(uri *SipUri, transport string) string {
+	param, ok := uri.Params["transport"]
+	if !ok || param == "" {
+		return transport
+	}
+
+	param = strings.ToUpper(param)
+	switch param {
+	case WS:
+		if uri.IsSecure() || transport == WSS {
+			return WSS
+		}
+	case TCP:
+		if uri.IsSecure() || transport == TLS {
+			return TLS
+		}
 	}
 
-	if hostPort.Port == 0 {
-		hostPort.Port = 5060
-		//TLS 5061
+	return param
+}
+
+func defaultPort(transport string) int {
+	switch transport {
+	case TLS:
+		return 5061
+	case WS:
+		return 80
+	case WSS:
+		return 443
+	default:
+		return 5060
 	}
+}
 
-	return &Hop{hostPort.Host, hostPort.Port, request.Via().transport}, nil
+// isLooseRouter lr参数表示RFC 3261 loose router, 没有lr的是RFC 2543 strict router
+func isLooseRouter(uri *SipUri) bool {
+	_, ok := uri.Params["lr"]
+	return ok
+}
+
+// nextHopUri RFC 3261 8.1.2 第一个Route是loose router时发往第一个Route.
+// 第一个Route不是loose router, 说明已经按照12.2.1.1改写, Request-URI就是strict router
+func nextHopUri(request *Request) *SipUri {
+	if header := request.GetHeader(RouteName); header != nil {
+		if uri := header[0].(*Route).Address[0]; isLooseRouter(uri) {
+			return uri
+		}
+	}
+	return request.GetRequestLine().RequestUri
 }
@@ -0,0 +1,250 @@
+package sip
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// lazyHeader 延迟解析的消息头, 值引用接收缓冲区. 第一次通过GetHeader访问时解析,
+// 序列化时没有解析过或者解析失败的消息头写入原始内容
+type lazyHeader struct {
+	name  string
+	key   string
+	value []byte
+
+	mutex   sync.Mutex
+	parsed  bool
+	headers []Header
+	err     error
+}
+
+func (h *lazyHeader) Name() string {
+	return h.name
+}
+
+func (h *lazyHeader) Value() string {
+	if headers := h.result(); len(headers) > 0 {
+		values := make([]string, 0, len(headers))
+		for _, header := range headers {
+			values = append(values, header.Value())
+		}
+		return strings.Join(values, ", ")
+	}
+	return string(h.value)
+}
+
+// Clone 原始内容不会被修改, 副本共享原始内容, 重新解析
+func (h *lazyHeader) Clone() Header {
+	return &lazyHeader{name: h.name, key: h.key, value: h.value}
+}
+
+func (h *lazyHeader) writeValue(buffer *bytes.Buffer) {
+	buffer.Write(h.value)
+}
+
+// parse 只解析一次, 多个协程可以同时访问同一个消息
+func (h *lazyHeader) parse() []Header {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.parsed {
+		h.parsed = true
+		h.headers, h.err = parseHeaderValues(h.name, string(h.value))
+	}
+	return h.headers
+}
+
+// result 已经解析成功时返回解析结果, 不触发解析
+func (h *lazyHeader) result() []Header {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.parsed && h.err == nil {
+		return h.headers
+	}
+	return nil
+}
+
+// expandHeaders 把lazyHeader替换为解析后的消息头. parse为false时不解析, 没有解析过的保留lazyHeader.
+// 解析失败的消息头在parse为true时被忽略
+func expandHeaders(headers []Header, parse bool) []Header {
+	lazy := false
+	for _, header := range headers {
+		if _, ok := header.(*lazyHeader); ok {
+			lazy = true
+			break
+		}
+	}
+	if !lazy {
+		return headers
+	}
+
+	expanded := make([]Header, 0, len(headers))
+	for _, header := range headers {
+		h, ok := header.(*lazyHeader)
+		if !ok {
+			expanded = append(expanded, header)
+			continue
+		}
+
+		var parsed []Header
+		if parse {
+			parsed = h.parse()
+		} else {
+			parsed = h.result()
+		}
+		if len(parsed) > 0 {
+			expanded = append(expanded, parsed...)
+		} else if !parse {
+			expanded = append(expanded, h)
+		}
+	}
+
+	if len(expanded) == 0 {
+		return nil
+	}
+	return expanded
+}
+
+func (m *message) appendLazy(h *lazyHeader) {
+	if _, ok := m.headers[h.key]; !ok {
+		m.order = append(m.order, h.key)
+	}
+	m.headers[h.key] = append(m.headers[h.key], h)
+}
+
+// headerKeyBytes 使用注册写法的消息头名称查找时不分配内存
+func headerKeyBytes(name []byte) string {
+	if canonical, ok := canonicalNames[string(name)]; ok {
+		return canonical
+	}
+	return headerKey(string(name))
+}
+
+// lineReader 按行读取消息, 返回的行去掉了CRLF, 和接收缓冲区共享内存
+type lineReader struct {
+	data   []byte
+	offset int
+	number int
+}
+
+func (r *lineReader) next() ([]byte, int, bool) {
+	if r.offset >= len(r.data) {
+		return nil, r.offset, false
+	}
+
+	start := r.offset
+	end := bytes.IndexByte(r.data[start:], '\n')
+	if end < 0 {
+		end = len(r.data) - start
+		r.offset = len(r.data)
+	} else {
+		r.offset = start + end + 1
+	}
+	r.number++
+
+	line := r.data[start : start+end]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, start, true
+}
+
+// folded 下一行以空格或者制表符开头, 是当前消息头的折叠
+func (r *lineReader) folded() bool {
+	return r.offset < len(r.data) && (r.data[r.offset] == ' ' || r.data[r.offset] == '\t')
+}
+
+// parseMessageLazy 只解析起始行和事务层需要的消息头, 其他消息头记录在接收缓冲区中的位置,
+// 通过GetHeader访问时才解析. 解析失败返回*ParseError, 位置和parseMessage相同
+func parseMessageLazy(data []byte, length int) (Message, bool, error) {
+	if length > len(data) {
+		length = len(data)
+	}
+	reader := &lineReader{data: data[:length]}
+	first, _, ok := reader.next()
+	if !ok || len(first) == 0 {
+		return nil, false, &ParseError{Line: 1, Err: fmt.Errorf("the message parse failed")}
+	}
+
+	var msg Message
+	var m *message
+	isRequest := false
+	if bytes.HasPrefix(first, []byte(SipVersion)) {
+		statusLine, err := parseStatusLine(string(first))
+		if err != nil {
+			return nil, false, &ParseError{1, 0, err}
+		}
+		response := &Response{message: message{line: statusLine, headers: make(map[string][]Header, 16), lazy: true}}
+		msg, m = response, &response.message
+	} else {
+		isRequest = true
+		requestLine, err := parseRequestLine(string(first))
+		if err != nil {
+			return nil, false, &ParseError{1, 0, err}
+		}
+		request := &Request{message: message{line: requestLine, headers: make(map[string][]Header, 16), lazy: true}}
+		msg, m = request, &request.message
+	}
+
+	for {
+		line, start, ok := reader.next()
+		if !ok || len(line) == 0 {
+			break
+		}
+
+		number := reader.number
+		if reader.folded() {
+			text := string(line)
+			for reader.folded() {
+				next, _, _ := reader.next()
+				text = strings.TrimRight(text, " \t") + " " + strings.TrimLeft(string(next), " \t")
+			}
+			line = []byte(text)
+		}
+
+		i := bytes.IndexByte(line, ':')
+		if i < 0 {
+			return nil, false, &ParseError{number, start, fmt.Errorf("the header line must contain a colon")}
+		}
+		name := bytes.TrimSpace(line[:i])
+		value := bytes.TrimSpace(line[i+1:])
+		if len(name) == 0 {
+			return nil, false, &ParseError{number, start, fmt.Errorf("the header name is empty")}
+		}
+
+		key := headerKeyBytes(name)
+		//Contact、Route和Record-Route决定对话和下一跳, 格式错误时和parseMessage一样拒绝消息
+		switch key {
+		case ViaName, FromName, ToName, CallIDName, CSeqName, MaxForwardsName, ContentLengthName, ContentTypeName, ExpiresName, UserAgentName,
+			ContactName, RouteName, RecordRouteName:
+			if err := parseHeader(msg, key, string(value)); err != nil {
+				return nil, false, &ParseError{number, start, fmt.Errorf("bad %s header: %s", string(name), err.Error())}
+			}
+		default:
+			h := &lazyHeader{key: key, value: value}
+			if _, ok := parsers[key]; ok {
+				h.name = key
+			} else {
+				h.name = string(name)
+			}
+			m.appendLazy(h)
+		}
+	}
+
+	if err := msg.CheckHeaders(); err != nil {
+		return nil, false, &ParseError{Err: err}
+	}
+
+	offset := reader.offset
+	if header := msg.ContentLength(); header != nil && *header != 0 {
+		contentLength := int(*header)
+		if offset+contentLength > length {
+			return nil, false, &ParseError{Offset: offset, Err: fmt.Errorf("the packet size is smaller than content length")}
+		}
+
+		msg.setBody(data[offset : offset+contentLength])
+	}
+
+	return msg, isRequest, nil
+}
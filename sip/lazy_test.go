@@ -0,0 +1,398 @@
+package sip
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 摄像头注册、心跳和点播使用的典型消息
+var (
+	benchRegister = crlf(`REGISTER sip:34020000002000000001@3402000000 SIP/2.0
+Via: SIP/2.0/UDP 192.168.1.108:5060;rport;branch=z9hG4bK1371463273
+From: <sip:34020000001320000001@3402000000>;tag=2043466181
+To: <sip:34020000001320000001@3402000000>
+Call-ID: 1011047669
+CSeq: 2 REGISTER
+Contact: <sip:34020000001320000001@192.168.1.108:5060>
+Authorization: Digest username="34020000001320000001", realm="3402000000", nonce="44010b73623249f6916a6acf7c316b8e", uri="sip:34020000002000000001@3402000000", response="e4ca3fdc5869fa1c544ea7af60014444", algorithm=MD5
+Max-Forwards: 70
+User-Agent: IP Camera
+Expires: 3600
+Allow: INVITE, ACK, BYE, CANCEL, OPTIONS, MESSAGE, INFO, SUBSCRIBE, NOTIFY
+Supported: timer, 100rel
+Content-Length: 0
+
+`)
+
+	benchMessage = withBody(`MESSAGE sip:34020000002000000001@3402000000 SIP/2.0
+Via: SIP/2.0/UDP 192.168.1.108:5060;rport;branch=z9hG4bK1649829281
+From: <sip:34020000001320000001@3402000000>;tag=1447452393
+To: <sip:34020000002000000001@3402000000>
+Call-ID: 1862931391
+CSeq: 20 MESSAGE
+Content-Type: Application/MANSCDP+xml
+Max-Forwards: 70
+User-Agent: IP Camera
+Content-Length: {length}
+
+`, `<?xml version="1.0" encoding="GB2312"?>
+<Notify>
+<CmdType>Keepalive</CmdType>
+<SN>31</SN>
+<DeviceID>34020000001320000001</DeviceID>
+<Status>OK</Status>
+<Info>
+</Info>
+</Notify>
+`)
+
+	benchInvite = withBody(`INVITE sip:34020000001320000001@192.168.1.108:5060 SIP/2.0
+Via: SIP/2.0/UDP 192.168.1.100:5060;rport;branch=z9hG4bK3498213902
+Route: <sip:proxy1.example.com;lr>, <sip:proxy2.example.com;lr>
+Record-Route: <sip:192.168.1.100:5060;lr>
+From: <sip:34020000002000000001@3402000000>;tag=185326220
+To: <sip:34020000001320000001@3402000000>
+Call-ID: 0a7dfe5ea3e9457c9d4c8f0e0b5c2b8a
+CSeq: 20 INVITE
+Contact: <sip:34020000002000000001@192.168.1.100:5060>
+Content-Type: APPLICATION/SDP
+Max-Forwards: 70
+User-Agent: gsip
+Subject: 34020000001320000001:0200000001,34020000002000000001:0
+Supported: timer
+Session-Expires: 1800;refresher=uac
+Allow: INVITE, ACK, BYE, CANCEL, UPDATE, PRACK, OPTIONS
+Content-Length: {length}
+
+`, `v=0
+o=34020000001320000001 0 0 IN IP4 192.168.1.100
+s=Play
+c=IN IP4 192.168.1.100
+t=0 0
+m=video 30000 RTP/AVP 96 98 97
+a=recvonly
+a=rtpmap:96 PS/90000
+a=rtpmap:98 H264/90000
+a=rtpmap:97 MPEG4/90000
+y=0200000001
+f=
+`)
+
+	benchMessages = []struct {
+		name    string
+		message string
+	}{
+		{"REGISTER", benchRegister},
+		{"MESSAGE", benchMessage},
+		{"INVITE", benchInvite},
+	}
+)
+
+// legacyToBytes 没有缓冲池和直接写入时的序列化, 作为对照
+func legacyToBytes(m *message) []byte {
+	var buffer bytes.Buffer
+	write := func(header Header) {
+		buffer.Write([]byte(header.Name()))
+		buffer.Write([]byte(": "))
+		buffer.Write([]byte(header.Value()))
+		buffer.Write([]byte("\r\n"))
+	}
+	writeHeaders := func(headers []Header) {
+		if len(headers) > 1 && listHeaders[headerKey(headers[0].Name())] {
+			values := make([]string, 0, len(headers))
+			for _, header := range headers {
+				values = append(values, header.Value())
+			}
+			write(NewStrHeader(headers[0].Name(), strings.Join(values, ", ")))
+			return
+		}
+		for _, header := range headers {
+			write(header)
+		}
+	}
+
+	buffer.Write([]byte(m.line.ToString()))
+	buffer.Write([]byte("\r\n"))
+	writeHeaders(m.GetHeader(ViaName))
+	writeHeaders(m.GetHeader(RouteName))
+	writeHeaders(m.GetHeader(RecordRouteName))
+	writeHeaders(m.GetHeader(ProxyRequireName))
+	if m.maxForwards != nil {
+		write(m.maxForwards)
+	}
+	write(m.from)
+	write(m.to)
+	write(m.callId)
+	write(m.cSeq)
+	for _, n := range m.order {
+		switch n {
+		case ViaName, RouteName, RecordRouteName, ProxyRequireName, MaxForwardsName, FromName, ToName, CallIDName, CSeqName, ContentLengthName:
+		default:
+			writeHeaders(m.headers[n])
+		}
+	}
+	write(m.ContentLength())
+	buffer.Write([]byte("\r\n"))
+	buffer.Write(m.body)
+	return buffer.Bytes()
+}
+
+func parseLazy(t testing.TB, data string) Message {
+	msg, _, err := parseMessageLazy([]byte(data), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestPooledSerializer(t *testing.T) {
+	//每个参数表只有一个参数, 序列化结果是确定的
+	request := withBody(`INVITE sip:34020000001320000001@[2001:db8::1]:5060 SIP/2.0
+Via: SIP/2.0/TCP 192.168.1.100:5060;branch=z9hG4bK3498213902
+Route: <sip:proxy1.example.com;lr>
+Route: <sip:proxy2.example.com>
+From: "Platform" <sip:34020000002000000001@3402000000>;tag=185326220
+To: <sip:34020000001320000001@3402000000>
+Call-ID: 0a7dfe5ea3e9457c9d4c8f0e0b5c2b8a
+CSeq: 20 INVITE
+Contact: <sip:34020000002000000001@192.168.1.100:5060>;q=0.7;expires=60
+Content-Type: application/sdp
+Max-Forwards: 70
+Expires: 120
+Allow: INVITE, ACK, BYE
+X-Custom: custom value
+Content-Length: {length}
+
+`, "v=0\n")
+	response := crlf(`SIP/2.0 486 Busy Here
+Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK1
+From: <sip:a@example.com>;tag=1
+To: <sip:b@example.com>;tag=2
+Call-ID: 1
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+
+	for _, data := range []string{request, response} {
+		msg, _, err := parseMessage([]byte(data), len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m *message
+		if r, ok := msg.(*Request); ok {
+			m = &r.message
+		} else {
+			m = &msg.(*Response).message
+		}
+		if expected, actual := legacyToBytes(m), msg.ToBytes(); !bytes.Equal(expected, actual) {
+			t.Fatalf("the pooled serializer changed the output\n%s\n%s", expected, actual)
+		}
+		if msg.ToString() != string(msg.ToBytes()) {
+			t.Fatalf("ToString is different from ToBytes")
+		}
+	}
+
+	//返回的切片不和池中的缓冲区共享内存
+	msg := parseTestRequest(t, request)
+	data := msg.ToBytes()
+	copied := string(data)
+	for i := 0; i < 10; i++ {
+		parseTestRequest(t, benchInvite).ToBytes()
+	}
+	if string(data) != copied {
+		t.Fatalf("the serialized data was overwritten")
+	}
+}
+
+func TestLazyParse(t *testing.T) {
+	for _, c := range append(benchMessages, struct{ name, message string }{"wsinv", tortureMessages[0].message}) {
+		eager, _, err := parseMessage([]byte(c.message), len(c.message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lazy := parseLazy(t, c.message)
+
+		if !reflect.DeepEqual(lazy.Via(), eager.Via()) || !reflect.DeepEqual(lazy.From(), eager.From()) ||
+			*lazy.CSeq() != *eager.CSeq() || *lazy.CallID() != *eager.CallID() ||
+			!bytes.Equal(lazy.(interface{ Content() []byte }).Content(), eager.(interface{ Content() []byte }).Content()) {
+			t.Fatalf("%s: the lazy message is different", c.name)
+		}
+
+		//访问时解析为和parseMessage相同的消息头
+		for _, name := range []string{ContactName, RouteName, RecordRouteName, AllowName, SupportedName, AuthorizationName, SessionExpiresName, SubjectName} {
+			expected, actual := eager.GetHeader(name), lazy.GetHeader(name)
+			if len(expected) != len(actual) {
+				t.Fatalf("%s: %s %d headers, expected %d", c.name, name, len(actual), len(expected))
+			}
+			for i := range expected {
+				if !reflect.DeepEqual(expected[i], actual[i]) {
+					t.Fatalf("%s: %s %s, expected %s", c.name, name, actual[i].Value(), expected[i].Value())
+				}
+			}
+		}
+
+		//没有解析的消息头按照原始内容转发
+		data := lazy.ToBytes()
+		forwarded, _, err := parseMessage(data, len(data))
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", c.name, err, data)
+		} else if forwarded.To().Value() != eager.To().Value() || len(forwarded.GetHeader(ViaName)) != len(eager.GetHeader(ViaName)) {
+			t.Fatalf("%s: bad forwarded message %s", c.name, data)
+		}
+	}
+
+	//和parseMessage返回相同的错误位置
+	for _, c := range tortureMessages {
+		_, _, err := parseMessageLazy([]byte(c.message), len(c.message))
+		if c.valid && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if _, ok := err.(*ParseError); err != nil && !ok {
+			t.Errorf("%s: the error should be a ParseError %v", c.name, err)
+		}
+	}
+	msg := "OPTIONS sip:user@example.com SIP/2.0\r\nVia: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw\r\nCSeq: x OPTIONS\r\n\r\n"
+	_, _, err1 := parseMessage([]byte(msg), len(msg))
+	_, _, err2 := parseMessageLazy([]byte(msg), len(msg))
+	if err1.Error() != err2.Error() {
+		t.Fatalf("different errors %v %v", err1, err2)
+	}
+}
+
+func TestLazyHeader(t *testing.T) {
+	data := strings.Replace(benchRegister, "Supported: timer, 100rel", "Session-Expires: soon\r\nSupported: timer, 100rel", 1)
+	if _, _, err := parseMessage([]byte(data), len(data)); err == nil {
+		t.Fatalf("the bad Session-Expires header should be rejected")
+	}
+
+	//延迟解析的消息头解析失败时不出现在GetHeader中, 转发时保留原始内容
+	msg := parseLazy(t, data)
+	if msg.GetHeader(SessionExpiresName) != nil {
+		t.Fatalf("the bad Session-Expires header should be ignored")
+	}
+	if !strings.Contains(msg.ToString(), "Session-Expires: soon\r\n") {
+		t.Fatalf("the bad Session-Expires header should be forwarded\n%s", msg.ToString())
+	}
+
+	//修改解析后的消息头
+	msg = parseLazy(t, benchInvite)
+	routes := msg.GetHeader(RouteName)
+	routes[0].(*Route).Address[0].HostPort.Host = "proxy3.example.com"
+	if data := msg.ToString(); !strings.Contains(data, "proxy3.example.com") || !strings.Contains(data, "proxy2.example.com") {
+		t.Fatalf("the modified header should be serialized\n%s", data)
+	}
+
+	//事务层创建应答, 复制请求
+	response := msg.(*Request).CreateResponse(OK)
+	if recordRoute := response.GetHeader(RecordRouteName); len(recordRoute) != 1 {
+		t.Fatalf("the response should contain the Record-Route")
+	} else if _, ok := recordRoute[0].(*RecordRoute); !ok {
+		t.Fatalf("bad Record-Route %T", recordRoute[0])
+	}
+	clone := msg.(*Request).Clone()
+	if clone.Contact() == nil || len(clone.GetHeader(AllowName)) != 7 {
+		t.Fatalf("bad clone %s", clone.ToString())
+	}
+}
+
+func TestLazyRoutingHeaders(t *testing.T) {
+	//Contact、Route和Record-Route格式错误时两种解析方式返回相同的错误
+	for _, header := range []string{"Contact: garbage", "m: <sip:user@example.com", "Route: <sip:proxy.example.com;lr", "Record-Route: sip:"} {
+		data := strings.Replace(benchRegister, "Max-Forwards: 70", header+"\r\nMax-Forwards: 70", 1)
+		_, _, err1 := parseMessage([]byte(data), len(data))
+		_, _, err2 := parseMessageLazy([]byte(data), len(data))
+		if err1 == nil || err2 == nil {
+			t.Fatalf("%s: the message should be rejected %v %v", header, err1, err2)
+		} else if err1.Error() != err2.Error() {
+			t.Fatalf("%s: different errors %v %v", header, err1, err2)
+		}
+	}
+}
+
+func TestLazyConcurrentAccess(t *testing.T) {
+	msg := parseLazy(t, benchInvite)
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			msg.Contact()
+			msg.GetHeader(RouteName)
+			msg.GetHeader(SessionExpiresName)
+			msg.ToBytes()
+		}()
+	}
+	group.Wait()
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, c := range benchMessages {
+		data := []byte(c.message)
+		b.Run(c.name+"/eager", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := parseMessage(data, len(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(c.name+"/lazy", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := parseMessageLazy(data, len(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	for _, c := range benchMessages {
+		msg, _, _ := parseMessage([]byte(c.message), len(c.message))
+		b.Run(c.name+"/legacy", func(b *testing.B) {
+			var m *message
+			if r, ok := msg.(*Request); ok {
+				m = &r.message
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				legacyToBytes(m)
+			}
+		})
+		b.Run(c.name+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg.ToBytes()
+			}
+		})
+	}
+}
+
+// BenchmarkRoundTrip 收到消息, 访问事务层需要的消息头, 再转发
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, c := range benchMessages {
+		data := []byte(c.message)
+		b.Run(c.name+"/eager", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg, _, _ := parseMessage(data, len(data))
+				msg.GetTransactionId()
+				legacyToBytes(&msg.(*Request).message)
+			}
+		})
+		b.Run(c.name+"/lazy", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg, _, _ := parseMessageLazy(data, len(data))
+				msg.GetTransactionId()
+				msg.ToBytes()
+			}
+		})
+	}
+}
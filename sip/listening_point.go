@@ -2,6 +2,7 @@ package sip
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
@@ -12,11 +13,17 @@ type ListeningPoint struct {
 	IP        string
 	Port      int
 	Transport string
+	//TLSConfig TLS监听点的证书、客户端证书校验(ClientAuth/ClientCAs)、以及作为客户端连接时的RootCAs/ServerName
+	TLSConfig *tls.Config
+	//OutboundProxy 覆盖Options.OutboundProxy
+	OutboundProxy *SipUri
 
 	transport   ITransport
 	sipStack    *Stack
 	tcpSessions *SafeMap
-	contact     *Contact
+	//WebSocket客户端(浏览器)无法被直接连接, 使用Contact/Via中的.invalid域名找回它的连接
+	wsAliases *SafeMap
+	contact   *Contact
 }
 
 func (l *ListeningPoint) CreateViaHeader() *Via {
@@ -27,19 +34,47 @@ func (l *ListeningPoint) CreateViaHeader() *Via {
 }
 
 func (l *ListeningPoint) GetSendBy() string {
-	return fmt.Sprintf("%s:%d", l.IP, l.Port)
+	return joinHostPort(l.IP, l.Port)
 }
 
 func (l *ListeningPoint) onConnect(conn net.Conn) {
-	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
-	key := generateTcpConnectKey(tcpAddr.IP.String(), tcpAddr.Port)
+	hop := getHostPort(conn.RemoteAddr())
+	key := generateTcpConnectKey(hop.IP, hop.Port)
 	l.tcpSessions.Add(key, conn)
 }
 
 func (l *ListeningPoint) onDisconnect(conn net.Conn) {
-	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
-	key := generateTcpConnectKey(tcpAddr.IP.String(), tcpAddr.Port)
+	hop := getHostPort(conn.RemoteAddr())
+	key := generateTcpConnectKey(hop.IP, hop.Port)
 	l.tcpSessions.Remove(key)
+
+	if ws, ok := conn.(*wsConn); ok && l.wsAliases != nil {
+		for _, alias := range ws.aliases {
+			if c, b := l.wsAliases.Find(alias); b && c == ws {
+				l.wsAliases.Remove(alias)
+			}
+		}
+	}
+}
+
+// bindWSAlias 记录WebSocket客户端在Via和Contact中使用的.invalid域名
+func (l *ListeningPoint) bindWSAlias(ws *wsConn, request *Request) {
+	hosts := []string{request.Via().sendBy.Host}
+	if contact := request.Contact(); contact != nil && contact.Address != nil && contact.Address.Uri != nil {
+		hosts = append(hosts, contact.Address.Uri.HostPort.Host)
+	}
+
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if !strings.HasSuffix(host, ".invalid") {
+			continue
+		}
+
+		if c, b := l.wsAliases.Find(host); !b || c != ws {
+			l.wsAliases.Add(host, ws)
+			ws.aliases = append(ws.aliases, host)
+		}
+	}
 }
 
 func (l *ListeningPoint) onPacket(conn net.Conn, tcp bool, data []byte, length int) {
@@ -65,20 +100,38 @@ func (l *ListeningPoint) getConn(hop *Hop) (net.Conn, error) {
 	} else {
 		key := generateTcpConnectKey(hop.IP, hop.Port)
 		if conn, b := l.tcpSessions.Find(key); b {
-			return conn.(*net.TCPConn), nil
+			return conn.(net.Conn), nil
+		} else if l.wsAliases != nil && strings.HasSuffix(strings.ToLower(hop.IP), ".invalid") {
+			//发往浏览器的请求只能复用浏览器建立的连接
+			if conn, b := l.wsAliases.Find(strings.ToLower(hop.IP)); b {
+				return conn.(net.Conn), nil
+			}
+			return nil, fmt.Errorf("the websocket connection of %s does not exist", hop.IP)
+		} else if strings.ToUpper(hop.Transport) == WS || strings.ToUpper(hop.Transport) == WSS {
+			wsClient := &WSClient{}
+			if strings.ToUpper(hop.Transport) == WSS {
+				wsClient.config = clientTLSConfig(l.TLSConfig, hop.serverName())
+			}
+			wsClient.setHandler(l)
+			return wsClient.dial(hop.serverName(), joinHostPort(hop.IP, hop.Port))
+		} else if strings.ToUpper(hop.Transport) == TLS {
+			tlsClient := &TLSClient{config: l.TLSConfig}
+			tlsClient.setHandler(l)
+			return tlsClient.dial(hop.serverName(), joinHostPort(hop.IP, hop.Port))
 		} else {
 			tcpClient := &TCPClient{}
 			tcpClient.setHandler(l)
-			return tcpClient.dial(fmt.Sprintf("%s:%d", hop.IP, hop.Port))
+			return tcpClient.dial(joinHostPort(hop.IP, hop.Port))
 		}
 	}
 }
 
 func (l *ListeningPoint) NewClientTransaction(request *Request) (*ClientTransaction, error) {
-	return l.NewClientTransactionWithTimeout(request, l.sipStack.Options.RequestTimeout)
+	return l.NewClientTransactionWithTimeout(request, l.sipStack.Options.RequestTimeout, nil)
 }
 
-func (l *ListeningPoint) NewClientTransactionWithTimeout(request *Request, requestTimeout time.Duration) (*ClientTransaction, error) {
+// NewClientTransactionWithTimeout timers不为空时覆盖Stack的事务定时器, 为0的字段仍然使用Stack的值
+func (l *ListeningPoint) NewClientTransactionWithTimeout(request *Request, requestTimeout time.Duration, timers *Timers) (*ClientTransaction, error) {
 
 	if request.via == nil {
 		viaHeader := l.CreateViaHeader()
@@ -99,12 +152,30 @@ func (l *ListeningPoint) NewClientTransactionWithTimeout(request *Request, reque
 		return nil, fmt.Errorf("the client transction is exist")
 	}
 
-	hop, err := findNextHop(request)
+	hops, err := l.sipStack.findNextHops(l.applyOutboundProxy(request), request.via.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	listen, err := l.switchListeningPoint(request, hops[0])
 	if err != nil {
 		return nil, err
 	}
 
-	tcp := strings.ToUpper(request.via.transport) == TCP
+	var deadline time.Time
+	if requestTimeout > 0 {
+		deadline = time.Now().Add(requestTimeout)
+	}
+
+	transaction := listen.newClientTransaction(request, hops[0], hops[1:], deadline)
+	transaction.overrideTimers(timers)
+	return transaction, nil
+}
+
+// newClientTransaction targets是RFC 3263解析出的后续候选目标, 当前目标失败时依次重试.
+// deadline不为0时是整个请求(包括发往后续目标)的截止时间
+func (l *ListeningPoint) newClientTransaction(request *Request, hop *Hop, targets []*Hop, deadline time.Time) *ClientTransaction {
+	tcp := isReliable(request.via.transport)
 	invite := request.cSeq.Method == INVITE
 
 	var stateMachine IStateMachine
@@ -118,6 +189,7 @@ func (l *ListeningPoint) NewClientTransactionWithTimeout(request *Request, reque
 	transactionId := request.GetTransactionId()
 	t := &ClientTransaction{
 		transaction: transaction{
+			timers:          l.sipStack.transactionTimers(hop),
 			id:              transactionId,
 			originalRequest: request,
 			isInvite:        invite,
@@ -130,17 +202,19 @@ func (l *ListeningPoint) NewClientTransactionWithTimeout(request *Request, reque
 			txTimeout:       make(chan bool, 1),
 			//txTerminated:    make(chan bool, 1),
 		},
+		targets: targets,
 	}
-
-	if requestTimeout > 0 {
-		t.timeoutCtx, _ = context.WithTimeout(context.Background(), requestTimeout)
+	if !deadline.IsZero() {
+		t.timeoutCtx, t.timeoutCancel = context.WithDeadline(context.Background(), deadline)
 	}
 
 	stateMachine.setTransaction(t)
+	t.setTimers(t.timers)
 	l.sipStack.addTransaction(transactionId, t, false)
 
-	return t, nil
+	return t
 }
+
 func (l *ListeningPoint) sendMessage(hop *Hop, msg Message) error {
 	conn, err := l.getConn(hop)
 	if err != nil {
@@ -151,15 +225,107 @@ func (l *ListeningPoint) sendMessage(hop *Hop, msg Message) error {
 	return err
 }
 
+// switchListeningPoint URI没有指定传输方式时, 由DNS选择的传输方式可能和当前监听点不同,
+// 此时使用对应传输方式的监听点发送, 并重写Via, branch不变
+func (l *ListeningPoint) switchListeningPoint(request *Request, hop *Hop) (*ListeningPoint, error) {
+	if hop.Transport == strings.ToUpper(l.Transport) {
+		return l, nil
+	}
+
+	listen := l.sipStack.findListeningPoint(hop.Transport, l.IP)
+	if listen == nil {
+		return nil, fmt.Errorf("transport protocol does not match")
+	}
+	request.SetHeader(listen.createViaHeaderWithBranch(request.Via().branch))
+	return listen, nil
+}
+
+// SendRequest 无状态发送请求(例如2xx的ACK), 发送失败时依次尝试RFC 3263解析出的后续目标
 func (l *ListeningPoint) SendRequest(msg *Request) error {
-	if hop, err := findNextHop(msg); err != nil {
+	hops, err := l.sipStack.findNextHops(l.applyOutboundProxy(msg), msg.Via().transport)
+	if err != nil {
 		return err
-	} else {
-		if hop.Transport != l.Transport {
-			return fmt.Errorf("transport protocol does not match")
+	}
+
+	via := msg.Via()
+	for _, hop := range hops {
+		msg.SetHeader(via)
+		var listen *ListeningPoint
+		if listen, err = l.switchListeningPoint(msg, hop); err != nil {
+			continue
+		} else if err = listen.sendStateless(hop, msg); err == nil {
+			return nil
 		}
-		return l.sendMessage(hop, msg)
 	}
+
+	return err
+}
+
+func (l *ListeningPoint) sendStateless(hop *Hop, msg *Request) error {
+	if tcp := l.tcpForLargeRequest(len(msg.ToBytes())); tcp != nil {
+		via := msg.Via()
+		msg.SetHeader(tcp.createViaHeaderWithBranch(via.branch))
+		if err := tcp.sendMessage(&Hop{IP: hop.IP, Port: hop.Port, Transport: TCP, Host: hop.Host}, msg); err == nil {
+			return nil
+		}
+		//TCP连接失败, 使用UDP重试
+		msg.SetHeader(via)
+	}
+	return l.sendMessage(hop, msg)
+}
+
+// outboundProxy 优先级: 请求 > 监听点 > Stack
+func (l *ListeningPoint) outboundProxy(request *Request) *SipUri {
+	if request.outboundProxy != nil {
+		return request.outboundProxy
+	} else if l.OutboundProxy != nil {
+		return l.OutboundProxy
+	}
+	return l.sipStack.Options.OutboundProxy
+}
+
+// applyOutboundProxy 返回下一跳的URI. loose router的出站代理作为第一个Route插入请求(已经存在则不重复插入),
+// strict router只替换下一跳
+func (l *ListeningPoint) applyOutboundProxy(request *Request) *SipUri {
+	proxy := l.outboundProxy(request)
+	if proxy == nil {
+		return nextHopUri(request)
+	} else if !isLooseRouter(proxy) {
+		return proxy
+	}
+
+	routes := []*SipUri{proxy.Clone()}
+	if header := request.GetHeader(RouteName); header != nil {
+		if route := header[0].(*Route); route.Address[0].ToString() == proxy.ToString() {
+			return proxy
+		} else {
+			routes = append(routes, route.Address...)
+			for _, h := range header[1:] {
+				routes = append(routes, h.(*Route).Address...)
+			}
+		}
+	}
+
+	request.SetHeader(&Route{Address: routes})
+	return proxy
+}
+
+// tcpForLargeRequest RFC 3261 18.1.1 UDP请求超过阈值时, 如果存在TCP监听点, 返回TCP监听点. 优先使用相同IP的监听点
+func (l *ListeningPoint) tcpForLargeRequest(size int) *ListeningPoint {
+	threshold := l.sipStack.Options.UDPThreshold
+	if strings.ToUpper(l.Transport) != UDP || threshold <= 0 || size <= threshold {
+		return nil
+	}
+
+	return l.sipStack.findListeningPoint(TCP, l.IP)
+}
+
+func (l *ListeningPoint) createViaHeaderWithBranch(branch string) *Via {
+	via := l.CreateViaHeader()
+	if branch != "" {
+		via.setBranch(branch)
+	}
+	return via
 }
 
 func (l *ListeningPoint) SendResponse(msg *Response) error {
@@ -185,7 +351,7 @@ func (l *ListeningPoint) newServerTransaction(request *Request, hop *Hop, conn n
 
 	var stateMachine IStateMachine
 	transactionId := request.GetTransactionId()
-	tcp := request.GetTransport() == TCP
+	tcp := isReliable(request.GetTransport())
 	invite := request.cSeq.Method == INVITE
 	if invite {
 		stateMachine = &InviteServerStateMachine{StateMachine: StateMachine{isTcp: tcp}}
@@ -194,19 +360,21 @@ func (l *ListeningPoint) newServerTransaction(request *Request, hop *Hop, conn n
 	}
 
 	serverTransaction := &ServerTransaction{
-		transaction{
+		transaction: transaction{
 			id:              transactionId,
 			originalRequest: request,
 			isInvite:        invite,
 			stateMachine:    stateMachine,
 			hop:             hop,
 			conn:            conn,
+			timers:          l.sipStack.Options.Timers,
 			sipStack:        l.sipStack,
 			listeningPoint:  l,
 		},
 	}
 
 	stateMachine.setTransaction(serverTransaction)
+	serverTransaction.setTimers(serverTransaction.timers)
 	l.sipStack.addTransaction(transactionId, serverTransaction, true)
 
 	return serverTransaction, nil
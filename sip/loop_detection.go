@@ -0,0 +1,45 @@
+package sip
+
+import (
+	"strconv"
+)
+
+// RFC 3261 8.2.2.2 合并请求检测和Max-Forwards检查
+
+// mergedRequestKey From tag、Call-ID和CSeq相同的请求是同一个请求经过不同路径到达
+func mergedRequestKey(request *Request) string {
+	cSeq := request.CSeq()
+	return request.From().Tag + "|" + request.CallID().Value() + "|" + strconv.Itoa(int(cSeq.Number)) + " " + cSeq.Method
+}
+
+// checkLoop 新的服务器事务通知TU之前检查Max-Forwards和合并请求, 返回false时已经响应483/482
+func (t *ServerTransaction) checkLoop(request *Request) bool {
+	stack := t.sipStack
+	if !stack.Options.DisableMaxForwardsCheck && OPTIONS != request.GetRequestMethod() {
+		if maxForwards := request.MaxForwards(); maxForwards != nil && maxForwards.ToInt() <= 0 {
+			t.SendResponse(request.CreateResponse(TooManyHops))
+			return false
+		}
+	}
+
+	if stack.Options.DisableMergedRequestCheck || stack.mergedRequests == nil || request.To().Tag != "" {
+		return true
+	}
+	key := mergedRequestKey(request)
+	if _, loaded := stack.mergedRequests.AddIfAbsent(key, t.id); loaded {
+		response := request.CreateResponse(LoopDetected)
+		response.To().Tag = GenerateTag()
+		t.SendResponse(response)
+		return false
+	}
+	t.mergedKey = key
+	return true
+}
+
+// removeMergedRequest 事务结束后, 相同的请求不再视为合并请求
+func (t *ServerTransaction) removeMergedRequest() {
+	if t.mergedKey != "" {
+		t.sipStack.mergedRequests.Remove(t.mergedKey)
+		t.mergedKey = ""
+	}
+}
@@ -43,7 +43,11 @@ type Message interface {
 type message struct {
 	line    Line
 	headers map[string][]Header
-	body    []byte
+	//order 消息头第一次出现的顺序, 序列化时保持原有顺序
+	order []string
+	body  []byte
+	//lazy 使用parseMessageLazy解析, 消息头列表中可能有没有解析的lazyHeader
+	lazy bool
 
 	via           *Via
 	from          *From
@@ -64,71 +68,103 @@ type message struct {
 }
 
 func (m *message) writeToBuffer2(buffer *bytes.Buffer, header Header) {
-	buffer.Write([]byte(header.Name()))
-	buffer.Write([]byte(": "))
-	buffer.Write([]byte(header.Value()))
-	buffer.Write([]byte("\r\n"))
+	buffer.WriteString(header.Name())
+	buffer.WriteString(": ")
+	writeHeaderValue(buffer, header)
+	buffer.WriteString("\r\n")
 }
 
 func (m *message) writeToBuffer(buffer *bytes.Buffer, headers []Header) {
 	if headers == nil {
 		return
 	}
+	if m.lazy {
+		headers = expandHeaders(headers, false)
+	}
+
+	//逗号分隔的列表合并为一行
+	if len(headers) > 1 && listHeaders[headerKey(headers[0].Name())] {
+		buffer.WriteString(headers[0].Name())
+		buffer.WriteString(": ")
+		for i, header := range headers {
+			if i > 0 {
+				buffer.WriteString(", ")
+			}
+			writeHeaderValue(buffer, header)
+		}
+		buffer.WriteString("\r\n")
+		return
+	}
 
 	for _, header := range headers {
 		m.writeToBuffer2(buffer, header)
 	}
 }
 
-func (m *message) ToBytes() []byte {
-	var buffer bytes.Buffer
-	buffer.Write([]byte(m.line.ToString()))
-	buffer.Write([]byte("\r\n"))
+// writeTo 序列化到缓冲区. 延迟解析并且没有访问过的消息头写入原始内容
+func (m *message) writeTo(buffer *bytes.Buffer) {
+	buffer.Grow(len(m.body) + defaultBufferSize)
+	writeLine(buffer, m.line)
+	buffer.WriteString("\r\n")
 
-	if contentLengthHeader := m.GetHeader(ContentLengthName); contentLengthHeader == nil {
+	if m.headers[ContentLengthName] == nil {
 		m.SetHeader(&defaultContentLengthHeader)
 	}
 	//Via > Route > Record-Route > Proxy-Require > Max-Forwards > Proxy-Authorization > From > To > CallID > CSeq *** > ContentLength
-	m.writeToBuffer(&buffer, m.GetHeader(ViaName))
-	m.writeToBuffer(&buffer, m.GetHeader(RouteName))
-	m.writeToBuffer(&buffer, m.GetHeader(RecordRouteName))
-	m.writeToBuffer(&buffer, m.GetHeader(ProxyRequireName))
+	m.writeToBuffer(buffer, m.headers[ViaName])
+	m.writeToBuffer(buffer, m.headers[RouteName])
+	m.writeToBuffer(buffer, m.headers[RecordRouteName])
+	m.writeToBuffer(buffer, m.headers[ProxyRequireName])
 	if m.maxForwards != nil {
-		m.writeToBuffer2(&buffer, m.maxForwards)
+		m.writeToBuffer2(buffer, m.maxForwards)
 	}
 	//m.writeToBuffer(buffer, m.GetHeader(ProxyAuthorization))
-	m.writeToBuffer2(&buffer, m.from)
-	m.writeToBuffer2(&buffer, m.to)
-	m.writeToBuffer2(&buffer, m.callId)
-	m.writeToBuffer2(&buffer, m.cSeq)
+	m.writeToBuffer2(buffer, m.from)
+	m.writeToBuffer2(buffer, m.to)
+	m.writeToBuffer2(buffer, m.callId)
+	m.writeToBuffer2(buffer, m.cSeq)
 
 	// for headers
-	for n, v := range m.headers {
+	for _, n := range m.order {
 		switch n {
 		case ViaName, RouteName, RecordRouteName, ProxyRequireName, MaxForwardsName, FromName, ToName, CallIDName, CSeqName, ContentLengthName:
 			break
 		default:
-			m.writeToBuffer(&buffer, v)
+			m.writeToBuffer(buffer, m.headers[n])
 		}
 	}
 
-	m.writeToBuffer2(&buffer, m.ContentLength())
-	buffer.Write([]byte("\r\n"))
+	m.writeToBuffer2(buffer, m.ContentLength())
+	buffer.WriteString("\r\n")
 	if m.body != nil {
 		buffer.Write(m.body)
 	}
+}
 
-	return buffer.Bytes()
+// ToBytes 使用池中的缓冲区序列化, 返回的切片不和缓冲区共享内存
+func (m *message) ToBytes() []byte {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	m.writeTo(buffer)
+	data := make([]byte, buffer.Len())
+	copy(data, buffer.Bytes())
+	return data
 }
 
 func (m *message) ToString() string {
-	return string(m.ToBytes())
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	m.writeTo(buffer)
+	return buffer.String()
 }
 
 func (m *message) SetHeader(header Header) {
-	headers := []Header{header}
-	m.headers[header.Name()] = headers
-	switch header.Name() {
+	key := headerKey(header.Name())
+	if _, ok := m.headers[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.headers[key] = []Header{header}
+	switch key {
 	case ViaName, ViaShortName:
 		m.via = header.(*Via)
 		break
@@ -163,15 +199,16 @@ func (m *message) SetHeader(header Header) {
 }
 
 func (m *message) AppendHeader(header Header) error {
-	if headers, ok := m.headers[header.Name()]; ok {
-		switch header.Name() {
+	key := headerKey(header.Name())
+	if headers, ok := m.headers[key]; ok {
+		switch key {
 		case FromName, FromShortName, ToName, ToShortName, CallIDName, CallIDShortName, CSeqName, MaxForwardsName, ExpiresName, UserAgentName, ContentTypeName, ContentTypeShortName, ContentLengthName, ContentLengthShortName:
-			if headers[0].Name() == header.Name() {
+			if headerKey(headers[0].Name()) == key {
 				return fmt.Errorf("multiple header field rows are not appropriate in the %s header", header.Name())
 			}
 		}
 		headers = append(headers, header)
-		m.headers[header.Name()] = headers
+		m.headers[key] = headers
 	} else {
 		m.SetHeader(header)
 	}
@@ -179,12 +216,38 @@ func (m *message) AppendHeader(header Header) error {
 	return nil
 }
 
+// GetHeader 消息头名称不区分大小写. 延迟解析的消息头在第一次访问时解析
 func (m *message) GetHeader(name string) []Header {
-	return m.headers[name]
+	headers := m.headers[headerKey(name)]
+	if m.lazy {
+		return expandHeaders(headers, true)
+	}
+	return headers
 }
 
 func (m *message) RemoveHeader(name string) {
-	delete(m.headers, name)
+	key := headerKey(name)
+	if _, ok := m.headers[key]; !ok {
+		return
+	}
+	delete(m.headers, key)
+	for i, n := range m.order {
+		if n == key {
+			m.order = append(m.order[:i:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// copyHeaders 按照原有顺序复制消息头列表, 头部对象本身是共享的
+func (m *message) copyHeaders(dst *message) {
+	dst.headers = make(map[string][]Header, len(m.headers))
+	dst.order = nil
+	for _, name := range m.order {
+		for _, header := range m.headers[name] {
+			dst.AppendHeader(header)
+		}
+	}
 }
 
 func (m *message) SetContent(header *ContentType, body []byte) {
@@ -254,6 +317,19 @@ func (m *message) Contact() *Contact {
 	return nil
 }
 
+// contacts 所有Contact消息头中的Contact
+func (m *message) contacts() []*Contact {
+	var contacts []*Contact
+	for _, header := range m.GetHeader(ContactName) {
+		if list, ok := header.(*Contacts); ok {
+			contacts = append(contacts, list.Contacts...)
+		} else {
+			contacts = append(contacts, header.(*Contact))
+		}
+	}
+	return contacts
+}
+
 func (m *message) GetTransactionId() string {
 	via := m.Via()
 	cseq := m.CSeq()
@@ -343,12 +419,16 @@ func (m *message) setLocalHostPort(ip string, port int) {
 }
 
 func processMessage(listeningPoint *ListeningPoint, stack *Stack, conn net.Conn, tcp bool, data []byte, length int) error {
-	msg, isRequest, err := parseMessage(data, length)
+	parse := parseMessage
+	if stack.Options.LazyParsing {
+		parse = parseMessageLazy
+	}
+	msg, isRequest, err := parse(data, length)
 	if err != nil {
 		return err
 	}
 	viaHeader := msg.Via()
-	if (viaHeader.transport == UDP && tcp) || (viaHeader.transport == TCP && !tcp) {
+	if (viaHeader.transport == UDP && tcp) || (isReliable(viaHeader.transport) && !tcp) {
 		return fmt.Errorf("the transport protocol of VIA header is not the same as that in the network layer")
 	}
 
@@ -372,13 +452,18 @@ func processMessage(listeningPoint *ListeningPoint, stack *Stack, conn net.Conn,
 	transactionId := msg.GetTransactionId()
 	if isRequest {
 		request := msg.(*Request)
+		if ws, ok := conn.(*wsConn); ok && listeningPoint.wsAliases != nil {
+			listeningPoint.bindWSAlias(ws, request)
+		}
 		if _, isRequest = viaHeader.FindFiled("rport"); isRequest {
 			viaHeader.setRPort(hop.Port)
 			viaHeader.setReceived(hop.IP)
 		}
 		//create server transaction
 		t, _ := stack.findTransaction(transactionId, true)
-		if t == nil {
+		if t == nil && ACK == request.GetRequestMethod() {
+			return stack.processAck(request)
+		} else if t == nil {
 			//if ACK == request.GetRequestMethod() {
 			//	return fmt.Errorf("the server t does not exist")
 			//}
@@ -398,112 +483,176 @@ func processMessage(listeningPoint *ListeningPoint, stack *Stack, conn net.Conn,
 	return nil
 }
 
-func parseMessage(data []byte, length int) (Message, bool, error) {
-	first, isRequest := true, false
-	offset, index := 0, 0
-	var msg Message
-	for index < length {
-		for index < length && data[index] != '\r' {
-			index++
+// ParseError 消息解析失败的位置. Line从1开始, Offset是该行在消息中的字节偏移.
+// 消息体的错误Line为0, 缺少必要的消息头时Line和Offset都为0
+type ParseError struct {
+	Line   int
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d offset %d: %s", e.Line, e.Offset, e.Err.Error())
+	} else if e.Offset > 0 {
+		return fmt.Sprintf("offset %d: %s", e.Offset, e.Err.Error())
+	}
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// headerLine 合并折叠之后的一行, 记录第一行的位置
+type headerLine struct {
+	text   string
+	line   int
+	offset int
+}
+
+// readHeaderLines RFC 3261 7.3.1 按行分割起始行和消息头, 以空格或者制表符开头的行是上一个消息头的折叠, 合并为一个空格.
+// 返回消息体的起始位置
+func readHeaderLines(data []byte) ([]headerLine, int) {
+	var lines []headerLine
+	offset := 0
+	for number := 1; offset < len(data); number++ {
+		start := offset
+		end := bytes.IndexByte(data[offset:], '\n')
+		next := offset + end + 1
+		if end < 0 {
+			end = len(data) - offset
+			next = len(data)
 		}
 
-		l := string(data[offset:index])
-
-		if first {
-			//responseEvent
-			if strings.HasPrefix(l, SipVersion) {
-				if statusLine, err := parseStatusLine(l); err != nil {
-					return nil, false, err
-				} else {
-					msg = &Response{
-						message: message{
-							line:    statusLine,
-							headers: make(map[string][]Header, 10),
-						},
-					}
-				}
-
-			} else {
-				isRequest = true
-				//Request
-				if requestLine, err := parseRequestLine(l); err != nil {
-					return nil, false, err
-				} else {
-					msg = &Request{
-						message: message{
-							line:    requestLine,
-							headers: make(map[string][]Header, 10),
-						},
-					}
-
-				}
-			}
+		line := data[offset : offset+end]
+		offset = next
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		//空行, 消息头结束
+		if len(line) == 0 {
+			break
+		}
 
-			first = false
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 1 {
+			last := &lines[len(lines)-1]
+			last.text = strings.TrimRight(last.text, " \t") + " " + strings.TrimLeft(string(line), " \t")
 		} else {
+			lines = append(lines, headerLine{string(line), number, start})
+		}
+	}
 
-			i := strings.Index(l, ":")
-			if i < 0 || len(l) == i+1 {
-				break
-			}
+	return lines, offset
+}
 
-			hName := l[:i]
-			var hValue string
-			if l[i+1:i+2] == " " {
-				hValue = l[i+2:]
-			} else {
-				hValue = l[i+1:]
-			}
+// parseHeaderValues 紧凑形式使用完整名称解析. 逗号分隔的列表, 每个元素解析为一个消息头
+func parseHeaderValues(name, value string) ([]Header, error) {
+	key := headerKey(name)
+	parser, ok := parsers[key]
+	if !ok {
+		//未知的消息头保留原始的名称和值
+		return []Header{NewStrHeader(name, value)}, nil
+	}
 
-			if strings.HasPrefix(hName, " ") || strings.HasSuffix(hName, " ") {
-				hName = strings.TrimSpace(hName)
-			}
-			if strings.HasPrefix(hValue, " ") || strings.HasSuffix(hValue, " ") {
-				hValue = strings.TrimSpace(hValue)
-			}
+	values := []string{value}
+	if _, ok := listHeaders[key]; ok {
+		values = splitHeaderValues(value)
+	}
+	headers := make([]Header, 0, len(values))
+	for _, v := range values {
+		header, err := parser(key, v)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
 
-			if hValue == "" {
-				return nil, false, fmt.Errorf("bad message. the %s header value is empty", hValue)
-			}
+	return headers, nil
+}
 
-			if parser, ok := parsers[hName]; !ok {
-				return nil, false, fmt.Errorf("unknow header:%s", hName)
-			} else {
-				if header, err := parser(hName, hValue); err != nil {
-					return nil, false, err
-				} else {
-					if err := msg.AppendHeader(header); err != nil {
-						return nil, false, err
-					}
-				}
-			}
+func parseHeader(msg Message, name, value string) error {
+	headers, err := parseHeaderValues(name, value)
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		if err = msg.AppendHeader(header); err != nil {
+			return err
 		}
+	}
 
-		index += 2
-		offset = index
+	return nil
+}
 
-		//消息头结束
-		if index+1 < length && data[index] == '\r' && data[index+1] == '\n' {
-			break
+// parseMessage 解析失败返回*ParseError
+func parseMessage(data []byte, length int) (Message, bool, error) {
+	if length > len(data) {
+		length = len(data)
+	}
+	lines, offset := readHeaderLines(data[:length])
+	if len(lines) == 0 {
+		return nil, false, &ParseError{Line: 1, Err: fmt.Errorf("the message parse failed")}
+	}
+
+	var msg Message
+	isRequest := false
+	if strings.HasPrefix(lines[0].text, SipVersion) {
+		//responseEvent
+		statusLine, err := parseStatusLine(lines[0].text)
+		if err != nil {
+			return nil, false, &ParseError{lines[0].line, lines[0].offset, err}
+		}
+		msg = &Response{
+			message: message{
+				line:    statusLine,
+				headers: make(map[string][]Header, 10),
+			},
+		}
+	} else {
+		//Request
+		isRequest = true
+		requestLine, err := parseRequestLine(lines[0].text)
+		if err != nil {
+			return nil, false, &ParseError{lines[0].line, lines[0].offset, err}
+		}
+		msg = &Request{
+			message: message{
+				line:    requestLine,
+				headers: make(map[string][]Header, 10),
+			},
 		}
 	}
 
-	if msg == nil {
-		return nil, false, fmt.Errorf("the message parse failed")
+	for _, l := range lines[1:] {
+		i := strings.Index(l.text, ":")
+		if i < 0 {
+			return nil, false, &ParseError{l.line, l.offset, fmt.Errorf("the header line must contain a colon")}
+		}
+
+		//RFC 3261 7.3.1 允许空的消息头, 由解析器决定是否有效
+		hName := strings.TrimSpace(l.text[:i])
+		hValue := strings.TrimSpace(l.text[i+1:])
+		if hName == "" {
+			return nil, false, &ParseError{l.line, l.offset, fmt.Errorf("the header name is empty")}
+		}
+
+		if err := parseHeader(msg, hName, hValue); err != nil {
+			return nil, false, &ParseError{l.line, l.offset, fmt.Errorf("bad %s header: %s", hName, err.Error())}
+		}
 	}
 
 	if err := msg.CheckHeaders(); err != nil {
-		return nil, false, err
+		return nil, false, &ParseError{Err: err}
 	}
 
 	if header := msg.ContentLength(); header != nil && *header != 0 {
 		contentLength := int(*header)
-		index += 2
-		if index+contentLength > length {
-			return nil, false, fmt.Errorf("the packet size is smaller than content length")
+		if offset+contentLength > length {
+			return nil, false, &ParseError{Offset: offset, Err: fmt.Errorf("the packet size is smaller than content length")}
 		}
 
-		msg.setBody(data[index : index+contentLength])
+		msg.setBody(data[offset : offset+contentLength])
 	}
 
 	return msg, isRequest, nil
@@ -15,10 +15,89 @@ var (
 
 var (
 	parsers map[string]HeaderParser
+	//canonicalNames 小写的消息头名称到注册的名称, 紧凑形式映射到完整名称
+	canonicalNames map[string]string
+
+	//compactForms RFC 3261 7.3.3 紧凑形式, 解析后使用完整名称
+	compactForms = map[string]string{
+		AcceptContactShortName:      AcceptContactName,
+		AllowEventsShortName:        AllowEventsName,
+		CallIDShortName:             CallIDName,
+		ContactShortName:            ContactName,
+		ContentEncodingShortName:    ContentEncodingName,
+		ContentLengthShortName:      ContentLengthName,
+		ContentTypeShortName:        ContentTypeName,
+		EventShortName:              EventName,
+		FromShortName:               FromName,
+		IdentityShortName:           IdentityName,
+		IdentityInfoShortName:       IdentityInfoName,
+		ReferToShortName:            ReferToName,
+		ReferredByShortName:         ReferredByName,
+		RejectContactShortName:      RejectContactName,
+		RequestDispositionShortName: RequestDispositionName,
+		SessionExpiresShortName:     SessionExpiresName,
+		SubjectShortname:            SubjectName,
+		SupportedShortName:          SupportedName,
+		ToShortName:                 ToName,
+		ViaShortName:                ViaName,
+	}
+
+	//listHeaders RFC 3261 7.3.1 值是逗号分隔列表的消息头, 解析时每个元素作为一个消息头.
+	//为true的消息头序列化时合并为一行
+	listHeaders = map[string]bool{
+		ViaName:                false,
+		RouteName:              false,
+		RecordRouteName:        false,
+		ContactName:            false,
+		AcceptName:             true,
+		AcceptContactName:      true,
+		AcceptEncodingName:     true,
+		AcceptLanguageName:     true,
+		AlertInfoName:          true,
+		AllowName:              true,
+		AllowEventsName:        true,
+		CallInfoName:           true,
+		ContentEncodingName:    true,
+		ContentLanguageName:    true,
+		ErrorInfoName:          true,
+		InReplyToName:          true,
+		ProxyRequireName:       true,
+		RejectContactName:      true,
+		RequestDispositionName: true,
+		RequireName:            true,
+		SupportedName:          true,
+		UnsupportedName:        true,
+		WarningName:            true,
+	}
 )
 
 type HeaderParser func(name, value string) (Header, error)
 
+// RegisterHeaderParser 注册消息头的解析器, 名称不区分大小写, 可以覆盖内置的解析器.
+// 没有解析器的消息头解析为StrHeader. 需要在Stack.Start之前调用
+func RegisterHeaderParser(name string, parser HeaderParser) {
+	//覆盖已注册的消息头时使用已有的写法, 否则Call-Id只覆盖call-id这种写法
+	if key := headerKey(name); parsers[key] != nil {
+		name = key
+	}
+	parsers[name] = parser
+	canonicalNames[strings.ToLower(name)] = name
+	canonicalNames[name] = name
+}
+
+// headerKey 已注册的消息头使用注册的名称, 其他消息头使用小写名称.
+// 大多数消息头使用注册的写法, 先直接查找避免转换小写
+func headerKey(name string) string {
+	if canonical, ok := canonicalNames[name]; ok {
+		return canonical
+	}
+	lower := strings.ToLower(name)
+	if canonical, ok := canonicalNames[lower]; ok {
+		return canonical
+	}
+	return lower
+}
+
 func init() {
 	parsers = map[string]HeaderParser{
 		AcceptName:               parseIntOrStrHeader,
@@ -41,7 +120,7 @@ func init() {
 		ContentLengthName:        parseIntOrStrHeader,
 		ContentLengthShortName:   parseIntOrStrHeader,
 		ContentTypeName:          parseIntOrStrHeader,
-		ContentTypeShortName:     parseCSeqHeader,
+		ContentTypeShortName:     parseIntOrStrHeader,
 		CSeqName:                 parseCSeqHeader,
 		DateName:                 parseIntOrStrHeader,
 		ErrorInfoName:            parseIntOrStrHeader,
@@ -57,12 +136,17 @@ func init() {
 		ProxyAuthenticateName:    parseIntOrStrHeader,
 		ProxyAuthorizationName:   parseIntOrStrHeader,
 		ProxyRequireName:         parseIntOrStrHeader,
-		RecordRouteName:          parseIntOrStrHeader,
+		RecordRouteName:          parseAddressHeader,
 		ReplyToName:              parseIntOrStrHeader,
 		RequireName:              parseIntOrStrHeader,
 		RetryAfterName:           parseIntOrStrHeader,
 		RouteName:                parseAddressHeader,
+		RSeqName:                 parseRSeqHeader,
+		RAckName:                 parseRAckHeader,
 		ServerName:               parseIntOrStrHeader,
+		SessionExpiresName:       parseSessionExpiresHeader,
+		SessionExpiresShortName:  parseSessionExpiresHeader,
+		MinSEName:                parseMinSEHeader,
 		SubjectName:              parseIntOrStrHeader,
 		SubjectShortname:         parseIntOrStrHeader,
 		SubscriptionStateName:    parseSubscriptionStateHeader,
@@ -78,97 +162,208 @@ func init() {
 		WarningName:              parseIntOrStrHeader,
 		WWWAuthenticateName:      parseWWWAuthenticateHeader,
 	}
+
+	canonicalNames = make(map[string]string, len(parsers)+len(compactForms))
+	for name := range parsers {
+		canonicalNames[strings.ToLower(name)] = name
+		canonicalNames[name] = name
+	}
+	for short, name := range compactForms {
+		canonicalNames[short] = name
+	}
+}
+
+// splitHeaderValues 按照逗号分割消息头的值, 忽略引号、尖括号中的逗号
+func splitHeaderValues(str string) []string {
+	var values []string
+	offset := 0
+	isBrackets, isQuotes, isEscaped := false, false, false
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if isEscaped {
+			isEscaped = false
+		} else if c == '\\' && isQuotes {
+			isEscaped = true
+		} else if c == '"' {
+			isQuotes = !isQuotes
+		} else if c == '<' && !isQuotes {
+			isBrackets = true
+		} else if c == '>' && !isQuotes {
+			isBrackets = false
+		} else if c == ',' && !isQuotes && !isBrackets {
+			if value := strings.TrimSpace(str[offset:i]); value != "" {
+				values = append(values, value)
+			}
+			offset = i + 1
+		}
+	}
+
+	if value := strings.TrimSpace(str[offset:]); value != "" {
+		values = append(values, value)
+	}
+	return values
 }
 
 func parseUri(str string) (*SipUri, error) {
-	if strings.HasPrefix(str, "sip:") {
+	var scheme string
+	if len(str) >= 4 && strings.EqualFold(str[:4], "sip:") {
 		str = str[4:]
-	} else if strings.HasPrefix(str, "sips:") {
+		scheme = SipScheme
+	} else if len(str) >= 5 && strings.EqualFold(str[:5], "sips:") {
 		str = str[5:]
+		scheme = SipsScheme
+	} else if len(str) >= 4 && strings.EqualFold(str[:4], "tel:") {
+		tel, err := parseTelSubscriber(str[4:])
+		if err != nil {
+			return nil, err
+		}
+		return tel.ToUri(), nil
 	} else {
-		return nil, fmt.Errorf("the SIP URI prefix must be sips or sip")
+		return nil, fmt.Errorf("the SIP URI prefix must be sips, sip or tel")
+	}
+
+	//1.解析userinfo. user可以包含;?等字符, 但是不能包含未转义的@
+	//2.解析头 hname-hvalue
+	//3.解析参数和hostPort
+	uri := SipUri{scheme: scheme}
+	if index := strings.Index(str, "@"); index == 0 {
+		return nil, fmt.Errorf("the user of the SIP URI is empty")
+	} else if index > 0 {
+		user, password := parseUserInfo(str[:index])
+		var err error
+		if uri.User, err = unescape(user); err != nil {
+			return nil, err
+		} else if uri.Password, err = unescape(password); err != nil {
+			return nil, err
+		}
+		str = str[index+1:]
 	}
 
-	index, offset := 0, len(str)
-
-	//1.解析头 hname-hvalue
-	//2.解析参数
-	//3.解析userinfo和hostPort
-	uri := SipUri{}
-	index = strings.Index(str, "?")
-	if index > 0 {
-		if params, err := ParseParams(str[index+1:], "&"); err != nil {
+	offset := len(str)
+	if index := strings.Index(str, "?"); index >= 0 {
+		params, err := ParseParams(str[index+1:], "&")
+		if err == nil {
+			params, err = unescapeParams(params)
+		}
+		if err != nil {
 			return nil, err
-		} else {
-			uri.Headers = params
-			offset = index
 		}
+		uri.Headers = params
+		offset = index
 	}
 
-	index = strings.Index(str, ";")
-	if index > 0 {
-		if params, err := ParseParams(str[index+1:offset], ";"); err != nil {
+	if index := strings.Index(str[:offset], ";"); index >= 0 {
+		params, err := ParseParams(str[index+1:offset], ";")
+		if err == nil {
+			params, err = unescapeParams(params)
+		}
+		if err != nil {
 			return nil, err
-		} else {
-			uri.Params = params
-			offset = index
 		}
+		uri.Params = params
+		offset = index
 	}
 
-	spearIndex := strings.Index(str[:offset], "@")
-	if spearIndex > 0 {
-		user, pwd := parseUserInfo(str[:spearIndex])
-		uri.User = user
-		uri.Password = pwd
+	host, port, err := ParseHostPort(str[:offset])
+	if err != nil {
+		return nil, err
+	} else if host == "" {
+		return nil, fmt.Errorf("the SIP URI must contain host")
+	} else if !isValidHost(host) {
+		return nil, fmt.Errorf("the host of the SIP URI is invalid %s", host)
 	}
+	uri.HostPort = HostPort{host, port}
+	return &uri, nil
+}
 
-	hostPort := str[spearIndex+1 : offset]
-	if host, port, err := ParseHostPort(hostPort); err != nil {
-		return nil, err
-	} else {
-		uri.HostPort = HostPort{host, port}
-		return &uri, nil
+// parseAddrSpec RFC 3261 25.1 addr-spec = SIP-URI / SIPS-URI / absoluteURI.
+// 地址可以携带其他scheme的URI, 只检查格式, 不解析冒号之后的内容
+func parseAddrSpec(str string) (*SipUri, error) {
+	colon := strings.IndexByte(str, ':')
+	if colon <= 0 {
+		return parseUri(str)
+	}
+	scheme := strings.ToLower(str[:colon])
+	if scheme == SipScheme || scheme == SipsScheme || scheme == TelScheme {
+		return parseUri(str)
+	}
+
+	for i := 0; i < colon; i++ {
+		c := scheme[i]
+		if !('a' <= c && c <= 'z' || i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return nil, fmt.Errorf("the URI scheme %s is invalid", str[:colon])
+		}
 	}
+	opaque := str[colon+1:]
+	if opaque == "" || strings.ContainsAny(opaque, " \t<>\"") {
+		return nil, fmt.Errorf("the URI %s is invalid", str)
+	}
+	return &SipUri{scheme: scheme, opaque: opaque}, nil
 }
 
 func parseAddress(str string) (*Address, map[string]string, error) {
-	l, r := -1, -1
 	var uriStr string
 	var paramsStr string
 	var displayName string
 
-	l = strings.Index(str, "<")
+	//显示名的引号中的<不是URI的开始, 引号需要成对出现
+	l := -1
+	isQuotes, isEscaped := false, false
+	for i := 0; i < len(str) && l < 0; i++ {
+		if c := str[i]; isEscaped {
+			isEscaped = false
+		} else if c == '\\' && isQuotes {
+			isEscaped = true
+		} else if c == '"' {
+			isQuotes = !isQuotes
+		} else if c == '<' && !isQuotes {
+			l = i
+		}
+	}
+	if isQuotes {
+		return nil, nil, fmt.Errorf("the quotes of the display name are unbalanced:%s", str)
+	}
+
 	if l >= 0 {
-		r = strings.LastIndex(str, ">")
-		if r < l {
+		r := strings.Index(str[l:], ">")
+		if r < 0 {
 			return nil, nil, fmt.Errorf("the URI format error:%s", str)
 		}
 
+		r += l
 		uriStr = str[l+1 : r]
-		if l > 0 {
-			displayName = str[:l]
+		displayName = str[:l]
+		paramsStr = str[r+1:]
+	} else {
+		//只转换ASCII字符, 保证下标和原字符串一致
+		lowerBytes := []byte(str)
+		for i, c := range lowerBytes {
+			if 'A' <= c && c <= 'Z' {
+				lowerBytes[i] = c + 'a' - 'A'
+			}
 		}
-
-		if end := strings.Index(str[r+1:], ";"); end >= 0 {
-			paramsStr = str[end+1:]
+		lower := string(lowerBytes)
+		index := strings.Index(lower, "sip:")
+		if index < 0 {
+			index = strings.Index(lower, "sips:")
 		}
-
-	} else {
-		index := strings.Index(str, "sip:")
 		if index < 0 {
-			return nil, nil, fmt.Errorf("the SIP URI prefix must be sips or sip:%s", str)
+			index = strings.Index(lower, "tel:")
+		}
+		if index < 0 {
+			//其他scheme的addr-spec没有显示名, 由parseAddrSpec检查
+			index = 0
 		}
 
-		end := strings.Index(str[index:], ";")
-		if end < 0 {
-			uriStr = str[index:]
-		} else {
-			uriStr = str[index:end]
-			paramsStr = str[end+1:]
+		//没有尖括号时, 分号之后是消息头的参数
+		uriStr = str[index:]
+		if end := strings.Index(uriStr, ";"); end >= 0 {
+			uriStr, paramsStr = uriStr[:end], uriStr[end:]
 		}
+		uriStr = strings.TrimSpace(uriStr)
 	}
 
-	uri, err := parseUri(uriStr)
+	uri, err := parseAddrSpec(uriStr)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -191,8 +386,10 @@ func parseAddress(str string) (*Address, map[string]string, error) {
 
 func parseRequestLine(str string) (*RequestLine, error) {
 	split := strings.Split(str, " ")
-	if len(split) != 3 {
+	if len(split) != 3 || split[0] == "" {
 		return nil, fmt.Errorf("the Request Line is invaild %s", str)
+	} else if !strings.EqualFold(split[2], SipVersion) {
+		return nil, fmt.Errorf("the SIP version %s is not supported", split[2])
 	}
 
 	if uri, err := parseUri(split[1]); err != nil {
@@ -208,8 +405,13 @@ func parseStatusLine(str string) (*StatusLine, error) {
 		return nil, fmt.Errorf("the status Line is invaild %s", str)
 	}
 
+	if !strings.EqualFold(split[0], SipVersion) {
+		return nil, fmt.Errorf("the SIP version %s is not supported", split[0])
+	}
 	if code, err := strconv.Atoi(split[1]); err != nil {
 		return nil, err
+	} else if code < 100 || code > 699 {
+		return nil, fmt.Errorf("the status code %s is invaild", split[1])
 	} else {
 		return &StatusLine{split[0], code, strings.Join(split[2:], " ")}, nil
 	}
@@ -222,18 +424,45 @@ func parseUserInfo(str string) (string, string) {
 	}
 }
 
+// ParseHostPort 支持IPv6 reference格式 [2001:db8::1]:5060, 返回的host不包含中括号
 func ParseHostPort(str string) (string, int, error) {
+	if strings.HasPrefix(str, "[") {
+		end := strings.Index(str, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("the IPv6 reference is invaild %s", str)
+		}
 
-	index := strings.Index(str, ":")
+		host, remain := str[1:end], str[end+1:]
+		if remain == "" {
+			return host, 0, nil
+		} else if remain[0] != ':' {
+			return "", 0, fmt.Errorf("the IPv6 reference is invaild %s", str)
+		}
 
-	if index > 0 {
-		port, err := strconv.Atoi(str[index+1:])
+		port, err := parsePort(remain[1:])
+		return host, port, err
+	}
+
+	index := strings.Index(str, ":")
+	if index > 0 && strings.Count(str, ":") > 1 {
+		//没有中括号的IPv6地址, 无法区分端口
+		return str, 0, nil
+	} else if index >= 0 {
+		port, err := parsePort(str[index+1:])
 		return str[:index], port, err
 	} else {
 		return str, 0, nil
 	}
 }
 
+func parsePort(str string) (int, error) {
+	port, err := strconv.Atoi(str)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("the port %s is invaild", str)
+	}
+	return port, nil
+}
+
 func ParseParams(str string, separator string) (map[string]string, error) {
 
 	nameV := strings.Split(str, separator)
@@ -247,10 +476,14 @@ func ParseParams(str string, separator string) (map[string]string, error) {
 	return headers, nil
 }
 
+// ParseParams2 参数名和值两侧可以有LWS, 忽略空的参数
 func ParseParams2(parts []string, iterator func(k, v string) error) error {
 	for _, part := range parts {
 		k, v := SplitParamsByEqual(part)
-		if err := iterator(k, v); err != nil {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		if err := iterator(k, strings.TrimSpace(v)); err != nil {
 			return err
 		}
 	}
@@ -275,25 +508,24 @@ func SplitParamsByEqual(str string) (string, string) {
 
 func parseViaHeader(_, str string) (Header, error) {
 	parts := strings.Split(str, ";")
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("the via format is invaild %s", str)
-	}
-	//先解析 版本/传输方式 sendby
-	transportAndSendBy := strings.Split(parts[0], " ")
-	if len(transportAndSendBy) != 2 || !strings.HasPrefix(transportAndSendBy[0], SipVersion) {
-		return nil, fmt.Errorf("the via header parse failed %s", str)
+	//先解析 版本/传输方式 sendby, SLASH两侧可以有LWS
+	protocol := strings.SplitN(parts[0], "/", 3)
+	if len(protocol) != 3 || !strings.EqualFold(strings.TrimSpace(protocol[0])+"/"+strings.TrimSpace(protocol[1]), SipVersion) {
+		return nil, fmt.Errorf("the via header protcol parse failed %s", str)
 	}
 
-	protocol := strings.Split(transportAndSendBy[0], "/")
-	if len(protocol) != 3 {
-		return nil, fmt.Errorf("the via header protcol parse failed %s", str)
+	transportAndSendBy := strings.Fields(protocol[2])
+	if len(transportAndSendBy) != 2 {
+		return nil, fmt.Errorf("the via header parse failed %s", str)
 	}
 	ip, port, err2 := ParseHostPort(transportAndSendBy[1])
 	if err2 != nil {
 		return nil, err2
+	} else if ip == "" {
+		return nil, fmt.Errorf("the via header must contain sent-by %s", str)
 	}
 
-	via := &Via{sipVersion: SipVersion, transport: protocol[2], sendBy: HostPort{Host: ip, Port: port}}
+	via := &Via{sipVersion: SipVersion, transport: strings.ToUpper(transportAndSendBy[0]), sendBy: HostPort{Host: ip, Port: port}}
 
 	params := make(map[string]string, len(parts)-1)
 	err := ParseParams2(parts[1:], func(k, v string) error {
@@ -335,31 +567,33 @@ func parseViaHeader(_, str string) (Header, error) {
 		return nil, err
 	}
 
-	//branch是必须存在的，匹配事务
-	if via.branch == "" {
-		return nil, fmt.Errorf("the VIA header must contain branch %s", str)
-	}
-
+	//RFC 2543的Via可以没有branch, 使用RFC 3261 17.2.3的字段匹配事务
 	via.files = params
 	return via, nil
 }
 
 func parseAddressValues(str string) ([]*Address, []map[string]string, error) {
 	offset := 0
-	isBrackets, isQuotes := false, false
+	isBrackets, isQuotes, escaped := false, false, false
 	address := str + ","
 
 	addresses := make([]*Address, 0, 1)
 	params := make([]map[string]string, 0, 1)
 	for i, e := range address {
-		if e == '"' {
+		if escaped {
+			escaped = false
+		} else if e == '\\' && isQuotes {
+			escaped = true
+		} else if e == '"' {
 			isQuotes = !isQuotes
 		} else if e == '<' && !isQuotes {
 			isBrackets = true
 		} else if e == '>' && !isQuotes {
 			isBrackets = false
 		} else if e == ',' && !isQuotes && !isBrackets {
-			if adr, m, err := parseAddress(address[offset:i]); err != nil {
+			if strings.TrimSpace(address[offset:i]) == "*" {
+				return nil, nil, fmt.Errorf("the wildcard Contact must be the only Contact %s", str)
+			} else if adr, m, err := parseAddress(address[offset:i]); err != nil {
 				return nil, nil, err
 			} else {
 				addresses = append(addresses, adr)
@@ -370,12 +604,18 @@ func parseAddressValues(str string) ([]*Address, []map[string]string, error) {
 		}
 	}
 
+	if isQuotes || len(addresses) == 0 {
+		return nil, nil, fmt.Errorf("unbalanced quotes %s", str)
+	}
 	return addresses, params, nil
 }
 
 // parseAddressHeader reference from https://github.com/ghettovoice/gosip
 func parseAddressHeader(name, str string) (Header, error) {
 	//from/to/contact/route/record-route/reply-to
+	if ("Contact" == name || "m" == name) && strings.TrimSpace(str) == "*" {
+		return &Contacts{Contacts: []*Contact{{Wildcard: true}}}, nil
+	}
 
 	addresses, params, err := parseAddressValues(str)
 
@@ -403,8 +643,8 @@ func parseAddressHeader(name, str string) (Header, error) {
 					}
 					break
 				case "q":
-					if q, err2 := strconv.ParseFloat(v, 10); err2 != nil {
-						return nil, err
+					if q, err2 := strconv.ParseFloat(v, 32); err2 != nil {
+						return nil, err2
 					} else {
 						contact.Q = float32(q)
 					}
@@ -421,22 +661,83 @@ func parseAddressHeader(name, str string) (Header, error) {
 			address = append(address, addr.Uri)
 		}
 		header = &Route{Address: address}
+	} else if RecordRouteName == name {
+		var address []*SipUri
+		for _, addr := range addresses {
+			address = append(address, addr.Uri)
+		}
+		header = &RecordRoute{Address: address}
 	}
 
 	return header, nil
 }
 
 func parseCSeqHeader(_, str string) (Header, error) {
-	split := strings.Split(str, " ")
+	split := strings.Fields(str)
 	if len(split) != 2 {
 		return nil, fmt.Errorf("the format of cSeq header is invaild %s", str)
 	}
 
-	if number, err := strconv.Atoi(split[0]); err != nil {
+	//RFC 3261 8.1.1.5 序号小于2**31
+	if number, err := strconv.ParseUint(split[0], 10, 31); err != nil {
 		return nil, err
 	} else {
-		return &CSeq{Number: number, Method: split[1]}, nil
+		return &CSeq{Number: int(number), Method: split[1]}, nil
+	}
+}
+
+func parseRSeqHeader(_, str string) (Header, error) {
+	number, err := strconv.ParseUint(str, 10, 32)
+	if err != nil || number == 0 {
+		return nil, fmt.Errorf("the format of RSeq header is invaild %s", str)
+	}
+
+	rseq := RSeq(number)
+	return &rseq, nil
+}
+
+func parseRAckHeader(_, str string) (Header, error) {
+	split := strings.Fields(str)
+	if len(split) != 3 {
+		return nil, fmt.Errorf("the format of RAck header is invaild %s", str)
+	}
+
+	rseq, err := strconv.ParseUint(split[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	number, err := strconv.Atoi(split[1])
+	if err != nil {
+		return nil, err
 	}
+
+	return &RAck{RSeq: uint32(rseq), CSeq: number, Method: split[2]}, nil
+}
+
+func parseSessionExpiresHeader(_, str string) (Header, error) {
+	split := strings.Split(str, ";")
+	delta, err := strconv.Atoi(strings.TrimSpace(split[0]))
+	if err != nil || delta <= 0 {
+		return nil, fmt.Errorf("the format of Session-Expires header is invaild %s", str)
+	}
+
+	header := &SessionExpires{Delta: delta}
+	for _, param := range split[1:] {
+		if k, v := SplitParamsByEqual(strings.TrimSpace(param)); strings.EqualFold(k, "refresher") {
+			header.Refresher = strings.ToLower(v)
+		}
+	}
+	return header, nil
+}
+
+func parseMinSEHeader(_, str string) (Header, error) {
+	delta, err := strconv.Atoi(strings.TrimSpace(strings.Split(str, ";")[0]))
+	if err != nil || delta <= 0 {
+		return nil, fmt.Errorf("the format of Min-SE header is invaild %s", str)
+	}
+
+	header := MinSE(delta)
+	return &header, nil
 }
 
 func parseAuth(str string, iterator func(k, v string) error) error {
@@ -464,7 +765,7 @@ func parseAuth(str string, iterator func(k, v string) error) error {
 		}
 		offset = i + 1
 
-		split := strings.Split(params, "=")
+		split := strings.SplitN(params, "=", 2)
 		if len(split) != 2 {
 			return fmt.Errorf("bad auth params :%s", params)
 		}
@@ -544,6 +845,9 @@ func parseIntOrStrHeader(name, str string) (Header, error) {
 	var header Header
 	switch name {
 	case CallIDName, CallIDShortName:
+		if str == "" {
+			return nil, fmt.Errorf("the Call-ID header is empty")
+		}
 		callId := CallID(str)
 		header = &callId
 	case UserAgentName:
@@ -554,6 +858,8 @@ func parseIntOrStrHeader(name, str string) (Header, error) {
 		integer, err := strconv.Atoi(str)
 		if err != nil {
 			return nil, err
+		} else if integer < 0 || integer > 255 {
+			return nil, fmt.Errorf("the Max-Forwards %s is out of range", str)
 		}
 		forwards := MaxForwards(integer)
 		header = &forwards
@@ -561,6 +867,8 @@ func parseIntOrStrHeader(name, str string) (Header, error) {
 		integer, err := strconv.Atoi(str)
 		if err != nil {
 			return nil, err
+		} else if integer < 0 {
+			return nil, fmt.Errorf("the Expires %s is negative", str)
 		}
 		expires := Expires(integer)
 		header = &expires
@@ -568,6 +876,8 @@ func parseIntOrStrHeader(name, str string) (Header, error) {
 		integer, err := strconv.Atoi(str)
 		if err != nil {
 			return nil, err
+		} else if integer < 0 {
+			return nil, fmt.Errorf("the Content-Length %s is negative", str)
 		}
 		length := ContentLength(integer)
 		header = &length
@@ -1,6 +1,9 @@
 package sip
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestParseStrMessage(t *testing.T) {
 	msgs := []string{
@@ -20,3 +23,304 @@ func TestParseStrMessage(t *testing.T) {
 		println(err)
 	}
 }
+
+func TestParseSipsUri(t *testing.T) {
+	uri, err := parseUri("sips:34020000001320000001@example.com:5061;transport=tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !uri.IsSecure() || uri.GetScheme() != SipsScheme {
+		t.Fatalf("the scheme should be sips: %s", uri.GetScheme())
+	}
+
+	if str := uri.ToString(); str != "sips:34020000001320000001@example.com:5061;transport=tls" {
+		t.Fatalf("bad sips uri %s", str)
+	}
+
+	address, _, err := parseAddress("sips:34020000001320000001@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !address.Uri.IsSecure() {
+		t.Fatalf("the address uri should be sips")
+	}
+}
+
+func TestParseIPv6(t *testing.T) {
+	host, port, err := ParseHostPort("[2001:db8::1]:5060")
+	if err != nil || host != "2001:db8::1" || port != 5060 {
+		t.Fatalf("bad IPv6 reference %s %d %v", host, port, err)
+	}
+
+	uri, err := parseUri("sip:34020000001320000001@[2001:db8::1]:5060;transport=udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.HostPort.Host != "2001:db8::1" || uri.HostPort.Port != 5060 {
+		t.Fatalf("bad IPv6 uri %v", uri.HostPort)
+	}
+	if str := uri.ToString(); str != "sip:34020000001320000001@[2001:db8::1]:5060;transport=udp" {
+		t.Fatalf("bad IPv6 uri %s", str)
+	}
+
+	header, err := parseViaHeader(ViaName, "SIP/2.0/UDP [2001:db8::1]:5060;branch=z9hG4bK-1;received=2001:db8::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	via := header.(*Via)
+	if via.sendBy.Host != "2001:db8::1" || via.sendBy.Port != 5060 || via.received != "2001:db8::2" {
+		t.Fatalf("bad IPv6 via %v", via)
+	}
+	if sendBy := via.sendBy.ToString(); sendBy != "[2001:db8::1]:5060" {
+		t.Fatalf("bad IPv6 sent-by %s", sendBy)
+	}
+
+	if key := generateTcpConnectKey("2001:db8::1", 5060); key != "[2001:db8::1]:5060" {
+		t.Fatalf("bad IPv6 connect key %s", key)
+	}
+}
+
+func TestParseRSeqRAck(t *testing.T) {
+	rseq, err := parseRSeqHeader(RSeqName, "988789")
+	if err != nil || rseq.Value() != "988789" {
+		t.Fatalf("bad RSeq %v", err)
+	}
+
+	rack, err := parseRAckHeader(RAckName, "776656 1 INVITE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rack.(*RAck); r.RSeq != 776656 || r.CSeq != 1 || r.Method != INVITE || r.Value() != "776656 1 INVITE" {
+		t.Fatalf("bad RAck %s", r.Value())
+	}
+
+	if _, err = parseRAckHeader(RAckName, "776656 INVITE"); err == nil {
+		t.Fatalf("the RAck header must contain RSeq, CSeq and method")
+	}
+}
+
+func TestParseSessionExpires(t *testing.T) {
+	header, err := parseSessionExpiresHeader(SessionExpiresShortName, "1800; Refresher=UAS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se := header.(*SessionExpires); se.Delta != 1800 || se.Refresher != "uas" || se.Value() != "1800;refresher=uas" {
+		t.Fatalf("bad Session-Expires %s", se.Value())
+	}
+
+	minSE, err := parseMinSEHeader(MinSEName, "90")
+	if err != nil || minSE.Value() != "90" {
+		t.Fatalf("bad Min-SE %v", err)
+	}
+
+	if _, err = parseSessionExpiresHeader(SessionExpiresName, "0"); err == nil {
+		t.Fatalf("the session interval must be greater than zero")
+	}
+}
+
+// gbVersion 应用注册的消息头
+type gbVersion struct {
+	major, minor string
+}
+
+func (v *gbVersion) Name() string  { return "X-GB-Ver" }
+func (v *gbVersion) Value() string { return v.major + "." + v.minor }
+func (v *gbVersion) Clone() Header { clone := *v; return &clone }
+
+func TestParseExtensionHeaders(t *testing.T) {
+	msg := "MESSAGE sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.108:5060;branch=z9hG4bK-1\r\n" +
+		"From: <sip:34020000001110000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000002000000001@3402000000>\r\n" +
+		"call-id: 1\r\n" +
+		"CSeq: 1 MESSAGE\r\n" +
+		"P-Asserted-Identity: <sip:34020000001110000001@3402000000>\r\n" +
+		"X-GB-Ver: 3.0\r\n" +
+		"P-Asserted-Identity: <tel:+8613800000000>\r\n" +
+		"Date: Sat, 13 Nov 2010 23:29:00 GMT\r\n" +
+		"content-length: 0\r\n\r\n"
+
+	message, _, err := parseMessage([]byte(msg), len(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := message.GetHeader("x-gb-ver"); len(header) != 1 || header[0].Name() != "X-GB-Ver" || header[0].Value() != "3.0" {
+		t.Fatalf("bad extension header %v", header)
+	}
+	if identities := message.GetHeader("p-asserted-identity"); len(identities) != 2 || identities[1].Value() != "<tel:+8613800000000>" {
+		t.Fatalf("bad extension headers %v", identities)
+	}
+	if message.CallID() == nil || message.ContentLength() == nil {
+		t.Fatalf("the known headers should be case-insensitive")
+	}
+
+	//未知的消息头按照原有顺序序列化
+	data := message.ToString()
+	expected := "P-Asserted-Identity: <sip:34020000001110000001@3402000000>\r\n" +
+		"P-Asserted-Identity: <tel:+8613800000000>\r\n" +
+		"X-GB-Ver: 3.0\r\n" +
+		"Date: Sat, 13 Nov 2010 23:29:00 GMT\r\n"
+	if !strings.Contains(data, expected) {
+		t.Fatalf("bad message %s", data)
+	}
+	reparsed, _, err := parseMessage([]byte(data), len(data))
+	if err != nil || reparsed.ToString() != data {
+		t.Fatalf("the message should round-trip %v", err)
+	}
+
+	message.RemoveHeader("P-ASSERTED-IDENTITY")
+	if message.GetHeader("P-Asserted-Identity") != nil || strings.Contains(message.ToString(), "P-Asserted-Identity") {
+		t.Fatalf("the header should be removed")
+	}
+
+	RegisterHeaderParser("X-GB-Ver", func(name, value string) (Header, error) {
+		major, minor := SplitParams(value, ".")
+		return &gbVersion{major, minor}, nil
+	})
+	defer func() {
+		delete(parsers, "X-GB-Ver")
+		delete(canonicalNames, "x-gb-ver")
+		delete(canonicalNames, "X-GB-Ver")
+	}()
+	message, _, err = parseMessage([]byte(msg), len(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, ok := message.GetHeader("X-Gb-Ver")[0].(*gbVersion); !ok || version.major != "3" {
+		t.Fatalf("the registered parser should be used")
+	}
+}
+
+func TestOverrideHeaderParser(t *testing.T) {
+	calls := 0
+	RegisterHeaderParser("Call-Id", func(name, value string) (Header, error) {
+		calls++
+		return parseIntOrStrHeader(name, value)
+	})
+	defer func() {
+		parsers[CallIDName] = parseIntOrStrHeader
+		canonicalNames["call-id"] = CallIDName
+		delete(canonicalNames, "Call-Id")
+	}()
+	if parsers["Call-Id"] != nil || headerKey("call-id") != CallIDName {
+		t.Fatalf("the built-in name should be kept")
+	}
+
+	//任何写法的Call-ID都使用新的解析器
+	for _, name := range []string{"Call-ID", "call-id", "CALL-ID", "i"} {
+		msg := crlf(`OPTIONS sip:user@example.com SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+To: sip:user@example.com
+From: sip:caller@example.net;tag=1
+` + name + `: override
+CSeq: 1 OPTIONS
+Content-Length: 0
+
+`)
+		for _, parse := range []func([]byte, int) (Message, bool, error){parseMessage, parseMessageLazy} {
+			calls = 0
+			message, _, err := parse([]byte(msg), len(msg))
+			if err != nil {
+				t.Fatal(err)
+			} else if calls != 1 || string(*message.CallID()) != "override" {
+				t.Fatalf("%s: the override parser should be used, %d calls", name, calls)
+			}
+		}
+	}
+}
+
+func TestParseFoldingAndLists(t *testing.T) {
+	msg := "INVITE sip:34020000001320000001@192.168.1.108:5060 SIP/2.0\r\n" +
+		"v: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1,\r\n" +
+		"  SIP/2.0/TCP 192.168.1.99:5060 ;branch=z9hG4bK-2\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.98:5060;branch=z9hG4bK-3\r\n" +
+		"Route: <sip:p1.example.com;lr>, <sip:p2.example.com;lr>\r\n" +
+		"f: \"Doe, John\" <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"t: <sip:34020000001320000001@3402000000>\r\n" +
+		"i: 1\r\n" +
+		"CSeq: 1\r\n" +
+		"\tINVITE\r\n" +
+		"m: \"Doe, John\" <sip:34020000002000000001@192.168.1.100:5060>, <sip:34020000002000000001@192.168.1.101:5060>;expires=60\r\n" +
+		"Allow: INVITE, ACK,\r\n BYE\r\n" +
+		"Allow: CANCEL\r\n" +
+		"k: 100rel, timer\r\n" +
+		"Warning: 399 example.com \"a, b\"\r\n" +
+		"c: application/sdp\r\n" +
+		"l: 4\r\n\r\n" +
+		"v=0\n"
+
+	message, _, err := parseMessage([]byte(msg), len(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vias := message.GetHeader(ViaName)
+	if len(vias) != 3 || vias[1].(*Via).transport != TCP || vias[1].(*Via).branch != "z9hG4bK-2" || message.Via().branch != "z9hG4bK-1" {
+		t.Fatalf("bad via headers %v", vias)
+	}
+	if routes := message.GetHeader(RouteName); len(routes) != 2 || routes[1].(*Route).Address[0].HostPort.Host != "p2.example.com" {
+		t.Fatalf("bad route headers %v", routes)
+	}
+	if message.From().Address.DisPlayName != "\"Doe, John\" " || message.CSeq().Method != INVITE {
+		t.Fatalf("bad from or cseq %v %v", message.From(), message.CSeq())
+	}
+	if contacts := message.GetHeader(ContactName); len(contacts) != 2 || contacts[1].(*Contacts).Contacts[0].Expires != 60 {
+		t.Fatalf("bad contact headers %v", contacts)
+	}
+	if allow := message.GetHeader(AllowName); len(allow) != 4 || allow[2].Value() != BYE {
+		t.Fatalf("bad allow headers %v", allow)
+	}
+	if supported := message.GetHeader(SupportedShortName); len(supported) != 2 || supported[0].Name() != SupportedName {
+		t.Fatalf("the compact form should be expanded %v", supported)
+	}
+	if warning := message.GetHeader(WarningName); len(warning) != 1 {
+		t.Fatalf("the comma in the quoted string should not split the header %v", warning)
+	}
+	if message.ContentType() == nil || *message.ContentType() != "application/sdp" || string(message.(*Request).Content()) != "v=0\n" {
+		t.Fatalf("bad content type %v", message.ContentType())
+	}
+
+	data := message.ToString()
+	for _, line := range []string{
+		"Allow: INVITE, ACK, BYE, CANCEL\r\n",
+		"Supported: 100rel, timer\r\n",
+		"Via: SIP/2.0/TCP 192.168.1.99:5060;branch=z9hG4bK-2\r\n",
+		"Content-Type: application/sdp\r\n",
+	} {
+		if !strings.Contains(data, line) {
+			t.Fatalf("%s is missing in %s", line, data)
+		}
+	}
+
+	//RFC 3261 10.2.2 Contact: *删除所有绑定, 只能单独出现在REGISTER中
+	register := func(contacts string) string {
+		return "REGISTER sip:3402000000 SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1\r\n" +
+			"From: <sip:34020000001320000001@3402000000>;tag=1\r\n" +
+			"To: <sip:34020000001320000001@3402000000>\r\n" +
+			"Call-ID: 1\r\n" +
+			"CSeq: 1 REGISTER\r\n" +
+			contacts +
+			"Expires: 0\r\n" +
+			"Content-Length: 0\r\n\r\n"
+	}
+	if message, _, err = parseMessage([]byte(register("Contact: *\r\n")), len(register("Contact: *\r\n"))); err != nil {
+		t.Fatal(err)
+	} else if contact := message.Contact(); contact == nil || !contact.Wildcard || !strings.Contains(message.ToString(), "Contact: *\r\n") {
+		t.Fatalf("bad wildcard contact %v", contact)
+	}
+	for _, contacts := range []string{
+		"Contact: *, <sip:34020000001320000001@192.168.1.100:5060>\r\n",
+		"m: <sip:34020000001320000001@192.168.1.100:5060>,*\r\n",
+		"Contact: *\r\nContact: <sip:34020000001320000001@192.168.1.100:5060>\r\n",
+	} {
+		if _, _, err = parseMessage([]byte(register(contacts)), len(register(contacts))); err == nil {
+			t.Fatalf("the wildcard mixed with other contacts should be rejected %s", contacts)
+		}
+	}
+	invite := strings.Replace(strings.Replace(register("m: *\r\n"), "REGISTER", INVITE, 2), "sip:3402000000", "sip:34020000001320000001@3402000000", 1)
+	if _, _, err = parseMessage([]byte(invite), len(invite)); err == nil {
+		t.Fatalf("the wildcard contact is only allowed in REGISTER")
+	}
+}
@@ -0,0 +1,242 @@
+package sip
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// RFC 3262 可靠临时应答
+
+const OptionTag100rel = "100rel"
+
+// hasOptionTag Require/Supported等option tag列表中是否包含tag
+func hasOptionTag(msg Message, tag string, names ...string) bool {
+	for _, name := range names {
+		for _, header := range msg.GetHeader(name) {
+			for _, t := range strings.Split(header.Value(), ",") {
+				if strings.EqualFold(strings.TrimSpace(t), tag) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func getRSeq(msg Message) *RSeq {
+	if header := msg.GetHeader(RSeqName); header != nil {
+		if rseq, ok := header[0].(*RSeq); ok {
+			return rseq
+		}
+	}
+	return nil
+}
+
+func getRAck(msg Message) *RAck {
+	if header := msg.GetHeader(RAckName); header != nil {
+		if rack, ok := header[0].(*RAck); ok {
+			return rack
+		}
+	}
+	return nil
+}
+
+// reliableProvisional UAS同一时间只能有一个未确认的可靠临时应答, 之后的临时应答排队, 最终应答等待确认后发送
+type reliableProvisional struct {
+	mutex      sync.Mutex
+	rseq       uint32
+	pending    *Response
+	queue      []*Response
+	final      *Response
+	retransmit *timerA //与Timer A相同, 从T1开始翻倍
+	timeout    *timerB //64*T1没有收到PRACK
+}
+
+func (r *reliableProvisional) stopTimer() {
+	if r.retransmit != nil {
+		r.retransmit.stop()
+		r.retransmit = nil
+	}
+	if r.timeout != nil {
+		r.timeout.stop()
+		r.timeout = nil
+	}
+}
+
+// isReliableProvisional 101-199的INVITE临时应答, 请求要求或者支持100rel时可靠地发送
+func (t *ServerTransaction) isReliableProvisional(response *Response) bool {
+	code := response.GetStatusCode()
+	if !t.isInvite || code <= 100 || code >= 200 {
+		return false
+	}
+
+	request := t.originalRequest
+	if hasOptionTag(request, OptionTag100rel, RequireName) {
+		return true
+	} else if !hasOptionTag(request, OptionTag100rel, SupportedName, SupportedShortName) {
+		return false
+	}
+	return t.sipStack.Options.Enable100rel || hasOptionTag(response, OptionTag100rel, RequireName)
+}
+
+func (t *ServerTransaction) sendReliableProvisional(response *Response, dialog *Dialog) {
+	if t.reliable == nil {
+		t.reliable = &reliableProvisional{rseq: uint32(rand.Int31n(1<<30)) + 1}
+	}
+	if dialog != nil {
+		dialog.reliableTransaction = t
+	}
+
+	t.reliable.mutex.Lock()
+	defer t.reliable.mutex.Unlock()
+	if t.reliable.pending != nil {
+		t.reliable.queue = append(t.reliable.queue, response)
+		return
+	}
+	t.sendReliable(response)
+}
+
+// sendReliable 调用者持有reliable.mutex
+func (t *ServerTransaction) sendReliable(response *Response) {
+	r := t.reliable
+	r.rseq++
+	rseq := RSeq(r.rseq)
+	response.SetHeader(&rseq)
+	if !hasOptionTag(response, OptionTag100rel, RequireName) {
+		response.AppendHeader(&StrHeader{n: RequireName, v: OptionTag100rel})
+	}
+
+	r.pending = response
+	t.provisionalResponse = response
+	t.provisionalResponseBytes = response.ToBytes()
+	data := t.provisionalResponseBytes
+	if sendMessage(t.conn, data, t) != nil {
+		return
+	}
+
+	if !isReliable(response.Via().transport) {
+		r.retransmit = &timerA{}
+		r.retransmit.start(t.sipStack.timerService(), &t.timers, func() bool {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if r.pending != response {
+				return true
+			}
+			return sendMessage(t.conn, data, t) != nil
+		})
+	}
+	r.timeout = &timerB{}
+	r.timeout.start(t.sipStack.timerService(), &t.timers, func() {
+		t.onPrackTimeout(response)
+	})
+}
+
+// holdFinalResponse 存在未确认的可靠临时应答时, 保存最终应答, 收到PRACK后发送
+func (t *ServerTransaction) holdFinalResponse(response *Response) bool {
+	if t.reliable == nil {
+		return false
+	}
+
+	t.reliable.mutex.Lock()
+	defer t.reliable.mutex.Unlock()
+	if t.reliable.pending == nil {
+		return false
+	}
+	t.reliable.final = response
+	t.reliable.queue = nil
+	return true
+}
+
+// onPrackTimeout RFC 3262 3 64*T1没有收到PRACK, 使用5xx拒绝INVITE. TU已经发送了失败应答的, 直接发送
+func (t *ServerTransaction) onPrackTimeout(response *Response) {
+	r := t.reliable
+	r.mutex.Lock()
+	if r.pending != response {
+		r.mutex.Unlock()
+		return
+	}
+	r.stopTimer()
+	final := r.final
+	r.pending, r.queue, r.final = nil, nil, nil
+	r.mutex.Unlock()
+
+	if final == nil || final.GetStatusCode() < 300 {
+		final = t.originalRequest.CreateResponse(ServerInternalError)
+		final.SetHeader(response.To().Clone())
+	}
+	t.SendResponse(final)
+}
+
+// onPrack 确认当前的可靠临时应答, 发送排队的临时应答或者等待的最终应答
+func (t *ServerTransaction) onPrack(rack *RAck) bool {
+	r := t.reliable
+	if r == nil || rack == nil {
+		return false
+	}
+
+	r.mutex.Lock()
+	if r.pending == nil || rack.RSeq != r.rseq || rack.CSeq != t.originalRequest.CSeq().Number || !strings.EqualFold(rack.Method, INVITE) {
+		r.mutex.Unlock()
+		return false
+	}
+
+	r.stopTimer()
+	r.pending = nil
+	if len(r.queue) > 0 {
+		next := r.queue[0]
+		r.queue = r.queue[1:]
+		t.sendReliable(next)
+		r.mutex.Unlock()
+		return true
+	}
+
+	final := r.final
+	r.final = nil
+	r.mutex.Unlock()
+
+	if final != nil {
+		t.SendResponse(final)
+	}
+	return true
+}
+
+// processPrack PRACK由协议栈应答, 匹配的可靠临时应答响应200, 否则响应481
+func (t *ServerTransaction) processPrack(request *Request, dialog *Dialog) {
+	if dialog.reliableTransaction != nil && dialog.reliableTransaction.onPrack(getRAck(request)) {
+		t.SendResponse(request.CreateResponse(OK))
+	} else {
+		t.SendResponse(request.CreateResponse(CallTransactionDoesNotExist))
+	}
+}
+
+// acknowledgeReliable UAC对每个可靠临时应答自动发送PRACK. 重传或者乱序的应答返回false, 不通知TU
+func (t *ClientTransaction) acknowledgeReliable(response *Response, dialog *Dialog) bool {
+	rseq := getRSeq(response)
+	if rseq == nil || !hasOptionTag(response, OptionTag100rel, RequireName) {
+		return true
+	}
+
+	t.rseqMutex.Lock()
+	if t.rseqs == nil {
+		t.rseqs = make(map[string]uint32, 1)
+	}
+	tag := response.To().Tag
+	last, ok := t.rseqs[tag]
+	if ok && uint32(*rseq) != last+1 {
+		t.rseqMutex.Unlock()
+		return false
+	}
+	t.rseqs[tag] = uint32(*rseq)
+	t.rseqMutex.Unlock()
+
+	if dialog != nil {
+		if prack, err := dialog.CreateRequest(PRACK); err == nil {
+			prack.SetHeader(&RAck{RSeq: uint32(*rseq), CSeq: t.originalRequest.CSeq().Number, Method: INVITE})
+			if transaction, err := dialog.listeningPoint.NewClientTransaction(prack); err == nil {
+				go transaction.Execute()
+			}
+		}
+	}
+	return true
+}
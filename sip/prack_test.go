@@ -0,0 +1,155 @@
+package sip
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReliableProvisional(t *testing.T) {
+	stack := newTestStack(t)
+	stack.process(peerRequest(INVITE, "z9hG4bK-1", "", 1, "Require: 100rel\r\n"))
+	event := <-stack.recorder.requests
+	transaction := event.ServerTransaction
+
+	//可靠临时应答携带RSeq和Require: 100rel, 从T1开始翻倍重传
+	ringing := event.Request.CreateResponse(Ringing)
+	transaction.SendResponse(ringing)
+	rseq := uint32(*getRSeq(ringing))
+	tag := ringing.To().Tag
+	if sent := stack.conn.sent(); len(sent) != 1 || tag == "" || !strings.Contains(sent[0], "Require: 100rel") {
+		t.Fatalf("bad reliable provisional response %v", sent)
+	}
+	stack.clock.Advance(DefaultTimers.T1)
+	stack.clock.Advance(2 * DefaultTimers.T1)
+	if sent := stack.conn.sent(); len(sent) != 3 || sent[1] != sent[0] || sent[2] != sent[0] {
+		t.Fatalf("the reliable provisional response should be retransmitted %v", sent)
+	}
+
+	//确认之前的临时应答排队, 最终应答等待
+	progress := event.Request.CreateResponse(SessionProgress)
+	progress.SetHeader(ringing.To().Clone())
+	transaction.SendResponse(progress)
+	ok := event.Request.CreateResponse(OK)
+	ok.SetHeader(ringing.To().Clone())
+	ok.SetHeader(&Contact{Address: &Address{Uri: NewSipUri("34020000001320000001", "192.168.1.108", 5060)}})
+	transaction.SendResponse(ok)
+	if sent := stack.conn.sent(); len(sent) != 3 {
+		t.Fatalf("the responses should wait for the PRACK %v", sent)
+	}
+
+	//RSeq不匹配响应481
+	rack := func(rseq uint32) string {
+		return "RAck: " + strconv.FormatUint(uint64(rseq), 10) + " 1 INVITE\r\n"
+	}
+	stack.process(peerRequest(PRACK, "z9hG4bK-2", tag, 2, rack(rseq+1)))
+	if sent := stack.conn.sent(); len(sent) != 4 || !strings.HasPrefix(sent[3], "SIP/2.0 481") {
+		t.Fatalf("the PRACK of other RSeq should be rejected %v", sent)
+	}
+
+	//PRACK停止重传, 等待的最终应答清空了排队的临时应答, 所以在PRACK的应答之前发送最终应答
+	stack.process(peerRequest(PRACK, "z9hG4bK-3", tag, 3, rack(rseq)))
+	sent := stack.conn.sent()
+	if len(sent) != 6 || !strings.HasPrefix(sent[4], "SIP/2.0 200 OK") || !strings.Contains(sent[4], "CSeq: 1 INVITE") ||
+		!strings.HasPrefix(sent[5], "SIP/2.0 200 OK") || !strings.Contains(sent[5], "CSeq: 3 PRACK") {
+		t.Fatalf("the final response should be sent after the PRACK %v", sent)
+	}
+	stack.clock.Advance(10 * DefaultTimers.T1)
+	for _, msg := range stack.conn.sent()[6:] {
+		if strings.Contains(msg, "RSeq") {
+			t.Fatalf("the acknowledged response should not be retransmitted")
+		}
+	}
+}
+
+func TestReliableProvisionalQueue(t *testing.T) {
+	stack := newTestStack(t)
+	stack.process(peerRequest(INVITE, "z9hG4bK-1", "", 1, "Require: 100rel\r\n"))
+	event := <-stack.recorder.requests
+	transaction := event.ServerTransaction
+
+	ringing := event.Request.CreateResponse(Ringing)
+	transaction.SendResponse(ringing)
+	progress := event.Request.CreateResponse(SessionProgress)
+	progress.SetHeader(ringing.To().Clone())
+	transaction.SendResponse(progress)
+	rseq := uint32(*getRSeq(ringing))
+
+	//确认第一个临时应答后发送排队的临时应答, RSeq加1
+	stack.process(peerRequest(PRACK, "z9hG4bK-2", ringing.To().Tag, 2, "RAck: "+strconv.FormatUint(uint64(rseq), 10)+" 1 INVITE\r\n"))
+	if sent := stack.conn.sent(); len(sent) != 3 || !strings.HasPrefix(sent[1], "SIP/2.0 183") ||
+		!strings.Contains(sent[1], "RSeq: "+strconv.FormatUint(uint64(rseq+1), 10)) {
+		t.Fatalf("the queued response should be sent after the PRACK %v", sent)
+	}
+
+	//64*T1没有收到PRACK, 使用500拒绝INVITE
+	stack.clock.Advance(64 * DefaultTimers.T1)
+	sent := stack.conn.sent()
+	if last := sent[len(sent)-1]; !strings.HasPrefix(last, "SIP/2.0 500") || !strings.Contains(last, "tag="+ringing.To().Tag) {
+		t.Fatalf("the INVITE should be rejected when the PRACK times out %v", last)
+	}
+}
+
+func TestAutomaticPrack(t *testing.T) {
+	stack := newTestStack(t)
+	stack.Options.Enable100rel = true
+	transaction, err := stack.listen.NewClientTransaction(stack.newRequest(INVITE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan int, 4)
+	go transaction.SendRequest(func(event *ResponseEvent) {
+		responses <- event.Response.GetStatusCode()
+	}, func(err *UACError) {
+		t.Error(err)
+	})
+	invite := stack.next()
+	if !strings.Contains(invite, "Supported: 100rel") {
+		t.Fatalf("the INVITE should support 100rel %s", invite)
+	}
+
+	provisional := func(code int, rseq uint32) string {
+		response := stack.response(invite, code, "2")
+		r := RSeq(rseq)
+		response.SetHeader(&r)
+		response.AppendHeader(&StrHeader{n: RequireName, v: OptionTag100rel})
+		return response.ToString()
+	}
+	//每个可靠临时应答自动发送PRACK
+	prack := func(rseq uint32) {
+		msg := stack.next()
+		if !strings.HasPrefix(msg, "PRACK ") || !strings.Contains(msg, "RAck: "+strconv.FormatUint(uint64(rseq), 10)+" 1 INVITE") {
+			t.Fatalf("bad PRACK %s", msg)
+		}
+		stack.process(stack.response(msg, OK, "2").ToString())
+	}
+
+	stack.process(provisional(Ringing, 5))
+	prack(5)
+	if code := <-responses; code != Ringing {
+		t.Fatalf("bad response %d", code)
+	}
+
+	//重传和乱序的临时应答不发送PRACK, 不通知TU
+	stack.process(provisional(Ringing, 5))
+	stack.process(provisional(SessionProgress, 7))
+	stack.process(provisional(SessionProgress, 6))
+	prack(6)
+	if code := <-responses; code != SessionProgress {
+		t.Fatalf("bad response %d", code)
+	}
+	select {
+	case msg := <-stack.conn.written:
+		t.Fatalf("unexpected message %s", msg)
+	case code := <-responses:
+		t.Fatalf("unexpected response %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stack.process(stack.response(invite, BusyHere, "2").ToString())
+	if code := <-responses; code != BusyHere {
+		t.Fatalf("bad response %d", code)
+	}
+}
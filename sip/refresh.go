@@ -12,7 +12,7 @@ type AutoRefresher interface {
 
 type registerRefresh struct {
 	sipStack *Stack
-	timer    *time.Timer
+	timer    TimerHandle
 	interval time.Duration
 	request  *Request
 	handler  func(status bool, err error)
@@ -60,7 +60,7 @@ func newRegisterRefresher(sipStack *Stack, request *Request, handler func(bool,
 	}
 	r.interval = time.Duration(e) * time.Second
 
-	r.timer = time.AfterFunc(r.interval, r.refresh)
+	r.timer = sipStack.timerService().AfterFunc(r.interval, r.refresh)
 	return r
 }
 
@@ -68,7 +68,7 @@ type subscribeRefresh struct {
 	sipStack *Stack
 	request  *Request
 	dialog   *Dialog
-	timer    *time.Timer
+	timer    TimerHandle
 	interval time.Duration
 	handler  func(status, terminated bool, err error)
 }
@@ -122,6 +122,6 @@ func (s *subscribeRefresh) Stop() {
 
 func newSubscribeRefresherWithNear(stack *Stack, request *Request, dialog *Dialog, interval time.Duration, handler func(status bool, terminated bool, err error)) AutoRefresher {
 	refresh := &subscribeRefresh{sipStack: stack, request: request.Clone(), dialog: dialog, interval: interval, handler: handler}
-	refresh.timer = time.AfterFunc(refresh.interval, refresh.refresh)
+	refresh.timer = stack.timerService().AfterFunc(refresh.interval, refresh.refresh)
 	return refresh
 }
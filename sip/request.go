@@ -21,10 +21,12 @@ const (
 
 type Request struct {
 	message
+	//outboundProxy 单个请求的出站代理, 优先于ListeningPoint和Stack的配置
+	outboundProxy *SipUri
 }
 
 func NewRequest() *Request {
-	return &Request{message{headers: make(map[string][]Header, 10)}}
+	return &Request{message: message{headers: make(map[string][]Header, 10)}}
 }
 
 func (r *Request) GetRequestLine() *RequestLine {
@@ -69,6 +71,18 @@ func (r *Request) CheckHeaders() error {
 		return fmt.Errorf("the %s requests MUST contain a Contact header", r.cSeq.Method)
 	}
 
+	//RFC 3261 10.3 Contact: *只能用于REGISTER, 并且不能和其他Contact同时出现
+	contacts := r.contacts()
+	for _, contact := range contacts {
+		if !contact.Wildcard {
+			continue
+		} else if line.Method != REGISTER {
+			return fmt.Errorf("the wildcard Contact is only allowed in REGISTER requests")
+		} else if len(contacts) > 1 {
+			return fmt.Errorf("the wildcard Contact must be the only Contact")
+		}
+	}
+
 	if line.Method == SUBSCRIBE {
 		if header := r.GetHeader(EventName); header == nil {
 			return fmt.Errorf("the subscibe request must contain an event header")
@@ -82,6 +96,15 @@ func (r *Request) CheckHeaders() error {
 	return nil
 }
 
+// SetOutboundProxy 指定该请求的出站代理, 见ListeningPoint.OutboundProxy
+func (r *Request) SetOutboundProxy(proxy *SipUri) {
+	r.outboundProxy = proxy
+}
+
+func (r *Request) OutboundProxy() *SipUri {
+	return r.outboundProxy
+}
+
 func (r *Request) RemoveTransactionTag() {
 	if header := r.Via(); header != nil {
 		header.setBranch("")
@@ -95,12 +118,7 @@ func (r *Request) RemoveFromTag() {
 func (r *Request) Clone() *Request {
 	request := *r
 	request.line = r.line.Clone()
-	request.headers = make(map[string][]Header, len(r.headers))
-	for _, headers := range r.headers {
-		for _, header := range headers {
-			request.AppendHeader(header)
-		}
-	}
+	r.copyHeaders(&request.message)
 	if r.body != nil {
 		request.body = make([]byte, len(r.body))
 		copy(request.body, r.body)
@@ -120,12 +138,31 @@ func (r *Request) CreateResponse(code int) *Response {
 
 func (r *Request) CreateResponseWithReason(code int, reason string) *Response {
 	response := &Response{message{line: &StatusLine{SipVersion, code, reason}, headers: make(map[string][]Header, 10)}}
-	for _, header := range r.headers {
-		switch header[0].Name() {
+	for _, name := range r.order {
+		header := r.GetHeader(name)
+		switch name {
 		case ViaName, ViaShortName, CallIDName, CallIDShortName, CSeqName, FromName, FromShortName, ToName, ToShortName, MaxForwardsName:
 			response.SetHeader(header[0].Clone())
 			break
+		case RecordRouteName:
+			//RFC 3261 12.1.1 建立对话的应答需要携带请求的Record-Route
+			if code > 100 && code < 300 {
+				for _, recordRoute := range header {
+					response.AppendHeader(recordRoute.Clone())
+				}
+			}
 		}
 	}
 	return response
 }
+
+// shallowClone 复制消息头列表, 修改副本的消息头不影响原请求. 头部对象本身是共享的
+func (r *Request) shallowClone() *Request {
+	request := *r
+	request.headers = make(map[string][]Header, len(r.headers))
+	for name, headers := range r.headers {
+		request.headers[name] = append([]Header(nil), headers...)
+	}
+	request.order = append([]string(nil), r.order...)
+	return &request
+}
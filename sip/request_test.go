@@ -1,6 +1,13 @@
 package sip
 
-import "testing"
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 type MyIntercept struct {
 }
@@ -77,3 +84,218 @@ func TestStack(t *testing.T) {
 		transaction.Execute()
 	}
 }
+
+func TestCreateCancel(t *testing.T) {
+	invite := "INVITE sip:34020000001320000001@192.168.1.108:5060 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1\r\n" +
+		"Route: <sip:p1.example.com;lr>\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000001320000001@3402000000>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 2 INVITE\r\n" +
+		"Contact: <sip:34020000002000000001@192.168.1.100:5060>\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	msg, _, err := parseMessage([]byte(invite), len(invite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := msg.(*Request)
+	transaction := &ClientTransaction{transaction: transaction{originalRequest: request, isInvite: true}}
+	cancel := transaction.createCancel()
+	if cancel.GetRequestMethod() != CANCEL || cancel.CSeq().Number != 2 || cancel.CSeq().Method != CANCEL {
+		t.Fatalf("bad CANCEL %s", cancel.ToString())
+	}
+	if cancel.Via().branch != request.Via().branch || cancel.GetTransactionId() == request.GetTransactionId() {
+		t.Fatalf("the CANCEL must use the branch of the INVITE")
+	}
+	if route := cancel.GetHeader(RouteName); len(route) != 1 || route[0].(*Route).Address[0].HostPort.Host != "p1.example.com" {
+		t.Fatalf("the CANCEL must contain the Route of the INVITE")
+	}
+}
+
+type requestRecorder struct {
+	requests chan *RequestEvent
+}
+
+func (r *requestRecorder) OnRequest(event *RequestEvent) {
+	r.requests <- event
+}
+
+// testStack 没有启动传输层的Stack, 时间由FakeClock驱动, 发送的消息记录在conn中
+type testStack struct {
+	*Stack
+	t        *testing.T
+	clock    *FakeClock
+	listen   *ListeningPoint
+	conn     *recordConn
+	recorder *requestRecorder
+}
+
+func newTestStack(t *testing.T) *testStack {
+	recorder := &requestRecorder{requests: make(chan *RequestEvent, 8)}
+	clock := NewFakeClock(time.Unix(0, 0))
+	stack := &Stack{EventListener: recorder, TimerService: clock}
+	stack.Options.Timers = DefaultTimers
+	stack.Options.TryingDelay = -1
+	stack.clientTransactions = CreateSafeMap(4)
+	stack.serverTransactions = CreateSafeMap(4)
+	stack.dialogs = CreateSafeMap(4)
+	stack.mergedRequests = CreateSafeMap(4)
+	stack.Resolver = &StaticResolver{}
+	conn := &recordConn{written: make(chan string, 64)}
+	listen := &ListeningPoint{IP: "192.168.1.108", Port: 5060, Transport: UDP, sipStack: stack}
+	//Stop可以关闭没有启动的传输层
+	udp := &UDPTransport{udp: []net.PacketConn{conn}}
+	udp.ctx, udp.cancel = context.WithCancel(context.Background())
+	listen.transport = udp
+	stack.Listens = []*ListeningPoint{listen}
+	return &testStack{Stack: stack, t: t, clock: clock, listen: listen, conn: conn, recorder: recorder}
+}
+
+// newRequest 发往192.168.1.100:5060的请求
+func (s *testStack) newRequest(method string) *Request {
+	uri := NewSipUri("34020000001320000001", "192.168.1.100", 5060)
+	from := &From{Address: &Address{Uri: NewSipUri("34020000002000000001", "3402000000", 0)}}
+	to := &To{Address: &Address{Uri: NewSipUri("34020000001320000001", "3402000000", 0)}}
+	request := s.listen.NewEmptyRequestMessage(method, uri, from, to)
+	request.SetHeader(&Contact{Address: &Address{Uri: NewSipUri("34020000002000000001", "192.168.1.108", 5060)}})
+	return request
+}
+
+// response 对发送的请求msg创建应答, tag不为空时设置To tag. 应答携带Contact
+func (s *testStack) response(msg string, code int, tag string) *Response {
+	response := parseTestRequest(s.t, msg).CreateResponse(code)
+	if tag != "" {
+		response.To().Tag = tag
+	}
+	response.SetHeader(&Contact{Address: &Address{Uri: NewSipUri("34020000001320000001", "192.168.1.100", 5060)}})
+	return response
+}
+
+// peerRequest 对端发送的请求, toTag为空时是对话外的请求, headers是额外的消息头
+func peerRequest(method, branch, toTag string, cSeq int, headers string) string {
+	to := "<sip:34020000001320000001@3402000000>"
+	if toTag != "" {
+		to += ";tag=" + toTag
+	}
+	return method + " sip:34020000001320000001@192.168.1.108:5060 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=" + branch + "\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: " + to + "\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: " + strconv.Itoa(cSeq) + " " + method + "\r\n" +
+		"Contact: <sip:34020000002000000001@192.168.1.100:5060>\r\n" +
+		"Max-Forwards: 70\r\n" + headers +
+		"Content-Length: 0\r\n\r\n"
+}
+
+// next 等待监听点发送的下一个消息
+func (s *testStack) next() string {
+	select {
+	case msg := <-s.conn.written:
+		return msg
+	case <-time.After(5 * time.Second):
+		s.t.Fatalf("no message was sent")
+		return ""
+	}
+}
+
+// process 模拟监听点收到消息
+func (s *testStack) process(data string) {
+	if err := processMessage(s.listen, s.Stack, s.conn, false, []byte(data), len(data)); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	message := func(branch string, maxForwards int) string {
+		return "MESSAGE sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=" + branch + "\r\n" +
+			"From: <sip:34020000001110000001@3402000000>;tag=1\r\n" +
+			"To: <sip:34020000002000000001@3402000000>\r\n" +
+			"Call-ID: 1\r\n" +
+			"CSeq: 1 MESSAGE\r\n" +
+			"Max-Forwards: " + strconv.Itoa(maxForwards) + "\r\n" +
+			"Content-Length: 0\r\n\r\n"
+	}
+
+	stack := newTestStack(t)
+	recorder, conn, process := stack.recorder, stack.conn, stack.process
+
+	process(message("z9hG4bK-1", 70))
+	event := <-recorder.requests
+	//经过另一条路径到达的相同请求
+	process(message("z9hG4bK-2", 69))
+	if len(conn.messages) != 1 || !strings.HasPrefix(conn.messages[0], "SIP/2.0 482 Loop Detected") {
+		t.Fatalf("the merged request should be rejected %v", conn.messages)
+	}
+	//重传的请求属于原来的事务
+	process(message("z9hG4bK-1", 70))
+	if len(conn.messages) != 1 || len(recorder.requests) != 0 {
+		t.Fatalf("the retransmission should be absorbed %v", conn.messages)
+	}
+
+	//原来的事务结束后不再视为合并请求
+	event.ServerTransaction.terminated()
+	process(message("z9hG4bK-3", 70))
+	<-recorder.requests
+
+	process(message("z9hG4bK-4", 0))
+	if len(conn.messages) != 2 || !strings.HasPrefix(conn.messages[1], "SIP/2.0 483 Too Many Hops") {
+		t.Fatalf("the request should be rejected with 483 %v", conn.messages)
+	}
+
+	//关闭检查
+	stack.Options.DisableMergedRequestCheck = true
+	stack.Options.DisableMaxForwardsCheck = true
+	process(message("z9hG4bK-5", 0))
+	<-recorder.requests
+	if len(conn.messages) != 2 {
+		t.Fatalf("the checks should be disabled %v", conn.messages)
+	}
+}
+
+func TestCancelWithRequestTimeout(t *testing.T) {
+	stack := newTestStack(t)
+	stack.Options.RequestTimeout = time.Minute
+	transaction, err := stack.listen.NewClientTransaction(stack.newRequest(INVITE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan int, 4)
+	go transaction.SendRequest(func(event *ResponseEvent) {
+		responses <- event.Response.GetStatusCode()
+	}, func(err *UACError) {
+		t.Error(err)
+	})
+
+	invite := stack.next()
+	stack.process(stack.response(invite, Ringing, "2").ToString())
+	if code := <-responses; code != Ringing {
+		t.Fatalf("bad response %d", code)
+	}
+
+	//设置了请求超时时间, 收到临时应答后仍然等待最终应答
+	if err = transaction.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	cancel := stack.next()
+	if !strings.HasPrefix(cancel, "CANCEL ") {
+		t.Fatalf("bad CANCEL %s", cancel)
+	}
+	stack.process(stack.response(cancel, OK, "2").ToString())
+	stack.process(stack.response(invite, RequestTerminated, "2").ToString())
+	select {
+	case code := <-responses:
+		if code != RequestTerminated {
+			t.Fatalf("bad response %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the 487 of the cancelled INVITE should be returned")
+	}
+	if ack := stack.next(); !strings.HasPrefix(ack, "ACK ") {
+		t.Fatalf("the 487 should be acknowledged %s", ack)
+	}
+}
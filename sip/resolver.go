@@ -0,0 +1,307 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resolver RFC 3263 server location使用的DNS查询, 测试时可以替换为StaticResolver
+type Resolver interface {
+	LookupNAPTR(domain string) ([]*NAPTR, error)
+	// LookupSRV name是完整的SRV域名, 例如 _sip._udp.example.com
+	LookupSRV(name string) ([]*net.SRV, error)
+	// LookupHost A/AAAA
+	LookupHost(host string) ([]string, error)
+}
+
+// DefaultResolver SRV和A/AAAA使用系统解析, NAPTR直接查询NameServers(为空时读取/etc/resolv.conf)
+type DefaultResolver struct {
+	NameServers []string
+	Timeout     time.Duration
+}
+
+func (r *DefaultResolver) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return 3 * time.Second
+}
+
+func (r *DefaultResolver) LookupNAPTR(domain string) ([]*NAPTR, error) {
+	servers := r.NameServers
+	if len(servers) == 0 {
+		servers = systemNameServers()
+	}
+
+	var err error
+	for _, server := range servers {
+		var records []*NAPTR
+		if records, err = queryNAPTR(server, domain, r.timeout()); err == nil {
+			return records, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (r *DefaultResolver) LookupSRV(name string) ([]*net.SRV, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+func (r *DefaultResolver) LookupHost(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// StaticResolver 内存中的DNS表, key不区分大小写, 不以.结尾
+type StaticResolver struct {
+	NAPTR map[string][]*NAPTR
+	SRV   map[string][]*net.SRV
+	Hosts map[string][]string
+}
+
+func staticKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (r *StaticResolver) LookupNAPTR(domain string) ([]*NAPTR, error) {
+	return r.NAPTR[staticKey(domain)], nil
+}
+
+func (r *StaticResolver) LookupSRV(name string) ([]*net.SRV, error) {
+	return r.SRV[staticKey(name)], nil
+}
+
+func (r *StaticResolver) LookupHost(host string) ([]string, error) {
+	if addresses, ok := r.Hosts[staticKey(host)]; ok {
+		return addresses, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+var (
+	// naptrServices NAPTR service字段对应的传输方式
+	naptrServices = map[string]string{
+		"SIP+D2U":  UDP,
+		"SIP+D2T":  TCP,
+		"SIPS+D2T": TLS,
+		"SIP+D2W":  WS,
+		"SIPS+D2W": WSS,
+	}
+
+	srvPrefixes = map[string]string{
+		UDP: "_sip._udp.",
+		TCP: "_sip._tcp.",
+		TLS: "_sips._tcp.",
+		WS:  "_sip._ws.",
+		WSS: "_sips._ws.",
+	}
+)
+
+// orderSRV RFC 2782 按priority升序, 相同priority按weight随机排序
+func orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	for i := 0; i < len(sorted); {
+		j := i
+		total := 0
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			total += int(sorted[j].Weight) + 1
+			j++
+		}
+
+		for k := i; k < j-1; k++ {
+			n := rand.Intn(total)
+			for m := k; m < j; m++ {
+				if n -= int(sorted[m].Weight) + 1; n < 0 {
+					total -= int(sorted[m].Weight) + 1
+					sorted[k], sorted[m] = sorted[m], sorted[k]
+					break
+				}
+			}
+		}
+		i = j
+	}
+
+	return sorted
+}
+
+// resolveHost domain是URI中的域名, 保存在Hop中用于TLS的SNI和证书校验(RFC 5922 4.1), 而不是SRV的target
+func resolveHost(resolver Resolver, host string, port int, transport string, domain string) []*Hop {
+	if ip := net.ParseIP(host); ip != nil {
+		return []*Hop{{IP: host, Port: port, Transport: transport, Host: domain}}
+	}
+
+	addresses, err := resolver.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+
+	hops := make([]*Hop, 0, len(addresses))
+	for _, address := range addresses {
+		hops = append(hops, &Hop{IP: address, Port: port, Transport: transport, Host: domain})
+	}
+	return hops
+}
+
+func resolveSRV(resolver Resolver, name string, transport string, domain string) []*Hop {
+	records, err := resolver.LookupSRV(name)
+	if err != nil {
+		return nil
+	}
+
+	var hops []*Hop
+	for _, record := range orderSRV(records) {
+		//target为.表示服务不可用
+		if record.Target == "." || record.Target == "" {
+			continue
+		}
+		hops = append(hops, resolveHost(resolver, strings.TrimSuffix(record.Target, "."), int(record.Port), transport, domain)...)
+	}
+	return hops
+}
+
+func containsTransport(transports []string, transport string) bool {
+	for _, t := range transports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// locateHops RFC 3263 4.1/4.2 根据URI确定传输方式和目标地址, 返回的目标按优先级排序.
+// preferred 在URI没有指定传输方式并且无法通过DNS确定时使用, supported 是本地存在监听点的传输方式
+func locateHops(resolver Resolver, uri *SipUri, preferred string, supported []string) ([]*Hop, error) {
+	host := strings.Trim(uri.HostPort.Host, "[]")
+	port := uri.HostPort.Port
+	if host == "" {
+		return nil, fmt.Errorf("the URI must contain HOST")
+	}
+
+	transport := uriTransport(uri, "")
+	if uri.IsSecure() && transport == "" && !isSecure(preferred) {
+		preferred = TLS
+	}
+	if uri.IsSecure() && transport != "" && !isSecure(transport) {
+		return nil, fmt.Errorf("the sips URI must be sent over TLS")
+	}
+
+	//RFC 7118 浏览器在Contact/Via中使用的.invalid域名不能解析, 由getConn复用浏览器建立的连接
+	if strings.HasSuffix(strings.ToLower(host), ".invalid") {
+		t := transport
+		if t == "" {
+			t = preferred
+		}
+		if t == WS || t == WSS {
+			if port == 0 {
+				port = defaultPort(t)
+			}
+			return []*Hop{{IP: host, Port: port, Transport: t}}, nil
+		}
+	}
+
+	domain := host
+	if net.ParseIP(host) != nil {
+		domain = ""
+	}
+
+	//IP地址或者指定了端口, 不查询NAPTR/SRV
+	if domain == "" || port != 0 {
+		if transport == "" {
+			transport = preferred
+		}
+		if port == 0 {
+			port = defaultPort(transport)
+		}
+		if hops := resolveHost(resolver, host, port, transport, domain); len(hops) > 0 {
+			return hops, nil
+		}
+		return nil, fmt.Errorf("failed to resolve %s", host)
+	}
+
+	var hops []*Hop
+	if transport != "" {
+		hops = resolveSRV(resolver, srvPrefixes[transport]+host, transport, domain)
+	} else {
+		//NAPTR
+		records, _ := resolver.LookupNAPTR(host)
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Order != records[j].Order {
+				return records[i].Order < records[j].Order
+			}
+			return records[i].Preference < records[j].Preference
+		})
+
+		for _, record := range records {
+			t, ok := naptrServices[strings.ToUpper(record.Service)]
+			if !ok || !strings.EqualFold(record.Flags, "s") || !containsTransport(supported, t) {
+				continue
+			} else if uri.IsSecure() && !isSecure(t) {
+				continue
+			}
+			hops = append(hops, resolveSRV(resolver, strings.TrimSuffix(record.Replacement, "."), t, domain)...)
+		}
+
+		//没有NAPTR记录, 依次查询支持的传输方式的SRV记录
+		if len(records) == 0 {
+			for _, t := range supported {
+				if uri.IsSecure() && !isSecure(t) {
+					continue
+				}
+				hops = append(hops, resolveSRV(resolver, srvPrefixes[t]+host, t, domain)...)
+			}
+		}
+		transport = preferred
+	}
+
+	//没有SRV记录, 使用A/AAAA记录和默认端口
+	if len(hops) == 0 {
+		hops = resolveHost(resolver, host, defaultPort(transport), transport, domain)
+	}
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s", host)
+	}
+
+	return hops, nil
+}
+
+func (stack *Stack) supportedTransports() []string {
+	var transports []string
+	for _, listen := range stack.Listens {
+		if t := strings.ToUpper(listen.Transport); !containsTransport(transports, t) {
+			transports = append(transports, t)
+		}
+	}
+	return transports
+}
+
+// findNextHops 下一跳URI的所有候选目标, preferred是请求Via的传输方式
+func (stack *Stack) findNextHops(uri *SipUri, preferred string) ([]*Hop, error) {
+	if uri.IsTel() {
+		//RFC 3261 19.1.6 tel URI没有主机, 需要通过出站代理或者Route发送
+		return nil, fmt.Errorf("the tel URI %s requires an outbound proxy or route", uri.ToString())
+	} else if uri.IsAbsolute() {
+		return nil, fmt.Errorf("the %s URI %s cannot be resolved", uri.GetScheme(), uri.ToString())
+	}
+
+	resolver := stack.Resolver
+	if resolver == nil {
+		resolver = &DefaultResolver{}
+	}
+
+	return locateHops(resolver, uri, strings.ToUpper(preferred), stack.supportedTransports())
+}
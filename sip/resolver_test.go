@@ -0,0 +1,380 @@
+package sip
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocateHops(t *testing.T) {
+	resolver := &StaticResolver{
+		NAPTR: map[string][]*NAPTR{
+			"example.com": {
+				{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"},
+				{Order: 10, Preference: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com"},
+				{Order: 5, Preference: 10, Flags: "s", Service: "SIPS+D2T", Replacement: "_sips._tcp.example.com"},
+			},
+		},
+		SRV: map[string][]*net.SRV{
+			"_sip._tcp.example.com": {
+				{Target: "b.example.com.", Port: 5070, Priority: 20},
+				{Target: "a.example.com.", Port: 5060, Priority: 10},
+			},
+			"_sip._udp.example.com": {
+				{Target: "a.example.com.", Port: 5060, Priority: 10},
+			},
+			"_sip._udp.example.org": {
+				{Target: "c.example.org.", Port: 5062, Priority: 10},
+			},
+		},
+		Hosts: map[string][]string{
+			"a.example.com": {"192.168.1.1"},
+			"b.example.com": {"192.168.1.2"},
+			"c.example.org": {"192.168.1.3"},
+			"example.net":   {"192.168.1.4"},
+		},
+	}
+
+	//NAPTR按order排序, 忽略本地不支持的TLS
+	uri, _ := parseUri("sip:1000@example.com")
+	hops, err := locateHops(resolver, uri, UDP, []string{UDP, TCP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Hop{{"192.168.1.1", 5060, TCP, "example.com"}, {"192.168.1.2", 5070, TCP, "example.com"}, {"192.168.1.1", 5060, UDP, "example.com"}}
+	if len(hops) != len(expected) {
+		t.Fatalf("bad hops %d", len(hops))
+	}
+	for i, hop := range hops {
+		if *hop != expected[i] {
+			t.Fatalf("bad hop %d %v", i, *hop)
+		}
+	}
+
+	//没有NAPTR记录, 查询SRV
+	uri, _ = parseUri("sip:1000@example.org")
+	if hops, err = locateHops(resolver, uri, UDP, []string{UDP, TCP}); err != nil || *hops[0] != (Hop{"192.168.1.3", 5062, UDP, "example.org"}) {
+		t.Fatalf("bad srv hop %v", err)
+	}
+
+	//没有SRV记录, 使用A记录和默认端口
+	uri, _ = parseUri("sip:1000@example.net;transport=tcp")
+	if hops, err = locateHops(resolver, uri, UDP, []string{UDP, TCP}); err != nil || *hops[0] != (Hop{"192.168.1.4", 5060, TCP, "example.net"}) {
+		t.Fatalf("bad host hop %v", err)
+	}
+
+	//IP地址不查询DNS
+	uri, _ = parseUri("sips:1000@192.168.1.5")
+	if hops, err = locateHops(resolver, uri, UDP, []string{UDP, TLS}); err != nil || *hops[0] != (Hop{"192.168.1.5", 5061, TLS, ""}) {
+		t.Fatalf("bad ip hop %v", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	stack := newTestStack(t)
+	stack.Resolver = &StaticResolver{
+		SRV: map[string][]*net.SRV{
+			"_sip._udp.example.com": {
+				{Target: "a.example.com.", Port: 5060, Priority: 10},
+				{Target: "b.example.com.", Port: 5070, Priority: 20},
+			},
+		},
+		Hosts: map[string][]string{
+			"a.example.com": {"192.168.1.101"},
+			"b.example.com": {"192.168.1.102"},
+		},
+	}
+
+	execute := func() (*ClientTransaction, chan *ResponseEvent, chan error) {
+		uri, _ := parseUri("sip:1000@example.com")
+		from := &From{Address: &Address{Uri: NewSipUri("2000", "example.com", 0)}}
+		request := stack.listen.NewEmptyRequestMessage(MESSAGE, uri, from, &To{Address: &Address{Uri: uri}})
+		transaction, err := stack.listen.NewClientTransaction(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, errs := make(chan *ResponseEvent, 1), make(chan error, 1)
+		go func() {
+			event, err := transaction.Execute()
+			events <- event
+			errs <- err
+		}()
+		return transaction, events, errs
+	}
+	respond := func(msg string, code int) {
+		stack.process(parseTestRequest(t, msg).CreateResponse(code).ToString())
+	}
+
+	//503 RFC 3263 4.3 使用新的branch发往下一个目标
+	stack.Options.RequestTimeout = time.Minute
+	first, events, errs := execute()
+	msg := stack.next()
+	respond(msg, ServiceUnavailable)
+	next := stack.next()
+	if sentTo := stack.conn.sentTo(); len(sentTo) != 2 || sentTo[0] != "192.168.1.101:5060" || sentTo[1] != "192.168.1.102:5070" {
+		t.Fatalf("the request should fail over to the next target %v", sentTo)
+	} else if parseTestRequest(t, next).Via().branch == first.originalRequest.Via().branch {
+		t.Fatalf("the next target should use a new transaction")
+	}
+	respond(next, OK)
+	if event, err := <-events, <-errs; err != nil || event.Response.GetStatusCode() != OK {
+		t.Fatalf("the response of the next target should be returned %v", err)
+	}
+	//事务结束时释放timeoutCtx
+	stack.clock.Advance(DefaultTimers.T4)
+	if first.timeoutCtx.Err() != context.Canceled {
+		t.Fatalf("the timeout context should be cancelled when the transaction terminates")
+	}
+
+	//超时
+	stack.Options.RequestTimeout = 0
+	_, events, errs = execute()
+	msg = stack.next()
+	stack.clock.Advance(64 * DefaultTimers.T1)
+	for next = stack.next(); next == msg; next = stack.next() {
+	}
+	if sentTo := stack.conn.sentTo(); sentTo[len(sentTo)-1] != "192.168.1.102:5070" {
+		t.Fatalf("the request should fail over to the next target after timeout %v", sentTo)
+	}
+
+	//所有目标都失败. 下一个事务在另一个协程中启动定时器, 推进时钟直到返回结果
+	for i := 0; len(events) == 0; i++ {
+		if i > 1000 {
+			t.Fatalf("the request should fail after all targets timed out")
+		}
+		stack.clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	if event, err := <-events, <-errs; event != nil || err == nil || err.(*UACError).code != ErrorTransactionTimeout {
+		t.Fatalf("the timeout of the last target should be returned %v", err)
+	}
+}
+
+func TestResolvedTLSHop(t *testing.T) {
+	//证书签发给URI的域名, 而不是SRV的target或者IP
+	ca := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "gsip test CA"}}, nil)
+	serverCert := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	serverNames := make(chan string, 4)
+	server := &TLSServer{config: &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverNames <- hello.ServerName
+			return &serverCert, nil
+		},
+	}}
+	recorder := newStreamRecorder()
+	server.setHandler(recorder)
+	port := freePort(t)
+	if err := server.listen(joinHostPort("127.0.0.1", port)); err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	stack := newTestStack(t)
+	stack.Resolver = &StaticResolver{
+		SRV: map[string][]*net.SRV{
+			"_sips._tcp.example.com": {{Target: "sip1.example.com.", Port: uint16(port), Priority: 10}},
+		},
+		Hosts: map[string][]string{
+			"sip1.example.com": {"127.0.0.1"},
+		},
+	}
+	tlsListen := &ListeningPoint{IP: "127.0.0.1", Port: 5061, Transport: TLS, TLSConfig: &tls.Config{RootCAs: pool}, sipStack: stack.Stack, tcpSessions: CreateSafeMap(1)}
+	stack.Listens = append(stack.Listens, tlsListen)
+
+	uri, _ := parseUri("sips:1000@example.com")
+	from := &From{Address: &Address{Uri: NewSipUri("2000", "example.com", 0)}}
+	request := tlsListen.NewEmptyRequestMessage(MESSAGE, uri, from, &To{Address: &Address{Uri: uri}})
+	if err := tlsListen.SendRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if conn, ok := tlsListen.tcpSessions.Find(joinHostPort("127.0.0.1", port)); ok {
+			conn.(net.Conn).Close()
+		}
+	}()
+
+	if name := <-serverNames; name != "example.com" {
+		t.Fatalf("the SNI should be the domain of the URI, got %s", name)
+	}
+	select {
+	case recv := <-recorder.packets:
+		if !strings.HasPrefix(recv, "MESSAGE sips:1000@example.com SIP/2.0\r\n") || !strings.Contains(recv, "Call-ID: "+string(*request.CallID())) {
+			t.Fatalf("bad message %s", recv)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the request should be sent over TLS")
+	}
+}
+
+// dnsResponse question是查询中的问题, truncated设置TC位, replacement为空时没有应答记录
+func dnsResponse(query []byte, question string, truncated bool, replacement string) []byte {
+	flags := byte(0x81)
+	if truncated {
+		flags |= 0x02
+	}
+	msg := []byte{query[0], query[1], flags, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg, _ = appendDNSName(msg, question)
+	msg = append(msg, 0, dnsTypeNAPTR, 0, dnsClassINET)
+	if replacement == "" {
+		return msg
+	}
+
+	msg[7] = 1
+	rdata := []byte{0, 10, 0, 10, 1, 's', 7}
+	rdata = append(rdata, "SIP+D2T"...)
+	rdata = append(rdata, 0)
+	rdata, _ = appendDNSName(rdata, replacement)
+	msg = append(msg, 0xC0, 12, 0, dnsTypeNAPTR, 0, dnsClassINET, 0, 0, 0, 60, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func TestQueryNAPTR(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	//UDP应答被截断, 完整的记录通过TCP返回. questions是UDP应答中的问题
+	questions := make(chan string, 2)
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(dnsResponse(buffer[:n], <-questions, true, ""), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			length := make([]byte, 2)
+			if _, err = io.ReadFull(conn, length); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err = io.ReadFull(conn, query); err == nil {
+					response := dnsResponse(query, "example.com", false, "_sip._tcp.example.com")
+					conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	questions <- "example.com"
+	records, err := queryNAPTR(udp.LocalAddr().String(), "example.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(records) != 1 || records[0].Service != "SIP+D2T" || records[0].Replacement != "_sip._tcp.example.com" {
+		t.Fatalf("the truncated response should be retried over TCP %v", records)
+	}
+
+	questions <- "example.org"
+	if _, err = queryNAPTR(udp.LocalAddr().String(), "example.com", time.Second); err == nil {
+		t.Fatalf("the response to another question should be rejected")
+	}
+}
+
+func TestStatelessFailover(t *testing.T) {
+	stack := newTestStack(t)
+	closed := freePort(t)
+	stack.Resolver = &StaticResolver{
+		SRV: map[string][]*net.SRV{
+			"_sip._tcp.example.com": {
+				{Target: "a.example.com.", Port: uint16(closed), Priority: 10},
+				{Target: "b.example.com.", Port: 5070, Priority: 20},
+			},
+		},
+		Hosts: map[string][]string{
+			"a.example.com": {"127.0.0.1"},
+			"b.example.com": {"192.168.1.102"},
+		},
+	}
+	tcpConn := &recordConn{}
+	tcp := &ListeningPoint{IP: "192.168.1.108", Port: 5060, Transport: TCP, sipStack: stack.Stack, tcpSessions: CreateSafeMap(1)}
+	tcp.tcpSessions.Add(generateTcpConnectKey("192.168.1.102", 5070), tcpConn)
+	stack.Listens = append(stack.Listens, tcp)
+
+	//DNS只返回TCP目标, 通过TCP监听点发送. 第一个目标连接失败, 发往下一个目标
+	uri, _ := parseUri("sip:1000@example.com")
+	from := &From{Address: &Address{Uri: NewSipUri("2000", "example.com", 0)}}
+	request := stack.listen.NewEmptyRequestMessage(ACK, uri, from, &To{Address: &Address{Uri: uri}})
+	branch := generateBranchId()
+	request.Via().setBranch(branch)
+	if err := stack.listen.SendRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	if sent := tcpConn.sent(); len(sent) != 1 || !strings.Contains(sent[0], "Via: SIP/2.0/TCP 192.168.1.108:5060;") || !strings.Contains(sent[0], "branch="+branch) {
+		t.Fatalf("the stateless request should fail over to the next TCP target %v", sent)
+	}
+}
+
+func TestWebSocketClientTarget(t *testing.T) {
+	//.invalid域名不查询DNS
+	for _, target := range []string{"sip:1000@df7jal23ls0d.invalid;transport=ws", "sip:1000@df7jal23ls0d.invalid:5060;transport=ws"} {
+		uri, _ := parseUri(target)
+		if hops, err := locateHops(&StaticResolver{}, uri, WS, []string{WS}); err != nil || hops[0].IP != "df7jal23ls0d.invalid" || hops[0].Transport != WS {
+			t.Fatalf("the .invalid host of %s should not be resolved %v", target, err)
+		}
+	}
+
+	invite := "INVITE sip:34020000001320000001@192.168.1.108 SIP/2.0\r\n" +
+		"Via: SIP/2.0/WS df7jal23ls0d.invalid;branch=z9hG4bK-1\r\n" +
+		"From: <sip:1000@example.com>;tag=1\r\n" +
+		"To: <sip:34020000001320000001@192.168.1.108>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:1000@df7jal23ls0d.invalid;transport=ws>\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	request := parseTestRequest(t, invite)
+	response := request.CreateResponse(OK)
+	response.To().Tag = "2"
+
+	//对话内的请求通过浏览器建立的连接发送
+	stack := newTestStack(t)
+	wsConn := &recordConn{}
+	ws := &ListeningPoint{IP: "192.168.1.108", Port: 80, Transport: WS, sipStack: stack.Stack, tcpSessions: CreateSafeMap(1), wsAliases: CreateSafeMap(1)}
+	ws.wsAliases.Add("df7jal23ls0d.invalid", wsConn)
+	stack.Listens = append(stack.Listens, ws)
+	dialog := createDialog(stack.Stack, ws, request, response, true)
+	dialog.state = dialogStateConfirmed
+
+	bye, err := dialog.CreateRequest(BYE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction, err := ws.NewClientTransaction(bye)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction.SendRequest(nil, nil)
+	if sent := wsConn.sent(); len(sent) != 1 || !strings.HasPrefix(sent[0], "BYE sip:1000@df7jal23ls0d.invalid;transport=ws SIP/2.0\r\n") {
+		t.Fatalf("the BYE should be sent over the websocket connection %v", sent)
+	}
+}
@@ -31,6 +31,7 @@ const (
 	UnsupportedURIScheme        = 416
 	BadExtension                = 420
 	ExtensionRequired           = 421
+	SessionIntervalTooSmall     = 422
 	IntervalTooBrief            = 423
 	TemporarilyUnavailable      = 480
 	CallTransactionDoesNotExist = 481
@@ -89,6 +90,7 @@ func init() {
 		416: "Unsupported URI Scheme",
 		420: "Bad Extension",
 		421: "Extension Required",
+		422: "Session Interval Too Small",
 		423: "Interval Too Brief",
 		480: "Temporarily Unavailable",
 		481: "Call transaction Does Not Exist",
@@ -144,12 +146,7 @@ func (r *Response) GetReason() string {
 func (r *Response) Clone() *Response {
 	response := *r
 	response.line = r.line.Clone()
-	response.headers = make(map[string][]Header, len(r.headers))
-	for _, headers := range r.headers {
-		for _, header := range headers {
-			response.AppendHeader(header)
-		}
-	}
+	r.copyHeaders(&response.message)
 	if r.body != nil {
 		response.body = make([]byte, len(r.body))
 		copy(response.body, r.body)
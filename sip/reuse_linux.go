@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package sip
+
+import "syscall"
+
+const (
+	reusePortSupported = true
+	//syscall包没有导出linux的SO_REUSEPORT
+	soReusePort = 0xf
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		if isIPv6Address(address) {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+		}
+	})
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package sip
+
+import "syscall"
+
+const reusePortSupported = true
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		//SO_REUSEADDR, windows上允许多个socket绑定同一个端口
+		syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, 0x4, 1)
+		if isIPv6Address(address) {
+			syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+		}
+	})
+}
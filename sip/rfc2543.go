@@ -0,0 +1,90 @@
+package sip
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RFC 3261 17.2.3 兼容RFC 2543. branch不以z9hG4bK开头或者没有branch时, branch不能唯一标识事务,
+// 使用Request-URI、To tag、From tag、Call-ID、CSeq和顶层Via匹配事务.
+// 非2xx的ACK的To tag是应答的To tag, 所以INVITE和ACK的事务ID不包含To tag, 收到ACK时再和最终应答的To tag比较
+
+func isRFC3261Branch(branch string) bool {
+	return strings.HasPrefix(branch, BranchPrefix)
+}
+
+// GetTransactionId RFC 2543的请求使用17.2.3的字段生成事务ID
+func (r *Request) GetTransactionId() string {
+	if isRFC3261Branch(r.Via().branch) {
+		return r.message.GetTransactionId()
+	}
+
+	cSeq := r.CSeq()
+	if ACK == cSeq.Method {
+		return r.legacyTransactionId(INVITE)
+	}
+	return r.legacyTransactionId(cSeq.Method)
+}
+
+// inviteTransactionId CANCEL对应的INVITE事务ID
+func (r *Request) inviteTransactionId() string {
+	if isRFC3261Branch(r.Via().branch) {
+		return r.Via().branch
+	}
+	return r.legacyTransactionId(INVITE)
+}
+
+func (r *Request) legacyTransactionId(method string) string {
+	toTag := r.To().Tag
+	if INVITE == method {
+		toTag = ""
+	}
+
+	via := r.Via()
+	return strings.Join([]string{
+		legacyUriKey(r.GetRequestLine().RequestUri),
+		toTag,
+		r.From().Tag,
+		r.CallID().Value(),
+		strconv.Itoa(r.CSeq().Number),
+		method,
+		strings.ToUpper(via.transport),
+		via.sendBy.ToString(),
+		via.branch,
+	}, "|")
+}
+
+// legacyUriKey 参数按照名称排序, 保证相同的URI生成相同的键
+func legacyUriKey(uri *SipUri) string {
+	if uri == nil {
+		return ""
+	}
+
+	var buffer strings.Builder
+	buffer.WriteString(uri.GetScheme())
+	buffer.WriteString(":")
+	buffer.WriteString(uri.User)
+	buffer.WriteString("@")
+	buffer.WriteString(strings.ToLower(uri.HostPort.ToString()))
+	names := make([]string, 0, len(uri.Params))
+	for name := range uri.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buffer.WriteString(";")
+		buffer.WriteString(strings.ToLower(name))
+		buffer.WriteString("=")
+		buffer.WriteString(uri.Params[name])
+	}
+	return buffer.String()
+}
+
+// matchLegacyAck RFC 2543的ACK的To tag必须和事务发送的最终应答的To tag相同
+func (t *ServerTransaction) matchLegacyAck(ack *Request) bool {
+	if isRFC3261Branch(ack.Via().branch) || t.finalResponse == nil {
+		return true
+	}
+	return ack.To().Tag == t.finalResponse.To().Tag
+}
@@ -0,0 +1,127 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+// legacyMessage RFC 2543的请求, 替换模板中的字段生成测试用例
+func legacyMessage(method, uri, via, to, callId, cSeq string) string {
+	return method + " " + uri + " SIP/2.0\r\n" +
+		"Via: " + via + "\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: " + to + "\r\n" +
+		"Call-ID: " + callId + "\r\n" +
+		"CSeq: " + cSeq + "\r\n" +
+		"Contact: <sip:34020000002000000001@192.168.1.100:5060>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n"
+}
+
+const (
+	legacyUri = "sip:34020000001320000001@192.168.1.108:5060"
+	legacyVia = "SIP/2.0/UDP 192.168.1.100:5060"
+	legacyTo  = "<sip:34020000001320000001@3402000000>"
+)
+
+func parseTestRequest(t *testing.T, data string) *Request {
+	msg, isRequest, err := parseMessage([]byte(data), len(data))
+	if err != nil {
+		t.Fatal(err)
+	} else if !isRequest {
+		t.Fatalf("not a request")
+	}
+	return msg.(*Request)
+}
+
+func TestLegacyTransactionId(t *testing.T) {
+	corpus := []struct {
+		name   string
+		first  string
+		second string
+		match  bool
+	}{
+		{"retransmission without branch",
+			legacyMessage(INVITE, legacyUri, legacyVia, legacyTo, "1", "1 INVITE"),
+			legacyMessage(INVITE, legacyUri, legacyVia, legacyTo, "1", "1 INVITE"), true},
+		{"retransmission with RFC 2543 branch",
+			legacyMessage(INVITE, legacyUri, legacyVia+";branch=1", legacyTo, "1", "1 INVITE"),
+			legacyMessage(INVITE, legacyUri, legacyVia+";branch=1", legacyTo, "1", "1 INVITE"), true},
+		{"ACK for non-2xx",
+			legacyMessage(INVITE, legacyUri, legacyVia, legacyTo, "1", "1 INVITE"),
+			legacyMessage(ACK, legacyUri, legacyVia, legacyTo+";tag=2", "1", "1 ACK"), true},
+		{"request uri parameters in different order",
+			legacyMessage(MESSAGE, legacyUri+";transport=udp;user=phone", legacyVia, legacyTo, "1", "1 MESSAGE"),
+			legacyMessage(MESSAGE, legacyUri+";user=phone;transport=udp", legacyVia, legacyTo, "1", "1 MESSAGE"), true},
+		{"branch reused by a new request",
+			legacyMessage(MESSAGE, legacyUri, legacyVia+";branch=1", legacyTo, "1", "1 MESSAGE"),
+			legacyMessage(MESSAGE, legacyUri, legacyVia+";branch=1", legacyTo, "1", "2 MESSAGE"), false},
+		{"different Call-ID",
+			legacyMessage(MESSAGE, legacyUri, legacyVia, legacyTo, "1", "1 MESSAGE"),
+			legacyMessage(MESSAGE, legacyUri, legacyVia, legacyTo, "2", "1 MESSAGE"), false},
+		{"different To tag",
+			legacyMessage(BYE, legacyUri, legacyVia, legacyTo+";tag=2", "1", "2 BYE"),
+			legacyMessage(BYE, legacyUri, legacyVia, legacyTo+";tag=3", "1", "2 BYE"), false},
+		{"different request uri",
+			legacyMessage(MESSAGE, legacyUri, legacyVia, legacyTo, "1", "1 MESSAGE"),
+			legacyMessage(MESSAGE, "sip:34020000001320000002@192.168.1.108:5060", legacyVia, legacyTo, "1", "1 MESSAGE"), false},
+		{"different sent-by",
+			legacyMessage(MESSAGE, legacyUri, legacyVia, legacyTo, "1", "1 MESSAGE"),
+			legacyMessage(MESSAGE, legacyUri, "SIP/2.0/UDP 192.168.1.101:5060", legacyTo, "1", "1 MESSAGE"), false},
+		{"CANCEL does not match INVITE",
+			legacyMessage(INVITE, legacyUri, legacyVia, legacyTo, "1", "1 INVITE"),
+			legacyMessage(CANCEL, legacyUri, legacyVia, legacyTo, "1", "1 CANCEL"), false},
+		{"RFC 3261 ACK for non-2xx",
+			legacyMessage(INVITE, legacyUri, legacyVia+";branch=z9hG4bK-1", legacyTo, "1", "1 INVITE"),
+			legacyMessage(ACK, legacyUri, legacyVia+";branch=z9hG4bK-1", legacyTo+";tag=2", "1", "1 ACK"), true},
+	}
+
+	for _, c := range corpus {
+		first, second := parseTestRequest(t, c.first), parseTestRequest(t, c.second)
+		if match := first.GetTransactionId() == second.GetTransactionId(); match != c.match {
+			t.Errorf("%s: expected match %t, %s %s", c.name, c.match, first.GetTransactionId(), second.GetTransactionId())
+		}
+	}
+
+	invite := parseTestRequest(t, legacyMessage(INVITE, legacyUri, legacyVia, legacyTo, "1", "1 INVITE"))
+	cancel := parseTestRequest(t, legacyMessage(CANCEL, legacyUri, legacyVia, legacyTo, "1", "1 CANCEL"))
+	if cancel.inviteTransactionId() != invite.GetTransactionId() {
+		t.Fatalf("CANCEL should find the INVITE transaction")
+	}
+	if via := invite.Via().Value(); via != legacyVia {
+		t.Fatalf("bad via %s", via)
+	}
+}
+
+func TestLegacyServerTransaction(t *testing.T) {
+	stack := newTestStack(t)
+	recorder, conn, process := stack.recorder, stack.conn, stack.process
+
+	//没有branch的INVITE重传不会重复通知TU
+	invite := legacyMessage(INVITE, legacyUri, legacyVia, legacyTo, "1", "1 INVITE")
+	process(invite)
+	event := <-recorder.requests
+	process(invite)
+	if len(recorder.requests) != 0 || stack.serverTransactions.Size() != 1 {
+		t.Fatalf("the retransmission should match the transaction")
+	}
+
+	response := event.Request.CreateResponse(BusyHere)
+	response.To().Tag = "2"
+	event.ServerTransaction.SendResponse(response)
+	process(invite)
+	if len(conn.messages) != 2 || conn.messages[1] != conn.messages[0] || !strings.HasPrefix(conn.messages[0], "SIP/2.0 486") {
+		t.Fatalf("the final response should be retransmitted %v", conn.messages)
+	}
+
+	//To tag和最终应答不同的ACK不属于该事务
+	process(legacyMessage(ACK, legacyUri, legacyVia, legacyTo+";tag=3", "1", "1 ACK"))
+	if event.ServerTransaction.stateMachine.getState() != inviteServerStateCompleted || len(conn.messages) != 2 {
+		t.Fatalf("the ACK with a different To tag should not match")
+	}
+	process(legacyMessage(ACK, legacyUri, legacyVia, legacyTo+";tag=2", "1", "1 ACK"))
+	if ack := <-recorder.requests; ack.Request.GetRequestMethod() != ACK ||
+		event.ServerTransaction.stateMachine.getState() != inviteServerStateConfirmed {
+		t.Fatalf("the ACK should confirm the transaction")
+	}
+}
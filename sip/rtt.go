@@ -0,0 +1,124 @@
+package sip
+
+import (
+	"sync"
+	"time"
+)
+
+// Options.EstimateT1 RFC 3261 17.1.1.1 允许根据RTT调整T1. 按照RFC 6298估算每个目标地址的RTO作为T1
+
+const (
+	//minEstimatedT1 估算的T1的下限
+	minEstimatedT1 = 100 * time.Millisecond
+)
+
+type rttEntry struct {
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+type rttEstimator struct {
+	mutex   sync.Mutex
+	entries map[string]*rttEntry
+}
+
+func rttKey(hop *Hop) string {
+	return hop.Transport + "/" + joinHostPort(hop.IP, hop.Port)
+}
+
+// update RFC 6298 2 使用新的RTT样本更新SRTT和RTTVAR
+func (r *rttEstimator) update(key string, rtt time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[key]
+	if !ok {
+		r.entries[key] = &rttEntry{srtt: rtt, rttvar: rtt / 2}
+		return
+	}
+
+	delta := entry.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	entry.rttvar = (3*entry.rttvar + delta) / 4
+	entry.srtt = (7*entry.srtt + rtt) / 8
+}
+
+// t1 RTO = SRTT + 4*RTTVAR, 限制在[minEstimatedT1, T2]. 没有样本时返回fallback
+func (r *rttEstimator) t1(key string, fallback time.Duration, t2 time.Duration) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[key]
+	if !ok {
+		return fallback
+	}
+
+	rto := entry.srtt + 4*entry.rttvar
+	if rto < minEstimatedT1 {
+		rto = minEstimatedT1
+	} else if rto > t2 {
+		rto = t2
+	}
+	return rto
+}
+
+// transactionTimers 客户端事务使用的定时器, 开启EstimateT1时使用目标地址的估算值
+func (stack *Stack) transactionTimers(hop *Hop) Timers {
+	timers := stack.Options.Timers.merge(DefaultTimers)
+	if stack.rtt != nil && hop != nil {
+		timers.T1 = stack.rtt.t1(rttKey(hop), timers.T1, timers.T2)
+	}
+	return timers
+}
+
+// rttSample 一个客户端事务的RTT样本. 请求发生过重传时无法确定应答对应哪一次发送, 不采样(Karn算法)
+type rttSample struct {
+	mutex         sync.Mutex
+	sentAt        time.Time
+	retransmitted bool
+	done          bool
+}
+
+func (s *rttSample) sent(now time.Time) {
+	s.mutex.Lock()
+	s.sentAt = now
+	s.mutex.Unlock()
+}
+
+func (s *rttSample) retransmit() {
+	s.mutex.Lock()
+	s.retransmitted = true
+	s.mutex.Unlock()
+}
+
+// measure 收到第一个应答时返回RTT
+func (s *rttSample) measure(now time.Time) (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done || s.retransmitted || s.sentAt.IsZero() {
+		s.done = true
+		return 0, false
+	}
+
+	s.done = true
+	return now.Sub(s.sentAt), true
+}
+
+// overrideTimers 使用指定的定时器, 为0的字段保留Stack的值
+func (t *ClientTransaction) overrideTimers(timers *Timers) {
+	if timers == nil {
+		return
+	}
+	t.timersOverride = timers
+	t.setTimers(timers.merge(t.timers))
+}
+
+// sampleRTT 第一个应答更新目标地址的RTT
+func (t *ClientTransaction) sampleRTT() {
+	if t.sipStack.rtt == nil {
+		return
+	}
+	if rtt, ok := t.rtt.measure(t.sipStack.timerService().Now()); ok {
+		t.sipStack.rtt.update(rttKey(t.hop), rtt)
+	}
+}
@@ -39,6 +39,17 @@ func (t *SafeMap) Add(id string, transaction interface{}) {
 	t.containers[id] = transaction
 }
 
+// AddIfAbsent id不存在时添加, 存在时返回已有的元素
+func (t *SafeMap) AddIfAbsent(id string, transaction interface{}) (interface{}, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if i, b := t.containers[id]; b {
+		return i, true
+	}
+	t.containers[id] = transaction
+	return transaction, false
+}
+
 func (t *SafeMap) Iterator(callback func(key string, e interface{})) {
 	for s, i := range t.containers {
 		callback(s, i)
@@ -50,5 +61,7 @@ func (t *SafeMap) Size() int {
 }
 
 func (t *SafeMap) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	t.containers = make(map[string]interface{})
 }
@@ -0,0 +1,153 @@
+package sip
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+// 消息序列化复用预分配的缓冲区, 常用的消息头直接写入缓冲区, 不生成Value()的中间字符串
+
+const (
+	//defaultBufferSize 大多数SIP消息小于2KB
+	defaultBufferSize = 2048
+	//maxPooledBufferSize 超过该大小的缓冲区不放回池中, 避免个别大消息长期占用内存
+	maxPooledBufferSize = 64 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, defaultBufferSize))
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
+
+// valueWriter 直接把消息头的值写入缓冲区, 结果和Value()相同
+type valueWriter interface {
+	writeValue(buffer *bytes.Buffer)
+}
+
+func writeInt(buffer *bytes.Buffer, i int) {
+	var b [20]byte
+	buffer.Write(strconv.AppendInt(b[:0], int64(i), 10))
+}
+
+func writeHeaderValue(buffer *bytes.Buffer, header Header) {
+	if writer, ok := header.(valueWriter); ok {
+		writer.writeValue(buffer)
+	} else {
+		buffer.WriteString(header.Value())
+	}
+}
+
+func writeLine(buffer *bytes.Buffer, line Line) {
+	switch l := line.(type) {
+	case *RequestLine:
+		buffer.WriteString(l.Method)
+		buffer.WriteString(" ")
+		l.RequestUri.writeTo(buffer)
+		buffer.WriteString(" ")
+		buffer.WriteString(l.SipVersion)
+	case *StatusLine:
+		buffer.WriteString(SipVersion)
+		buffer.WriteString(" ")
+		writeInt(buffer, l.StatusCode)
+		buffer.WriteString(" ")
+		buffer.WriteString(l.Reason)
+	default:
+		buffer.WriteString(line.ToString())
+	}
+}
+
+func (via *Via) writeValue(buffer *bytes.Buffer) {
+	buffer.WriteString(SipVersion)
+	buffer.WriteString("/")
+	buffer.WriteString(via.transport)
+	buffer.WriteString(" ")
+	via.sendBy.writeTo(buffer)
+	if len(via.files) > 0 {
+		buffer.WriteString(";")
+		writeParams(buffer, via.files, ";")
+	}
+}
+
+func writeNameAddr(buffer *bytes.Buffer, address *Address) {
+	buffer.WriteString(address.DisPlayName)
+	buffer.WriteString("<")
+	address.Uri.writeTo(buffer)
+	buffer.WriteString(">")
+}
+
+func (f *From) writeValue(buffer *bytes.Buffer) {
+	writeNameAddr(buffer, f.Address)
+	buffer.WriteString(";tag=")
+	buffer.WriteString(f.Tag)
+}
+
+func (t *To) writeValue(buffer *bytes.Buffer) {
+	writeNameAddr(buffer, t.Address)
+	if t.Tag != "" {
+		buffer.WriteString(";tag=")
+		buffer.WriteString(t.Tag)
+	}
+}
+
+func (c *Contact) writeValue(buffer *bytes.Buffer) {
+	if c.Wildcard {
+		buffer.WriteString("*")
+		return
+	}
+
+	writeNameAddr(buffer, c.Address)
+	if c.Q != 0 {
+		var b [24]byte
+		buffer.WriteString(";q=")
+		buffer.Write(strconv.AppendFloat(b[:0], float64(c.Q), 'g', -1, 32))
+	}
+	if c.Expires != 0 {
+		buffer.WriteString(";expires=")
+		writeInt(buffer, c.Expires)
+	}
+}
+
+func (c *Contacts) writeValue(buffer *bytes.Buffer) {
+	for i, contact := range c.Contacts {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		contact.writeValue(buffer)
+	}
+}
+
+func (c *CSeq) writeValue(buffer *bytes.Buffer) {
+	writeInt(buffer, c.Number)
+	buffer.WriteString(" ")
+	buffer.WriteString(c.Method)
+}
+
+func (c *CallID) writeValue(buffer *bytes.Buffer) {
+	buffer.WriteString(string(*c))
+}
+
+func (m *MaxForwards) writeValue(buffer *bytes.Buffer) {
+	writeInt(buffer, int(*m))
+}
+
+func (c *ContentLength) writeValue(buffer *bytes.Buffer) {
+	writeInt(buffer, int(*c))
+}
+
+func (e *Expires) writeValue(buffer *bytes.Buffer) {
+	writeInt(buffer, int(*e))
+}
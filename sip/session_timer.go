@@ -0,0 +1,274 @@
+package sip
+
+import (
+	"time"
+)
+
+// RFC 4028 会话定时器
+
+const (
+	OptionTagTimer = "timer"
+	refresherUAC   = "uac"
+	refresherUAS   = "uas"
+	//defaultMinSE Min-SE不能小于90秒
+	defaultMinSE = 90
+)
+
+func getSessionExpires(msg Message) *SessionExpires {
+	for _, name := range []string{SessionExpiresName, SessionExpiresShortName} {
+		if header := msg.GetHeader(name); header != nil {
+			if se, ok := header[0].(*SessionExpires); ok {
+				return se
+			}
+		}
+	}
+	return nil
+}
+
+func getMinSE(msg Message) int {
+	if header := msg.GetHeader(MinSEName); header != nil {
+		if minSE, ok := header[0].(*MinSE); ok {
+			return int(*minSE)
+		}
+	}
+	return 0
+}
+
+func (stack *Stack) minSE() int {
+	if stack.Options.MinSE > defaultMinSE {
+		return stack.Options.MinSE
+	}
+	return defaultMinSE
+}
+
+func isSessionRefresh(method string) bool {
+	return INVITE == method || UPDATE == method
+}
+
+// addSessionTimer UAC的INVITE/UPDATE携带Session-Expires和Supported: timer.
+// 对话内的请求使用协商后的会话间隔, 本端是刷新者时refresher=uac
+func (stack *Stack) addSessionTimer(request *Request) {
+	if getSessionExpires(request) != nil {
+		return
+	}
+
+	se := &SessionExpires{Delta: stack.Options.SessionExpires}
+	if request.To().Tag != "" {
+		dialog, _ := stack.findDialog(request.GetDialogId(false))
+		if dialog == nil {
+			return
+		}
+
+		dialog.timerMutex.Lock()
+		if dialog.sessionInterval > 0 {
+			se.Delta = int(dialog.sessionInterval / time.Second)
+			se.Refresher = refresherUAS
+			if dialog.sessionRefresher {
+				se.Refresher = refresherUAC
+			}
+		}
+		dialog.timerMutex.Unlock()
+	}
+	if se.Delta <= 0 {
+		return
+	} else if se.Delta < stack.minSE() {
+		se.Delta = stack.minSE()
+	}
+
+	request.SetHeader(se)
+	if stack.Options.MinSE > defaultMinSE {
+		minSE := MinSE(stack.minSE())
+		request.SetHeader(&minSE)
+	}
+	if !hasOptionTag(request, OptionTagTimer, SupportedName, SupportedShortName, RequireName) {
+		request.AppendHeader(&StrHeader{n: SupportedName, v: OptionTagTimer})
+	}
+}
+
+// retryWithMinSE RFC 4028 7.4 初始INVITE收到422, 使用对端的Min-SE作为会话间隔,
+// 以新的事务重新发送. 不能重试返回false
+func (t *ClientTransaction) retryWithMinSE(response *Response, onSuccess OnSuccess, onFailure OnFailure) bool {
+	se := getSessionExpires(t.originalRequest)
+	minSE := getMinSE(response)
+	if !t.isInvite || t.originalRequest.To().Tag != "" || se == nil || minSE <= se.Delta {
+		return false
+	}
+
+	//同一个Call-ID的新请求, CSeq加1, 使用新的branch
+	request := t.originalRequest.shallowClone()
+	request.SetHeader(t.listeningPoint.createViaHeaderWithBranch(generateBranchId()))
+	request.SetHeader(&CSeq{Number: request.CSeq().Number + 1, Method: INVITE})
+	request.RemoveHeader(SessionExpiresShortName)
+	request.SetHeader(&SessionExpires{Delta: minSE, Refresher: se.Refresher})
+	header := MinSE(minSE)
+	request.SetHeader(&header)
+
+	next := t.listeningPoint.newClientTransaction(request, t.hop, t.targets, t.deadline())
+	next.overrideTimers(t.timersOverride)
+	t.targets = nil
+	next.SendRequest(onSuccess, onFailure)
+	return true
+}
+
+// checkSessionInterval 请求的会话间隔小于本端的Min-SE时响应422
+func (t *ServerTransaction) checkSessionInterval(request *Request) bool {
+	se := getSessionExpires(request)
+	if se == nil || se.Delta >= t.sipStack.minSE() {
+		return true
+	}
+
+	response := request.CreateResponse(SessionIntervalTooSmall)
+	if response.To().Tag == "" {
+		response.To().Tag = GenerateTag()
+	}
+	minSE := MinSE(t.sipStack.minSE())
+	response.SetHeader(&minSE)
+	t.SendResponse(response)
+	return false
+}
+
+// negotiateSessionTimer RFC 4028 9 UAS在INVITE/UPDATE的2xx中确定会话间隔和刷新者, 并启动会话定时器.
+// 对端不支持timer时由本端刷新
+func (t *ServerTransaction) negotiateSessionTimer(response *Response, dialog *Dialog) {
+	request := t.originalRequest
+	supported := hasOptionTag(request, OptionTagTimer, SupportedName, SupportedShortName, RequireName)
+
+	se := getSessionExpires(response)
+	if se == nil {
+		if requested := getSessionExpires(request); requested != nil {
+			se = &SessionExpires{Delta: requested.Delta, Refresher: requested.Refresher}
+		} else if t.sipStack.Options.SessionExpires > 0 {
+			se = &SessionExpires{Delta: t.sipStack.Options.SessionExpires}
+			if minSE := getMinSE(request); se.Delta < minSE {
+				se.Delta = minSE
+			}
+		} else {
+			dialog.startSessionTimer(0, false)
+			return
+		}
+		response.SetHeader(se)
+	}
+
+	if !supported {
+		se.Refresher = refresherUAS
+	} else if se.Refresher == "" {
+		se.Refresher = refresherUAC
+	}
+	if se.Refresher == refresherUAC && !hasOptionTag(response, OptionTagTimer, RequireName) {
+		response.AppendHeader(&StrHeader{n: RequireName, v: OptionTagTimer})
+	}
+
+	dialog.startSessionTimer(time.Duration(se.Delta)*time.Second, se.Refresher == refresherUAS)
+}
+
+// updateSessionTimer UAC收到INVITE/UPDATE的2xx, 2xx没有Session-Expires时不使用会话定时器
+func (d *Dialog) updateSessionTimer(response *Response) {
+	if se := getSessionExpires(response); se != nil {
+		d.startSessionTimer(time.Duration(se.Delta)*time.Second, se.Refresher != refresherUAS)
+	} else {
+		d.startSessionTimer(0, false)
+	}
+}
+
+// startSessionTimer 刷新者在会话间隔的一半时刷新会话,
+// 另一方在会话过期前min(32, 会话间隔/3)秒没有收到刷新时结束会话
+func (d *Dialog) startSessionTimer(interval time.Duration, refresher bool) {
+	d.timerMutex.Lock()
+	defer d.timerMutex.Unlock()
+	if d.sessionTimer != nil {
+		d.sessionTimer.Stop()
+		d.sessionTimer = nil
+	}
+
+	d.sessionInterval = interval
+	d.sessionRefresher = refresher
+	if interval <= 0 || d.state == dialogStateTerminated {
+		return
+	}
+
+	if refresher {
+		d.sessionTimer = d.sipStack.timerService().AfterFunc(interval/2, d.refreshSession)
+	} else {
+		grace := interval / 3
+		if grace > 32*time.Second {
+			grace = 32 * time.Second
+		}
+		d.sessionTimer = d.sipStack.timerService().AfterFunc(interval-grace, d.onSessionExpired)
+	}
+}
+
+func (d *Dialog) stopSessionTimer() {
+	d.timerMutex.Lock()
+	defer d.timerMutex.Unlock()
+	if d.sessionTimer != nil {
+		d.sessionTimer.Stop()
+		d.sessionTimer = nil
+	}
+}
+
+// refreshSession 对端允许UPDATE时使用不带会话描述的UPDATE, 否则使用携带上一次会话描述的re-INVITE.
+// 刷新失败时在会话过期后结束会话, 超时或者408/481立即结束
+func (d *Dialog) refreshSession() {
+	if d.state == dialogStateTerminated {
+		return
+	}
+
+	var event *ResponseEvent
+	var err error
+	if d.remoteUpdate {
+		event, err = d.SendUpdate(nil, nil)
+	} else {
+		d.timerMutex.Lock()
+		contentType, content := d.localContentType, d.localContent
+		d.timerMutex.Unlock()
+		event, err = d.SendReInvite(contentType, content)
+	}
+
+	if err == nil && event.Response.GetStatusCode()/100 == 2 {
+		return
+	} else if err == nil && (event.Response.GetStatusCode() == RequestTimeout || event.Response.GetStatusCode() == CallTransactionDoesNotExist) {
+		d.onSessionExpired()
+		return
+	} else if uacErr, ok := err.(*UACError); ok && (uacErr.Code() == ErrorTransactionTimeout || uacErr.Code() == ErrorRequestTimeout) {
+		//RFC 4028 10 刷新请求超时, 和408一样立即结束会话
+		d.onSessionExpired()
+		return
+	}
+
+	d.timerMutex.Lock()
+	defer d.timerMutex.Unlock()
+	if d.sessionTimer != nil {
+		d.sessionTimer.Stop()
+	}
+	if d.state != dialogStateTerminated && d.sessionInterval > 0 {
+		d.sessionTimer = d.sipStack.timerService().AfterFunc(d.sessionInterval/2, d.onSessionExpired)
+	}
+}
+
+// onSessionExpired 会话过期, 发送BYE删除对话并通知TU
+func (d *Dialog) onSessionExpired() {
+	if d.state == dialogStateTerminated {
+		return
+	}
+
+	if bye, err := d.CreateRequest(BYE); err == nil {
+		if transaction, err := d.listeningPoint.NewClientTransaction(bye); err == nil {
+			go transaction.Execute()
+		}
+	}
+	d.Delete()
+
+	if listener, ok := d.sipStack.EventListener.(SessionListener); ok {
+		go listener.OnSessionExpired(d)
+	}
+}
+
+// setLocalContent 记录本端最后一次发送的会话描述
+func (d *Dialog) setLocalContent(contentType *ContentType, content []byte) {
+	if contentType != nil && len(content) > 0 {
+		d.timerMutex.Lock()
+		d.localContentType = contentType
+		d.localContent = content
+		d.timerMutex.Unlock()
+	}
+}
@@ -1,8 +1,8 @@
 package sip
 
 import (
-	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -10,6 +10,27 @@ type EventListener interface {
 	OnRequest(*RequestEvent)
 }
 
+// CancelListener EventListener实现该接口时, 收到CANCEL后回调OnCancel
+type CancelListener interface {
+	OnCancel(*CancelEvent)
+}
+
+// AckListener EventListener实现该接口时, 2xx的ACK通过OnAck通知, 否则通过OnRequest通知
+type AckListener interface {
+	OnAck(*AckEvent)
+}
+
+// SessionListener EventListener实现该接口时, 会话定时器超时后回调OnSessionExpired, 此时已经发送BYE并删除对话
+type SessionListener interface {
+	OnSessionExpired(*Dialog)
+}
+
+// ForkListener EventListener实现该接口时, INVITE分叉后第一个2xx之外的2xx通过OnForkedResponse通知,
+// 否则自动发送ACK和BYE结束多余的对话
+type ForkListener interface {
+	OnForkedResponse(*ResponseEvent)
+}
+
 // EventInterceptor You can use it for stateless proxy/**
 type EventInterceptor interface {
 	OnRequest(*Request)
@@ -33,20 +54,104 @@ type Options struct {
 	RequestTimeout time.Duration
 
 	UserAgent string
+
+	/**
+	RFC 3261 18.1.1 UDP请求超过该字节数, 并且存在TCP监听点时, 使用TCP发送. 默认1300, 小于0不切换
+	*/
+	UDPThreshold int
+
+	/**
+	出站代理, 所有请求都发往该代理. URI包含lr参数时作为第一个Route插入请求, 否则只替换下一跳, 不修改请求.
+	可以被ListeningPoint.OutboundProxy和Request.SetOutboundProxy覆盖
+	*/
+	OutboundProxy *SipUri
+
+	/**
+	RFC 3262 UAC的INVITE携带Supported: 100rel, UAS对支持100rel的INVITE可靠地发送临时应答.
+	不开启时, 请求包含Require: 100rel或者应答包含Require: 100rel仍然可靠地发送
+	*/
+	Enable100rel bool
+
+	/**
+	RFC 4028 会话定时器的会话间隔, 单位秒. 大于0时UAC的INVITE携带Session-Expires, UAS对没有请求会话定时器的INVITE在2xx中启用.
+	等于0时只响应对端的请求
+	*/
+	SessionExpires int
+
+	/**
+	RFC 4028 允许的最小会话间隔, 单位秒. 默认90, 小于90时使用90
+	*/
+	MinSE int
+
+	/**
+	事务定时器T1/T2/T4/TimerD, 为0的字段使用RFC 3261的默认值. 可以被NewClientTransactionWithTimeout的timers覆盖
+	*/
+	Timers
+
+	/**
+	根据每个目标地址的RTT估算T1(RFC 6298), 代替固定的T1
+	*/
+	EstimateT1 bool
+
+	/**
+	RFC 3261 17.2.1 INVITE服务器事务在该时间内没有收到TU的临时应答时, 自动发送100 Trying. 默认200ms, 小于0不发送
+	*/
+	TryingDelay time.Duration
+
+	/**
+	RFC 3261 8.2.2.2 不检测合并请求. 默认对From tag、Call-ID、CSeq和进行中的事务相同但是branch不同的请求响应482
+	*/
+	DisableMergedRequestCheck bool
+
+	/**
+	不检查Max-Forwards. 默认对Max-Forwards为0的请求(OPTIONS除外)响应483
+	*/
+	DisableMaxForwardsCheck bool
+
+	/**
+	延迟解析收到的消息. 只解析事务层和路由需要的Via、From、To、Call-ID、CSeq、Contact、Route等消息头, 其他消息头在第一次GetHeader时解析.
+	延迟解析的消息头格式错误时不会拒绝消息, GetHeader的结果中不包含该消息头, 转发时保留原始内容
+	*/
+	LazyParsing bool
 }
 
+const (
+	DefaultUDPThreshold = 1300
+	DefaultTryingDelay  = 200 * time.Millisecond
+)
+
 type Stack struct {
 	Listens []*ListeningPoint
-	//TLS     *ListeningPoint
-	//WS      *ListeningPoint
 
 	EventListener    EventListener
 	EventInterceptor EventInterceptor
 	Options          Options
+	//Resolver RFC 3263 定位下一跳使用的DNS查询, 为空使用DefaultResolver
+	Resolver Resolver
+	//TimerService 事务、对话和自动刷新使用的定时器, 为空时Start创建分层时间轮
+	TimerService TimerService
+	ownWheel     *TimingWheel
+	//rtt Options.EstimateT1开启时每个目标地址的RTT
+	rtt *rttEstimator
 
 	clientTransactions *SafeMap
 	serverTransactions *SafeMap
 	dialogs            *SafeMap
+	//mergedRequests 没有To tag的请求到服务器事务ID, 用于检测合并请求
+	mergedRequests *SafeMap
+	//done Stop时关闭. TimingWheel.Stop丢弃未到期的定时器, 等待定时器的协程同时等待done
+	done      chan struct{}
+	doneMutex sync.Mutex
+}
+
+// stopped 返回Stop时关闭的通道
+func (stack *Stack) stopped() <-chan struct{} {
+	stack.doneMutex.Lock()
+	defer stack.doneMutex.Unlock()
+	if stack.done == nil {
+		stack.done = make(chan struct{})
+	}
+	return stack.done
 }
 
 func (stack *Stack) Stop() {
@@ -67,11 +172,48 @@ func (stack *Stack) Stop() {
 	if stack.dialogs != nil {
 		stack.dialogs.Clear()
 	}
+	if stack.mergedRequests != nil {
+		stack.mergedRequests.Clear()
+	}
+	if stack.ownWheel != nil {
+		stack.ownWheel.Stop()
+		stack.ownWheel = nil
+		stack.TimerService = nil
+	}
+
+	stack.doneMutex.Lock()
+	if stack.done == nil {
+		stack.done = make(chan struct{})
+	}
+	select {
+	case <-stack.done:
+	default:
+		close(stack.done)
+	}
+	stack.doneMutex.Unlock()
 }
 
 func (stack *Stack) Start() error {
+	if stack.Options.UDPThreshold == 0 {
+		stack.Options.UDPThreshold = DefaultUDPThreshold
+	}
+	stack.Options.Timers = stack.Options.Timers.merge(DefaultTimers)
+	if stack.Options.TryingDelay == 0 {
+		stack.Options.TryingDelay = DefaultTryingDelay
+	}
+	stack.doneMutex.Lock()
+	stack.done = make(chan struct{})
+	stack.doneMutex.Unlock()
+	if stack.TimerService == nil {
+		stack.ownWheel = NewTimingWheel(DefaultWheelTick, DefaultWheelSlots)
+		stack.TimerService = stack.ownWheel
+	}
+	if stack.Options.EstimateT1 {
+		stack.rtt = &rttEstimator{entries: make(map[string]*rttEntry)}
+	}
+
 	for _, listen := range stack.Listens {
-		server, err := createServer(listen.Transport, fmt.Sprintf("%s:%d", listen.IP, listen.Port))
+		server, err := createServer(listen.Transport, joinHostPort(listen.IP, listen.Port), listen.TLSConfig)
 		if err != nil {
 			stack.Stop()
 			return err
@@ -79,15 +221,23 @@ func (stack *Stack) Start() error {
 
 		listen.sipStack = stack
 		listen.transport = server
-		if TCP == listen.Transport {
+		if isReliable(listen.Transport) {
 			listen.tcpSessions = CreateSafeMap(10)
 		}
+		if transport := strings.ToUpper(listen.Transport); transport == WS || transport == WSS {
+			listen.wsAliases = CreateSafeMap(10)
+		}
 		server.setHandler(listen)
 	}
 
+	if stack.Resolver == nil {
+		stack.Resolver = &DefaultResolver{}
+	}
+
 	stack.clientTransactions = CreateSafeMap(1024)
 	stack.serverTransactions = CreateSafeMap(1024)
 	stack.dialogs = CreateSafeMap(1024)
+	stack.mergedRequests = CreateSafeMap(1024)
 
 	return nil
 }
@@ -119,6 +269,22 @@ func (stack *Stack) GetListeningPoint(transport string) *ListeningPoint {
 	return nil
 }
 
+// findListeningPoint 查找指定传输方式的监听点, 优先使用相同IP的监听点
+func (stack *Stack) findListeningPoint(transport, ip string) *ListeningPoint {
+	var find *ListeningPoint
+	for _, listen := range stack.Listens {
+		if strings.ToUpper(listen.Transport) != transport {
+			continue
+		} else if listen.IP == ip {
+			return listen
+		} else if find == nil {
+			find = listen
+		}
+	}
+
+	return find
+}
+
 func (stack *Stack) findDialog(id string) (*Dialog, bool) {
 	if find, b := stack.dialogs.Find(id); b {
 		return find.(*Dialog), true
@@ -0,0 +1,122 @@
+package sip
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	//单个消息头的最大长度, 超过后认为流已经错乱
+	maxStreamHeaderSize = 64 * 1024
+	//单个消息体的最大长度
+	maxStreamBodySize = 1024 * 1024
+)
+
+var headerTerminator = []byte("\r\n\r\n")
+
+// streamFramer 面向流的传输层(TCP/TLS)的消息重组器, 每个连接一个.
+// 累积收到的字节, 根据消息头结束符和Content-Length切分出完整的消息, 按顺序回调.
+type streamFramer struct {
+	buffer []byte
+	//offset buffer中未处理数据的起始位置, 切分出的消息只移动offset, 需要扩容时才整理buffer
+	offset int
+}
+
+func (s *streamFramer) pending() []byte {
+	return s.buffer[s.offset:]
+}
+
+// skipKeepAlive 丢弃消息之间的CRLF保活包(RFC 5626 CRLF ping)
+func (s *streamFramer) skipKeepAlive() {
+	pending := s.pending()
+	i := 0
+	for i < len(pending) && (pending[i] == '\r' || pending[i] == '\n') {
+		i++
+	}
+	if i > 0 {
+		s.consume(i)
+	}
+}
+
+func (s *streamFramer) consume(n int) {
+	s.offset += n
+	if s.offset == len(s.buffer) {
+		s.buffer = s.buffer[:0]
+		s.offset = 0
+	}
+}
+
+// append 容量不足时先把未处理的数据移到buffer开头
+func (s *streamFramer) append(data []byte) {
+	if s.offset > 0 && len(s.buffer)+len(data) > cap(s.buffer) {
+		remain := copy(s.buffer, s.buffer[s.offset:])
+		s.buffer = s.buffer[:remain]
+		s.offset = 0
+	}
+	s.buffer = append(s.buffer, data...)
+}
+
+// parseContentLength 在流上Content-Length是必须的
+func parseContentLength(header []byte) (int, error) {
+	for _, line := range strings.Split(string(header), "\r\n")[1:] {
+		index := strings.Index(line, ":")
+		if index < 0 {
+			continue
+		}
+
+		name := strings.TrimSpace(line[:index])
+		if !strings.EqualFold(name, ContentLengthName) && !strings.EqualFold(name, ContentLengthShortName) {
+			continue
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(line[index+1:]))
+		if err != nil {
+			return 0, fmt.Errorf("bad Content-Length %s", line)
+		} else if length < 0 || length > maxStreamBodySize {
+			return 0, fmt.Errorf("invalid Content-Length %d", length)
+		}
+		return length, nil
+	}
+
+	return 0, fmt.Errorf("the Content-Length header is mandatory for stream-oriented transports")
+}
+
+// feed 写入收到的数据, 每切分出一个完整的消息回调一次handler.
+// 返回错误说明流已经无法继续解析, 应该关闭连接
+func (s *streamFramer) feed(data []byte, handler func(msg []byte)) error {
+	s.append(data)
+
+	for {
+		s.skipKeepAlive()
+		pending := s.pending()
+		if len(pending) == 0 {
+			return nil
+		}
+
+		end := bytes.Index(pending, headerTerminator)
+		if end < 0 {
+			if len(pending) > maxStreamHeaderSize {
+				return fmt.Errorf("the message header exceeds %d bytes", maxStreamHeaderSize)
+			}
+			return nil
+		}
+
+		contentLength, err := parseContentLength(pending[:end])
+		if err != nil {
+			return err
+		}
+
+		total := end + len(headerTerminator) + contentLength
+		if len(pending) < total {
+			return nil
+		}
+
+		//解析后的消息会引用body, 不能和buffer共享内存
+		msg := make([]byte, total)
+		copy(msg, pending[:total])
+		s.consume(total)
+		handler(msg)
+	}
+}
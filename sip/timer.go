@@ -19,12 +19,12 @@ type Timer interface {
 }
 
 type timer struct {
-	t        *time.Timer
-	interval int
+	t        TimerHandle
+	interval time.Duration
 }
 
-func (t *timer) start(task func()) {
-	t.t = time.AfterFunc(time.Duration(t.interval)*time.Millisecond, task)
+func (t *timer) start(service TimerService, task func()) {
+	t.t = service.AfterFunc(t.interval, task)
 }
 
 func (t *timer) stop() {
@@ -32,16 +32,16 @@ func (t *timer) stop() {
 }
 
 func (t *timer) reset() {
-	t.t.Reset(time.Duration(t.interval) * time.Millisecond)
+	t.t.Reset(t.interval)
 }
 
 type timerA struct {
 	timer
 }
 
-func (t *timerA) start(task func() bool) {
-	t.interval = T1
-	t.timer.start(func() {
+func (t *timerA) start(service TimerService, timers *Timers, task func() bool) {
+	t.interval = timers.T1
+	t.timer.start(service, func() {
 		if !task() {
 			t.interval = t.interval * 2
 			t.timer.reset()
@@ -53,9 +53,9 @@ type timerB struct {
 	timer
 }
 
-func (t *timerB) start(task func()) {
-	t.interval = 64 * T1
-	t.timer.start(func() {
+func (t *timerB) start(service TimerService, timers *Timers, task func()) {
+	t.interval = 64 * timers.T1
+	t.timer.start(service, func() {
 		task()
 	})
 }
@@ -64,23 +64,25 @@ type timerD struct {
 	timer
 }
 
-func (t *timerD) start(task func()) {
-	t.interval = 32 * 1000
-	t.timer.start(func() {
+func (t *timerD) start(service TimerService, timers *Timers, task func()) {
+	t.interval = timers.TimerD
+	t.timer.start(service, func() {
 		task()
 	})
 }
 
 type timerE struct {
 	timer
+	max time.Duration
 }
 
-func (t *timerE) start(task func() bool) {
-	t.interval = T1
-	t.timer.start(func() {
+func (t *timerE) start(service TimerService, timers *Timers, task func() bool) {
+	t.interval = timers.T1
+	t.max = timers.T2
+	t.timer.start(service, func() {
 		if !task() {
-			if t.interval != T2 {
-				t.interval = min(t.interval*2, T2)
+			if t.interval != t.max {
+				t.interval = time.Duration(min(int(t.interval*2), int(t.max)))
 			}
 			t.timer.reset()
 		}
@@ -88,16 +90,16 @@ func (t *timerE) start(task func() bool) {
 }
 
 func (t *timerE) setToT2() {
-	t.interval = T2
+	t.interval = t.max
 }
 
 type timerF struct {
 	timer
 }
 
-func (t *timerF) start(task func()) {
-	t.interval = 64 * T1
-	t.timer.start(func() {
+func (t *timerF) start(service TimerService, timers *Timers, task func()) {
+	t.interval = 64 * timers.T1
+	t.timer.start(service, func() {
 		task()
 	})
 }
@@ -106,9 +108,9 @@ type timerK struct {
 	timer
 }
 
-func (t *timerK) start(task func()) {
-	t.interval = T4
-	t.timer.start(func() {
+func (t *timerK) start(service TimerService, timers *Timers, task func()) {
+	t.interval = timers.T4
+	t.timer.start(service, func() {
 		task()
 	})
 }
@@ -131,3 +133,13 @@ type timerI struct {
 type timerJ struct {
 	timerF
 }
+
+// timerL RFC 6026 Accepted状态持续64*T1
+type timerL struct {
+	timerF
+}
+
+// timerM RFC 6026 INVITE客户端事务的Accepted状态持续64*T1
+type timerM struct {
+	timerF
+}
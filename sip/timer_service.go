@@ -0,0 +1,332 @@
+package sip
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// TimerService 事务状态机、对话和自动刷新使用的定时器服务. 默认使用分层时间轮,
+// 测试时可以替换为FakeClock
+type TimerService interface {
+	AfterFunc(d time.Duration, task func()) TimerHandle
+	Now() time.Time
+}
+
+// TimerHandle *time.Timer 实现了该接口
+type TimerHandle interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// goTimerService 每个定时器一个time.Timer, 用于没有Start的Stack
+type goTimerService struct{}
+
+func (goTimerService) AfterFunc(d time.Duration, task func()) TimerHandle {
+	return time.AfterFunc(d, task)
+}
+
+func (goTimerService) Now() time.Time {
+	return time.Now()
+}
+
+func (stack *Stack) timerService() TimerService {
+	if stack.TimerService != nil {
+		return stack.TimerService
+	}
+	return goTimerService{}
+}
+
+const (
+	DefaultWheelTick  = 10 * time.Millisecond
+	DefaultWheelSlots = 256
+	//wheelLevels 10ms*256^4 足够覆盖所有SIP定时器
+	wheelLevels = 4
+)
+
+// TimingWheel 分层时间轮. 第i层的每个槽对应tick*slots^i, 到期前逐层下沉到第0层.
+// 所有定时器共用一个time.Ticker, 到期的任务在新的协程中执行
+type TimingWheel struct {
+	tick    time.Duration
+	slots   uint64
+	mutex   sync.Mutex
+	levels  [wheelLevels][]map[*wheelTimer]struct{}
+	current uint64 //已经走过的tick数
+	start   time.Time
+	ticker  *time.Ticker
+	done    chan struct{}
+	once    sync.Once
+}
+
+type wheelTimer struct {
+	wheel  *TimingWheel
+	task   func()
+	expire uint64
+	bucket map[*wheelTimer]struct{} //为空表示不在时间轮中
+}
+
+func newTimingWheel(tick time.Duration, slots int) *TimingWheel {
+	if tick <= 0 {
+		tick = DefaultWheelTick
+	}
+	if slots <= 1 {
+		slots = DefaultWheelSlots
+	}
+
+	w := &TimingWheel{tick: tick, slots: uint64(slots), start: time.Now(), done: make(chan struct{})}
+	for i := range w.levels {
+		w.levels[i] = make([]map[*wheelTimer]struct{}, slots)
+		for j := range w.levels[i] {
+			w.levels[i][j] = make(map[*wheelTimer]struct{})
+		}
+	}
+	return w
+}
+
+// NewTimingWheel tick是定时器的精度, slots是每层的槽数
+func NewTimingWheel(tick time.Duration, slots int) *TimingWheel {
+	w := newTimingWheel(tick, slots)
+	w.ticker = time.NewTicker(w.tick)
+	go w.run()
+	return w
+}
+
+func (w *TimingWheel) run() {
+	for {
+		select {
+		case now := <-w.ticker.C:
+			w.advanceTo(uint64(now.Sub(w.start) / w.tick))
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Stop 停止时间轮, 未到期的定时器不再执行
+func (w *TimingWheel) Stop() {
+	w.once.Do(func() {
+		if w.ticker != nil {
+			w.ticker.Stop()
+		}
+		close(w.done)
+	})
+}
+
+func (w *TimingWheel) Now() time.Time {
+	return time.Now()
+}
+
+func (w *TimingWheel) AfterFunc(d time.Duration, task func()) TimerHandle {
+	t := &wheelTimer{wheel: w, task: task}
+	w.mutex.Lock()
+	w.schedule(t, d)
+	w.mutex.Unlock()
+	return t
+}
+
+// schedule 至少一个tick之后到期
+func (w *TimingWheel) schedule(t *wheelTimer, d time.Duration) {
+	ticks := uint64((d + w.tick - 1) / w.tick)
+	if d <= 0 || ticks == 0 {
+		ticks = 1
+	}
+	t.expire = w.current + ticks
+	w.add(t)
+}
+
+// add 根据剩余的tick数放入对应的层, 超过最高层范围的放在最高层, 下沉时重新计算
+func (w *TimingWheel) add(t *wheelTimer) {
+	delta := uint64(0)
+	if t.expire > w.current {
+		delta = t.expire - w.current
+	}
+
+	level, span := 0, uint64(1)
+	for level < wheelLevels-1 && delta >= span*w.slots {
+		level++
+		span *= w.slots
+	}
+
+	index := t.expire / span
+	if delta >= span*w.slots {
+		//超过最高层的范围, 放在最后一个会被下沉的槽
+		index = w.current/span + w.slots - 1
+	}
+	t.bucket = w.levels[level][index%w.slots]
+	t.bucket[t] = struct{}{}
+}
+
+func (w *TimingWheel) remove(t *wheelTimer) bool {
+	if t.bucket == nil {
+		return false
+	}
+	delete(t.bucket, t)
+	t.bucket = nil
+	return true
+}
+
+// advanceTo 逐个tick前进到target, 先把高层到达的槽下沉, 再执行第0层到期的定时器
+func (w *TimingWheel) advanceTo(target uint64) {
+	w.mutex.Lock()
+	var expired []func()
+	for w.current < target {
+		w.current++
+		//从高层到低层下沉, 避免下沉到已经处理过的槽
+		top, span := 0, uint64(1)
+		for top < wheelLevels-1 && w.current%(span*w.slots) == 0 {
+			top++
+			span *= w.slots
+		}
+		for level := top; level > 0; level-- {
+			bucket := w.levels[level][(w.current/span)%w.slots]
+			for t := range bucket {
+				delete(bucket, t)
+				w.add(t)
+			}
+			span /= w.slots
+		}
+
+		bucket := w.levels[0][w.current%w.slots]
+		for t := range bucket {
+			if t.expire <= w.current {
+				delete(bucket, t)
+				t.bucket = nil
+				expired = append(expired, t.task)
+			}
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, task := range expired {
+		go task()
+	}
+}
+
+func (t *wheelTimer) Stop() bool {
+	t.wheel.mutex.Lock()
+	defer t.wheel.mutex.Unlock()
+	return t.wheel.remove(t)
+}
+
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	t.wheel.mutex.Lock()
+	defer t.wheel.mutex.Unlock()
+	active := t.wheel.remove(t)
+	t.wheel.schedule(t, d)
+	return active
+}
+
+// FakeClock 手动推进的时钟, 到期的任务在Advance中按照到期时间依次同步执行
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers fakeTimerHeap
+	seq    uint64
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	task  func()
+	when  time.Time
+	seq   uint64 //到期时间相同的按照创建顺序执行
+	index int    //在堆中的位置, -1表示已经停止或者执行
+}
+
+type fakeTimerHeap []*fakeTimer
+
+func (h fakeTimerHeap) Len() int { return len(h) }
+
+func (h fakeTimerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h fakeTimerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fakeTimerHeap) Push(x interface{}) {
+	t := x.(*fakeTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *fakeTimerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, task func()) TimerHandle {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, task: task, index: -1}
+	c.schedule(t, d)
+	return t
+}
+
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	c.seq++
+	t.when = c.now.Add(d)
+	t.seq = c.seq
+	heap.Push(&c.timers, t)
+}
+
+// Advance 时钟前进d, 期间到期的任务(包括任务中新建或者重置的定时器)依次执行
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].when.After(target) {
+		t := heap.Pop(&c.timers).(*fakeTimer)
+		c.now = t.when
+		c.mutex.Unlock()
+		t.task()
+		c.mutex.Lock()
+	}
+	c.now = target
+	c.mutex.Unlock()
+}
+
+// Pending 还没有到期的定时器数量
+func (c *FakeClock) Pending() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&t.clock.timers, t.index)
+	}
+	t.clock.schedule(t, d)
+	return active
+}
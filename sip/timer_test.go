@@ -1,53 +1,329 @@
 package sip
 
 import (
+	"io"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// fakeTransaction 记录状态机的回调
+type fakeTransaction struct {
+	clock        *FakeClock
+	start        time.Time
+	retransmits  []time.Duration
+	timeoutAt    time.Duration
+	terminatedAt time.Duration
+}
+
+func (f *fakeTransaction) retransmit() bool {
+	f.retransmits = append(f.retransmits, f.clock.Now().Sub(f.start))
+	return false
+}
+
+func (f *fakeTransaction) timeout() {
+	f.timeoutAt = f.clock.Now().Sub(f.start)
+}
+
+func (f *fakeTransaction) terminated() {
+	f.terminatedAt = f.clock.Now().Sub(f.start)
+}
+
+func (f *fakeTransaction) ioException(error) {}
+
+func (f *fakeTransaction) GetOriginalRequest() *Request {
+	return nil
+}
+
+func (f *fakeTransaction) GetDialog() *Dialog {
+	return nil
+}
+
+func newFakeStateMachine(stateMachine IStateMachine, timers *Timers) *fakeTransaction {
+	clock := NewFakeClock(time.Unix(0, 0))
+	transaction := &fakeTransaction{clock: clock, start: clock.Now()}
+	stateMachine.setTransaction(transaction)
+	stateMachine.setTimers(timers)
+	stateMachine.setTimerService(clock)
+	return transaction
+}
+
 func TestTimer(t *testing.T) {
-	//a := timerA{}
-	//println("timer A begin :", time.Now().UnixNano()/1e6)
-	//a.start(func() bool {
-	//	println("timer A exec :", time.Now().UnixNano()/1e6)
-	//	return false
-	//})
-
-	//b := timerB{}
-	//println("timer B begin :",time.Now().UnixNano()/1e6)
-	//b.start(func() bool {
-	//	println("timer B exec :",time.Now().UnixNano()/1e6)
-	//	return false
-	//})
-
-	//d := timerD{}
-	//println("timer D begin :",time.Now().UnixNano()/1e6)
-	//d.start(func() bool {
-	//	println("timer D exec :",time.Now().UnixNano()/1e6)
-	//	return false
-	//})
-
-	//e := timerE{}
-	//println("timer E begin :",time.Now().UnixNano()/1e6)
-	//e.start(func() bool {
-	//	println("timer E exec :",time.Now().UnixNano()/1e6)
-	//	return false
-	//})
-
-	//f := timerF{}
-	//println("timer F begin :",time.Now().UnixNano()/1e6)
-	//f.start(func() bool {
-	//	println("timer F exec :",time.Now().UnixNano()/1e6)
-	//	return false
-	//})
-	//
-	//k := timerK{}
-	//println("timer K begin :",time.Now().UnixNano()/1e6)
-	//k.start(func() bool {
-	//	println("timer K exec :",time.Now().UnixNano()/1e6)
-	//	return false
-	//})
-
-	for {
-		select {}
+	//Timer A从T1开始翻倍, Timer B 64*T1超时
+	stateMachine := &InviteClientStateMachine{}
+	transaction := newFakeStateMachine(stateMachine, &DefaultTimers)
+	stateMachine.start()
+	transaction.clock.Advance(time.Minute)
+
+	expected := []time.Duration{500, 1500, 3500, 7500, 15500, 31500}
+	if len(transaction.retransmits) != len(expected) {
+		t.Fatalf("bad retransmits %v", transaction.retransmits)
+	}
+	for i, retransmit := range transaction.retransmits {
+		if retransmit != expected[i]*time.Millisecond {
+			t.Fatalf("bad retransmits %v", transaction.retransmits)
+		}
+	}
+	if transaction.timeoutAt != 32*time.Second {
+		t.Fatalf("timer B should fire at 64*T1, got %s", transaction.timeoutAt)
+	}
+}
+
+func TestUnInviteClientTimeout(t *testing.T) {
+	//Timer E从T1翻倍到T2, Timer F 64*T1超时
+	stateMachine := &UnInviteClientStateMachine{}
+	transaction := newFakeStateMachine(stateMachine, &Timers{T1: 100 * time.Millisecond, T2: 400 * time.Millisecond, T4: time.Second})
+	stateMachine.start()
+	transaction.clock.Advance(6300 * time.Millisecond)
+	if transaction.timeoutAt != 0 {
+		t.Fatalf("the transaction should not time out before 64*T1")
+	}
+
+	transaction.clock.Advance(100 * time.Millisecond)
+	if transaction.timeoutAt != 6400*time.Millisecond {
+		t.Fatalf("timer F should fire at 64*T1, got %s", transaction.timeoutAt)
+	}
+	//100 300 700 1100 ... 6300
+	if len(transaction.retransmits) != 17 || transaction.retransmits[3]-transaction.retransmits[2] != 400*time.Millisecond {
+		t.Fatalf("bad retransmits %v", transaction.retransmits)
+	}
+}
+
+func TestUnInviteClientCompleted(t *testing.T) {
+	//收到最终应答后停止重传, Timer K T4后终止
+	stateMachine := &UnInviteClientStateMachine{}
+	transaction := newFakeStateMachine(stateMachine, &DefaultTimers)
+	stateMachine.start()
+	transaction.clock.Advance(time.Second)
+	stateMachine.setState(unInviteClientStateCompleted)
+	transaction.clock.Advance(time.Minute)
+
+	if len(transaction.retransmits) != 1 || transaction.timeoutAt != 0 {
+		t.Fatalf("the timers should be stopped, retransmits %v", transaction.retransmits)
+	}
+	if transaction.terminatedAt != 6*time.Second {
+		t.Fatalf("timer K should fire at T4, got %s", transaction.terminatedAt)
+	}
+	if transaction.clock.Pending() != 0 {
+		t.Fatalf("all timers should be fired or stopped")
+	}
+}
+
+func TestTimingWheel(t *testing.T) {
+	wheel := newTimingWheel(10*time.Millisecond, 8)
+	fired := make(chan int, 8)
+	for _, i := range []int{1, 5, 9, 70, 600, 5000} {
+		i := i
+		wheel.AfterFunc(time.Duration(i)*10*time.Millisecond, func() {
+			fired <- i
+		})
+	}
+	stopped := wheel.AfterFunc(100*time.Millisecond, func() {
+		fired <- -1
+	})
+	reset := wheel.AfterFunc(20*time.Millisecond, func() {
+		fired <- 3
+	})
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("the timer should be stopped once")
+	}
+	reset.Reset(30 * time.Millisecond)
+
+	for _, expected := range []int{1, 3, 5, 9, 70, 600, 5000} {
+		wheel.advanceTo(uint64(expected) - 1)
+		select {
+		case i := <-fired:
+			t.Fatalf("the timer %d fired before %d", i, expected)
+		default:
+		}
+
+		wheel.advanceTo(uint64(expected))
+		select {
+		case i := <-fired:
+			if i != expected {
+				t.Fatalf("the timer %d fired at %d", i, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the timer %d did not fire", expected)
+		}
+	}
+}
+
+func TestMergeTimers(t *testing.T) {
+	timers := (&Timers{T1: 100 * time.Millisecond}).merge(DefaultTimers)
+	if timers.T1 != 100*time.Millisecond || timers.T2 != DefaultTimers.T2 || timers.T4 != DefaultTimers.T4 || timers.TimerD != 32*time.Second {
+		t.Fatalf("bad timers %+v", timers)
+	}
+
+	f := &timerF{}
+	f.start(NewFakeClock(time.Now()), &timers, func() {})
+	defer f.stop()
+	if f.interval != 64*100*time.Millisecond {
+		t.Fatalf("timer F should be 64*T1, got %s", f.interval)
+	}
+}
+
+func TestEstimateT1(t *testing.T) {
+	stack := &Stack{Options: Options{EstimateT1: true}}
+	stack.rtt = &rttEstimator{entries: make(map[string]*rttEntry)}
+	hop := &Hop{IP: "192.168.1.1", Port: 5060, Transport: UDP}
+	if timers := stack.transactionTimers(hop); timers.T1 != DefaultTimers.T1 {
+		t.Fatalf("the default T1 should be used without samples, got %s", timers.T1)
+	}
+
+	for i := 0; i < 20; i++ {
+		stack.rtt.update(rttKey(hop), 40*time.Millisecond)
+	}
+	if timers := stack.transactionTimers(hop); timers.T1 != minEstimatedT1 {
+		t.Fatalf("the estimated T1 should not be less than %s, got %s", minEstimatedT1, timers.T1)
+	}
+
+	//卫星链路
+	stack.rtt.update(rttKey(hop), 800*time.Millisecond)
+	if timers := stack.transactionTimers(hop); timers.T1 <= DefaultTimers.T1 || timers.T1 > DefaultTimers.T2 {
+		t.Fatalf("bad estimated T1 %s", timers.T1)
+	}
+
+	//发生重传的事务不采样
+	sample := &rttSample{}
+	sample.sent(time.Now())
+	sample.retransmit()
+	if _, ok := sample.measure(time.Now()); ok {
+		t.Fatalf("the retransmitted request should not be sampled")
+	}
+}
+
+// recordConn 记录发送的消息, 也可以作为UDP监听点的socket
+type recordConn struct {
+	net.Conn
+	mutex    sync.Mutex
+	messages []string
+	//destinations 作为UDP socket时每个消息的目的地址
+	destinations []string
+	//written 不为空时通知发送的消息, 缓冲区满时丢弃
+	written chan string
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.messages = append(c.messages, string(b))
+	c.mutex.Unlock()
+	if c.written != nil {
+		select {
+		case c.written <- string(b):
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (c *recordConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	c.destinations = append(c.destinations, addr.String())
+	c.mutex.Unlock()
+	return c.Write(b)
+}
+
+func (c *recordConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, io.EOF
+}
+
+func (c *recordConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.168.1.108"), Port: 5060}
+}
+
+// sent 已经发送的消息
+func (c *recordConn) sent() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.messages...)
+}
+
+func (c *recordConn) sentTo() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.destinations...)
+}
+
+func (c *recordConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5060}
+}
+
+func newTryingTransaction(t *testing.T, delay time.Duration) (*ServerTransaction, *FakeClock, *recordConn) {
+	invite := "INVITE sip:34020000001320000001@192.168.1.108:5060 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.100:5060;branch=z9hG4bK-1\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000001320000001@3402000000>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:34020000002000000001@192.168.1.100:5060>\r\n" +
+		"Timestamp: 54\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	request, _, err := parseMessage([]byte(invite), len(invite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	conn := &recordConn{}
+	stack := &Stack{TimerService: clock, Options: Options{TryingDelay: delay}}
+	stateMachine := &InviteServerStateMachine{}
+	transaction := &ServerTransaction{transaction: transaction{
+		originalRequest: request.(*Request),
+		isInvite:        true,
+		stateMachine:    stateMachine,
+		conn:            conn,
+		sipStack:        stack,
+		listeningPoint:  &ListeningPoint{},
+	}}
+	stateMachine.setTransaction(transaction)
+	transaction.setTimers(DefaultTimers)
+	transaction.stateMachine.setState(inviteServerStateProceeding)
+	transaction.startTrying()
+	return transaction, clock, conn
+}
+
+func TestAutomaticTrying(t *testing.T) {
+	transaction, clock, conn := newTryingTransaction(t, DefaultTryingDelay)
+	clock.Advance(DefaultTryingDelay - time.Millisecond)
+	if len(conn.messages) != 0 {
+		t.Fatalf("100 Trying should not be sent before the delay")
+	}
+	clock.Advance(time.Millisecond)
+	if len(conn.messages) != 1 || !strings.HasPrefix(conn.messages[0], "SIP/2.0 100 Trying") || !strings.Contains(conn.messages[0], "Timestamp: 54") {
+		t.Fatalf("bad 100 Trying %v", conn.messages)
+	}
+
+	//重传的INVITE重传100 Trying
+	transaction.processRequest(transaction.originalRequest)
+	if len(conn.messages) != 2 || conn.messages[1] != conn.messages[0] {
+		t.Fatalf("100 Trying should be retransmitted %v", conn.messages)
+	}
+
+	//TU已经发送临时应答
+	transaction, clock, conn = newTryingTransaction(t, DefaultTryingDelay)
+	clock.Advance(100 * time.Millisecond)
+	transaction.SendResponse(transaction.originalRequest.CreateResponse(Ringing))
+	clock.Advance(time.Second)
+	if len(conn.messages) != 1 || !strings.HasPrefix(conn.messages[0], "SIP/2.0 180") {
+		t.Fatalf("100 Trying should be suppressed %v", conn.messages)
+	}
+
+	//在延迟之前收到重传, 立即发送
+	transaction, clock, conn = newTryingTransaction(t, DefaultTryingDelay)
+	transaction.processRequest(transaction.originalRequest)
+	clock.Advance(time.Second)
+	if len(conn.messages) != 1 || !strings.HasPrefix(conn.messages[0], "SIP/2.0 100 Trying") {
+		t.Fatalf("100 Trying should be sent once %v", conn.messages)
+	}
+
+	//关闭自动发送
+	transaction, clock, conn = newTryingTransaction(t, -1)
+	transaction.processRequest(transaction.originalRequest)
+	clock.Advance(time.Second)
+	if len(conn.messages) != 0 || clock.Pending() != 0 {
+		t.Fatalf("100 Trying should be disabled %v", conn.messages)
 	}
 }
@@ -0,0 +1,805 @@
+package sip
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// RFC 4475 SIP Torture Test Messages. 消息中的换行使用\n书写, crlf转换为CRLF
+
+func crlf(message string) string {
+	return strings.ReplaceAll(message, "\n", "\r\n")
+}
+
+// withBody 替换消息头中的{length}为消息体的长度
+func withBody(head, body string) string {
+	head, body = crlf(head), crlf(body)
+	return strings.Replace(head, "{length}", strconv.Itoa(len(body)), 1) + body
+}
+
+const tortureSdp = `v=0
+o=mhandley 29739 7272939 IN IP4 192.0.2.3
+s=-
+c=IN IP4 192.0.2.4
+t=0 0
+m=audio 49217 RTP/AVP 0 12
+m=video 3227 RTP/AVP 31
+a=rtpmap:31 LPC
+`
+
+func longRequest() string {
+	long := strings.Repeat("unknowheaderlongvalue", 50)
+	via := ""
+	for i := 0; i < 20; i++ {
+		via += "Via: SIP/2.0/TCP sip" + strconv.Itoa(i) + ".example.com;branch=z9hG4bK" + long[:i+1] + "\n"
+	}
+	return crlf(`INVITE sip:user@example.com SIP/2.0
+To: "I have a user name of ` + long + `" <sip:user@example.com>
+From: sip:caller@example.net;tag=` + long + `
+Call-ID: longreq.one` + long + `@example.net
+CSeq: 3882340 INVITE
+Unknown-` + long + `-Header: ` + long + `
+` + via + `Contact: <sip:amazinglylongcallername` + long + `@host5.example.net>
+Max-Forwards: 70
+l: 0
+
+`)
+}
+
+var tortureMessages = []struct {
+	name    string
+	message string
+	valid   bool
+}{
+	// 3.1.1 Parser Tests (Valid)
+	{"wsinv", withBody(`INVITE sip:vivekg@chair-dnrc.example.com;unknownparam SIP/2.0
+TO :
+ sip:vivekg@chair-dnrc.example.com ;   tag    = 1918181833n
+from   : "J Rosenberg \\\""       <sip:jdrosen@example.com>
+  ;
+  tag = 98asjd8
+MaX-fOrWaRdS: 0068
+Call-ID: wsinv.ndaksdj@192.0.2.1
+Content-Length   : {length}
+cseq: 0009
+  INVITE
+Via  : SIP  /   2.0
+ /UDP
+    192.0.2.2;branch=390skdjuw
+s :
+NewFangledHeader:   newfangled value
+ continued newfangled value
+UnknownHeaderWithUnusualValue: ;;,,;;,;
+Content-Type: application/sdp
+Route:
+ <sip:services.example.com;lr;unknownwith=value;unknown-no-value>
+v:  SIP  / 2.0  / TCP     spindle.example.com   ;
+  branch  =   z9hG4bK9ikj8  ,
+ SIP  /    2.0   / UDP  192.168.255.111   ; branch=
+ z9hG4bK30239
+m:"Quoted string \"\"" <sip:jdrosen@example.com> ; newparam =
+      newvalue ;
+  secondparam ; q = 0.33
+
+`, tortureSdp), true},
+	{"intmeth", "!interesting-Method0123456789_*+`.%indeed'~ sip:1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*:&it+has=1,weird!*pas$wo~d_too.(doesn't-it)@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP host1.example.com;branch=z9hG4bK-.!%66*_+`'~\r\n" +
+		"To: \"BEL:\\\x07 NUL:\\\x00 DEL:\\\x7F\" <sip:1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*@example.com>\r\n" +
+		"From: token1~` token2'+_ token3*%!.- <sip:mundane@example.com>;fromParam''~+*_!.-%=\"\xd1\x80\xd0\xb0\xd0\xb1\xd0\xbe\xd1\x82\xd0\xb0\xd1\x8e\xd1\x89\xd0\xb8\xd0\xb9\";tag=_token~1'+`*%!-.\r\n" +
+		"Call-ID: intmeth.word%ZK-!.*_+'@word`~)(><:\\/\"][?}{\r\n" +
+		"CSeq: 139122385 !interesting-Method0123456789_*+`.%indeed'~\r\n" +
+		"Max-Forwards: 255\r\n" +
+		"extensionHeader-!.%*+_`'~: \xef\xbb\xbf\xe5\xa4\xa7\xe5\x81\x9c\xe9\x9b\xbb\r\n" +
+		"Content-Length: 0\r\n\r\n", true},
+	{"esc01", withBody(`INVITE sip:sips%3Auser%40example.com@example.net SIP/2.0
+To: sip:%75se%72@example.com
+From: <sip:I%20have%20spaces@example.net>;tag=938
+Max-Forwards: 87
+i: esc01.239409asdfakjkn23onasd0-3234
+CSeq: 234234 INVITE
+Via: SIP/2.0/UDP host5.example.net;branch=z9hG4bKkdjuw
+C: application/sdp
+Contact:
+  <sip:cal%6Cer@host5.example.net;%6C%72;n%61me=v%61lue%25%34%31>
+Content-Length: {length}
+
+`, tortureSdp), true},
+	{"escnull", crlf(`REGISTER sip:example.com SIP/2.0
+To: sip:null-%00-null@example.com
+From: sip:null-%00-null@example.com;tag=839923423
+Max-Forwards: 70
+Call-ID: escnull.39203ndfvkjdasfkq3w4otrq0adsfdfnavd
+CSeq: 14398234 REGISTER
+Via: SIP/2.0/UDP host5.example.com;branch=z9hG4bKkdjuw
+Contact: <sip:%00@host5.example.com>
+Contact: <sip:%00%00@host5.example.com>
+L:0
+
+`), true},
+	{"esc02", crlf(`RE%47IST%45R sip:registrar.example.com SIP/2.0
+To: "%Z%45" <sip:resource@example.com>
+From: "%Z%45" <sip:resource@example.com>;tag=f232jadfj23
+Call-ID: esc02.asdfnqwo34rq23i34jrjasdcnl23nrlknsdf
+Via: SIP/2.0/TCP host.example.com;rport;branch=z9hG4bK209793
+Max-Forwards: 70
+Contact: <sip:alias1@host1.example.com>
+C%6Fntact: <sip:alias2@host2.example.com>
+Contact: <sip:alias3@host3.example.com>
+l: 0
+CSeq: 29344 RE%47IST%45R
+
+`), true},
+	{"lwsdisp", crlf(`OPTIONS sip:user@example.com SIP/2.0
+To: sip:user@example.com
+From: caller<sip:caller@example.com>;tag=323
+Max-Forwards: 70
+Call-ID: lwsdisp.1234abcd@funky.example.com
+CSeq: 60 OPTIONS
+Via: SIP/2.0/UDP funky.example.com;branch=z9hG4bKkdjuw
+l: 0
+
+`), true},
+	{"longreq", longRequest(), true},
+	{"dblreq", crlf(`REGISTER sip:example.com SIP/2.0
+To: sip:j.user@example.com
+From: sip:j.user@example.com;tag=43251j3j324
+Max-Forwards: 8
+I: dblreq.0ha0isndaksdj99sdfafnl3lk233412
+Contact: sip:j.user@host.example.com
+CSeq: 8 REGISTER
+Via: SIP/2.0/UDP 192.0.2.125;branch=z9hG4bKkdjuw23492
+Content-Length: 0
+
+
+INVITE sip:joe@example.com SIP/2.0
+t: sip:joe@example.com
+From: sip:caller@example.net;tag=141334
+Max-Forwards: 8
+Call-ID: dblreq.0ha0isnda977644900765@192.0.2.15
+CSeq: 8 INVITE
+Via: SIP/2.0/UDP 192.0.2.15;branch=z9hG4bKkdjuw380234
+Content-Type: application/sdp
+Content-Length: 150
+
+`), true},
+	{"semiuri", crlf(`OPTIONS sip:user;par=u%40example.net@example.com SIP/2.0
+To: sip:j_user@example.com
+From: sip:caller@example.org;tag=33242
+Max-Forwards: 3
+Call-ID: semiuri.0ha0isndaksdj
+CSeq: 8 OPTIONS
+Accept: application/sdp, application/pkcs7-mime,
+        multipart/mixed, multipart/signed,
+        message/sip, message/sipfrag
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+l: 0
+
+`), true},
+	{"transports", crlf(`OPTIONS sip:user@example.com SIP/2.0
+To: sip:user@example.com
+From: <sip:caller@example.com>;tag=323
+Max-Forwards: 70
+Call-ID:  transports.kijh4akdnaqjkwendsasfdj
+Accept: application/sdp
+CSeq: 60 OPTIONS
+Via: SIP/2.0/UDP t1.example.com;branch=z9hG4bKkdjuw
+Via: SIP/2.0/SCTP t2.example.com;branch=z9hG4bKklasjdhf
+Via: SIP/2.0/TLS t3.example.com;branch=z9hG4bK2980unddj
+Via: SIP/2.0/UNKNOWN t4.example.com;branch=z9hG4bKasd0f3en
+Via: SIP/2.0/TCP t5.example.com;branch=z9hG4bK0a9idfnee
+l: 0
+
+`), true},
+	{"mpart01", withBody(`MESSAGE sip:kumiko@example.org SIP/2.0
+Via: SIP/2.0/UDP 127.0.0.1:5070;branch=z9hG4bK-d87543-4dade06d0bdb11ee-1--d87543-;rport
+Max-Forwards: 70
+Route: <sip:127.0.0.1:5080>
+Identity: r5mwreLuyDRYBi/0TiPwEsY3rEVsk/G2WxhgTV1PF7hHuLIK0YWVKZhKv9Mj8UeXqkMVbnVq37CD+813gvYjcBUaZngQmXc9WNZSDNGCzA+fWl9MEUHWIZo1CeJebdY/XlgKeTa0Olvq0rt70Q5jiSfbqMJmQFteeivUhkMWYUA=
+Contact: <sip:fluffy@127.0.0.1:5070>
+To: <sip:kumiko@example.org>
+From: <sip:fluffy@example.com>;tag=2fb0dcc9
+Call-ID: 3d9485ad0c49859b@Zmx1ZmZ5LW1hYy0xNi5sb2NhbA..
+CSeq: 1 MESSAGE
+Content-Transfer-Encoding: binary
+Content-Type: multipart/mixed;boundary=7a9cbec02ceef655
+Date: Sat, 15 Oct 2005 04:44:56 GMT
+User-Agent: SIPimp.org/0.2.5 (curses)
+Content-Length: {length}
+
+`, "--7a9cbec02ceef655\n"+
+		"Content-Type: text/plain\n"+
+		"Content-Transfer-Encoding: binary\n"+
+		"\n"+
+		"Hello\n"+
+		"--7a9cbec02ceef655\n"+
+		"Content-Type: application/octet-stream\n"+
+		"Content-Transfer-Encoding: binary\n"+
+		"\n"+
+		"0\x82\x01R\x06\t*\x86H\x86\xf7\r\x01\x07\x02\xa0\x82\x01C0\x82\x01?\x02\x01\x011\t0\x07\x06\x05+\x0e\x03\x02\x1a0\x0b\x06\t*\x86H\x86\xf7\r\x01\x07\x011\x82\x01 \n"+
+		"--7a9cbec02ceef655--\n"), true},
+	{"unreason", withBody(`SIP/2.0 200 = 2**3 * 5**2 но сто девяносто девять - простое
+Via: SIP/2.0/UDP 192.0.2.198;branch=z9hG4bK1324923
+Call-ID: unreason.1234ksdfak3j2erwedfsASdf
+CSeq: 35 INVITE
+From: sip:user@example.com;tag=11141343
+To: sip:user@example.edu;tag=2229
+Content-Length: {length}
+Content-Type: application/sdp
+Contact: <sip:user@host198.example.com>
+
+`, tortureSdp), true},
+	{"noreason", crlf("SIP/2.0 100 \n" + `Via: SIP/2.0/UDP 192.0.2.105;branch=z9hG4bK2398ndaoe
+Call-ID: noreason.asndj203insdf99223ndf
+CSeq: 35 INVITE
+From: <sip:user@example.com>;tag=39ansfi3
+To: <sip:user@example.edu>;tag=902jndnke3
+Content-Length: 0
+Contact: <sip:user@host105.example.com>
+
+`), true},
+
+	// 3.1.2 Parser Tests (Invalid)
+	{"badinv01", withBody(`INVITE sip:user@example.com SIP/2.0
+To: sip:j.user@example.com
+From: sip:caller@example.net;tag=134161461246
+Max-Forwards: 7
+Call-ID: badinv01.0ha0isndaksdjasdf3234nas
+CSeq: 8 INVITE
+Via: SIP/2.0/UDP 192.0.2.15;;,;,,
+Contact: "Joe" <sip:joe@example.org>;;;;
+Content-Length: {length}
+Content-Type: application/sdp
+
+`, tortureSdp), false},
+	{"clerr", crlf(`INVITE sip:user@example.com SIP/2.0
+Max-Forwards: 80
+To: sip:j.user@example.com
+From: sip:caller@example.net;tag=93942939o2
+Contact: <sip:caller@hungry.example.net>
+Call-ID: clerr.0ha0isndaksdjweiafasdk3
+CSeq: 8 INVITE
+Via: SIP/2.0/UDP host5.example.com;branch=z9hG4bK-39234-23523
+Content-Type: application/sdp
+Content-Length: 9999
+
+v=0
+o=mhandley 29739 7272939 IN IP4 192.0.2.155
+`), false},
+	{"scalar02", crlf(`REGISTER sip:example.com SIP/2.0
+Via: SIP/2.0/TCP host129.example.com;branch=z9hG4bK342sdfoi3
+To: <sip:user@example.com>
+From: <sip:user@example.com>;tag=239232jh3
+CSeq: 36893488147419103232 REGISTER
+Call-ID: scalar02.23o0pd9vanlq3wnrlnewofjas9ui32
+Max-Forwards: 300
+Expires: 1` + strings.Repeat("0", 200) + `
+Contact: <sip:user@host129.example.com>
+  ;expires=280297596632815
+Content-Length: 0
+
+`), false},
+	{"scalarlg", crlf(`SIP/2.0 503 Service Unavailable
+Via: SIP/2.0/TCP host129.example.com;branch=z9hG4bKzzxdiwo34sw;received=192.0.2.129
+To: <sip:user@example.com>
+From: <sip:other@example.net>;tag=2easdjfejw
+CSeq: 9292394834772304023312 OPTIONS
+Call-ID: scalarlg.noase0of0234hn2qofoaf0232aewf2394r
+Retry-After: 949302838503028349304023988
+Warning: 1812 overture "In Progress"
+Content-Length: 18446744073709551617
+
+`), false},
+	{"quotbal", withBody(`INVITE sip:user@example.com SIP/2.0
+To: "Mr. J. User <sip:j.user@example.com>
+From: sip:caller@example.net;tag=93334
+Max-Forwards: 10
+Call-ID: quotbal.aksdj
+Contact: <sip:caller@host59.example.net>
+CSeq: 8 INVITE
+Via: SIP/2.0/UDP 192.0.2.59:5050;branch=z9hG4bKkdjuw39234
+Content-Type: application/sdp
+Content-Length: {length}
+
+`, tortureSdp), false},
+	{"ltgtruri", crlf(`INVITE <sip:user@example.com> SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.net;tag=39291
+Max-Forwards: 23
+Call-ID: ltgtruri.1@192.0.2.5
+CSeq: 1 INVITE
+Via: SIP/2.0/UDP 192.0.2.5
+Contact: <sip:caller@host5.example.net>
+Content-Length: 0
+
+`), false},
+	{"lwsruri", crlf(`INVITE sip:user@example.com; lr SIP/2.0
+To: sip:user@example.com;tag=3xfe-9921883-z9f
+From: sip:caller@example.net;tag=231413434
+Max-Forwards: 5
+Call-ID: lwsruri.asdfasdoeoi2323-asdfwrn23-asd834rk423
+CSeq: 2130706432 INVITE
+Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bKkdjuw2395
+Contact: <sip:caller@host1.example.net>
+Content-Length: 0
+
+`), false},
+	{"lwsstart", crlf(`INVITE  sip:user@example.com  SIP/2.0
+Max-Forwards: 8
+To: sip:user@example.com
+From: sip:caller@example.net;tag=8814
+Call-ID: lwsstart.dfknq234oi243099adsdfnawe3@example.com
+CSeq: 1893884 INVITE
+Via: SIP/2.0/UDP host1.example.com;branch=z9hG4bKkdjuw3923
+Contact: <sip:caller@host1.example.net>
+Content-Length: 0
+
+`), false},
+	{"trws", crlf("OPTIONS sip:remote-target@example.com SIP/2.0  \n" + `Via: SIP/2.0/TCP host1.example.com;branch=z9hG4bK299342093
+To: <sip:remote-target@example.com>
+From: <sip:local-resource@example.com>;tag=329429089
+Call-ID: trws.oicu34958239neffasdhr2345r
+Accept: application/sdp
+CSeq: 238923 OPTIONS
+Max-Forwards: 70
+Content-Length: 0
+
+`), false},
+	{"escruri", crlf(`INVITE sip:user@example.com?Route=%3Csip:example.com%3E SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.net;tag=341518
+Max-Forwards: 7
+Contact: <sip:caller@host39923.example.net>
+Call-ID: escruri.23940-asdfhj-aje3br-234q098w-fawerh2q-h4n5
+CSeq: 149209342 INVITE
+Via: SIP/2.0/UDP host-of-the-hour.example.com;branch=z9hG4bKkdjuw
+Content-Length: 0
+
+`), true},
+	{"baddate", crlf(`INVITE sip:user@example.com SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.net;tag=2234923
+Max-Forwards: 70
+Call-ID: baddate.239423mnsadf3j23lj42--sedfnm234
+CSeq: 1392934 INVITE
+Via: SIP/2.0/UDP host.example.com;branch=z9hG4bKkdjuw
+Date: Fri, 01 Jan 2010 16:00:00 EST
+Contact: <sip:caller@host5.example.net>
+Content-Length: 0
+
+`), true},
+	{"regbadct", crlf(`REGISTER sip:example.com SIP/2.0
+To: sip:user@example.com
+From: sip:user@example.com;tag=998332
+Max-Forwards: 70
+Call-ID: regbadct.k345asrl3fdbv@10.0.0.1
+CSeq: 1 REGISTER
+Via: SIP/2.0/UDP 135.180.130.133:5060;branch=z9hG4bKkdjuw
+Contact: sip:user@example.com?Route=%3Csip:sip.example.com%3E
+l: 0
+
+`), true},
+	{"badaspec", crlf(`OPTIONS sip:user@example.org SIP/2.0
+Via: SIP/2.0/UDP host4.example.com:5060;branch=z9hG4bKkdju43234
+Max-Forwards: 70
+From: "Bell, Alexander" <sip:a.g.bell@example.com>;tag=433423
+To: "Watson, Thomas" < sip:t.watson@example.org >
+Call-ID: badaspec.sdf0234n2nds0a099u23h3hnnw009cdkne3
+Accept: application/sdp
+CSeq: 3923239 OPTIONS
+l: 0
+
+`), false},
+	{"baddn", crlf(`OPTIONS sip:t.watson@example.org SIP/2.0
+Via:     SIP/2.0/UDP c.example.com:5060;branch=z9hG4bKkdjuw
+Max-Forwards:      70
+From:    Bell, Alexander <sip:a.g.bell@example.com>;tag=43
+To:      Watson, Thomas <sip:t.watson@example.org>
+Call-ID: baddn.31415@c.example.com
+Accept: application/sdp
+CSeq:    3923239 OPTIONS
+l: 0
+
+`), false},
+	{"badvers", crlf(`OPTIONS sip:t.watson@example.org SIP/7.0
+Via:     SIP/7.0/UDP c.example.com;branch=z9hG4bKkdjuw
+Max-Forwards:     70
+From:    A. Bell <sip:a.g.bell@example.com>;tag=qweoiqpe
+To:      T. Watson <sip:t.watson@example.org>
+Call-ID: badvers.31417@c.example.com
+CSeq:    1 OPTIONS
+l: 0
+
+`), false},
+	{"mismatch01", crlf(`OPTIONS sip:user@example.com SIP/2.0
+To: sip:j.user@example.com
+From: sip:caller@example.net;tag=34525
+Max-Forwards: 6
+Call-ID: mismatch01.dj0234sxdfl3
+CSeq: 8 INVITE
+Via: SIP/2.0/UDP host.example.com;branch=z9hG4bKkdjuw
+l: 0
+
+`), false},
+	{"mismatch02", crlf(`NEWMETHOD sip:user@example.com SIP/2.0
+To: sip:j.user@example.com
+From: sip:caller@example.net;tag=34525
+Max-Forwards: 6
+Call-ID: mismatch02.dj0234sxdfl3
+CSeq: 8 INVITE
+Contact: <sip:caller@host.example.net>
+Via: SIP/2.0/UDP host.example.net;branch=z9hG4bKkdjuw
+Content-Type: application/sdp
+l: 0
+
+`), false},
+	{"bigcode", crlf(`SIP/2.0 4294967301 better not break the receiver
+Via: SIP/2.0/UDP 192.0.2.105;branch=z9hG4bK2398ndaoe
+Call-ID: bigcode.asdof3uj203asdnf3429uasdhfas3ehjasdfas9i
+CSeq: 353494 INVITE
+From: <sip:user@example.com>;tag=39ansfi3
+To: <sip:user@example.edu>;tag=902jndnke3
+Content-Length: 0
+Contact: <sip:user@host105.example.com>
+
+`), false},
+	{"badbranch", crlf(`OPTIONS sip:user@example.com SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.org;tag=33242
+Max-Forwards: 3
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK
+Accept: application/sdp
+Call-ID: badbranch.sadonfo23i420jv0as0derf3j3n
+CSeq: 8 OPTIONS
+l: 0
+
+`), true},
+
+	// 3.3 Transaction Layer Semantics / 3.4 Application-Layer Semantics
+	{"zeromf", crlf(`OPTIONS sip:user@example.com SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.net;tag=3ghsd41
+Call-ID: zeromf.jfasdlfnm2o2l43r5u0asdfas
+CSeq: 39234321 OPTIONS
+Via: SIP/2.0/UDP host1.example.com;branch=z9hG4bKkdjuw2349i
+Max-Forwards: 0
+Content-Length: 0
+
+`), true},
+	{"insuf", withBody(`INVITE sip:user@example.com SIP/2.0
+CSeq: 193942 INVITE
+Via: SIP/2.0/UDP 192.0.2.95;branch=z9hG4bKkdj.insuf
+Content-Type: application/sdp
+l: {length}
+
+`, tortureSdp), false},
+	{"unkscm", crlf(`OPTIONS nobodyKnowsThisScheme:totallyopaquecontent SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.net;tag=384
+Max-Forwards: 3
+Call-ID: unkscm.nasdfasser0q239nwsdfasdkl34
+CSeq: 3923423 OPTIONS
+Via: SIP/2.0/TCP host9.example.com;branch=z9hG4bKkdjuw39234
+Content-Length: 0
+
+`), false},
+	{"novelsc", crlf(`OPTIONS soap.beep://192.0.2.103:3002 SIP/2.0
+To: sip:user@example.com
+From: sip:caller@example.net;tag=384
+Max-Forwards: 3
+Call-ID: novelsc.asdfasser0q239nwsdfasdkl34
+CSeq: 3923423 OPTIONS
+Via: SIP/2.0/TCP host9.example.com;branch=z9hG4bKkdjuw39234
+Content-Length: 0
+
+`), false},
+	{"unksm", crlf(`REGISTER sip:example.com SIP/2.0
+To: isbn:2983792873
+From: <http://www.example.com>;tag=3234233
+Call-ID: unksch.daksdj@hyphenated-host.example.com
+CSeq: 234902 REGISTER
+Max-Forwards: 70
+Via: SIP/2.0/UDP 192.0.2.21:5060;branch=z9hG4bKkdjuw
+Contact: <name:John_Smith>
+l: 0
+
+`), true},
+	{"unksm2", crlf(`REGISTER sip:example.com SIP/2.0
+To: <isbn:2983792873>
+From: <http://www.example.com>;tag=3234233
+Call-ID: unksch2.daksdj@hyphenated-host.example.com
+CSeq: 234902 REGISTER
+Max-Forwards: 70
+Via: SIP/2.0/UDP 192.0.2.21:5060;branch=z9hG4bKkdjuw
+Contact: <name:John_Smith>
+l: 0
+
+`), true},
+	{"bext01", crlf(`OPTIONS sip:user@example.com SIP/2.0
+To: sip:j_user@example.com
+From: sip:caller@example.net;tag=242etr
+Max-Forwards: 6
+Call-ID: bext01.0ha0isndaksdj
+Require: nothingSupportsThis, nothingSupportsThisEither
+Proxy-Require: noProxiesSupportThis, norDoAnyProxiesSupportThis
+CSeq: 8 OPTIONS
+Via: SIP/2.0/TLS fold-and-staple.example.com;branch=z9hG4bKkdjuw
+Content-Length: 0
+
+`), true},
+	{"invut", withBody(`INVITE sip:user@example.com SIP/2.0
+Contact: <sip:caller@host5.example.net>
+To: sip:j.user@example.com
+From: sip:caller@example.net;tag=8392034
+Max-Forwards: 70
+Call-ID: invut.0ha0isndaksdjadsfij34n23d
+CSeq: 235448 INVITE
+Via: SIP/2.0/UDP somehost.example.com;branch=z9hG4bKkdjuw
+Content-Type: application/unknownformat
+Content-Length: {length}
+
+`, `<audio>
+ <pcmu port="443"/>
+</audio>
+`), true},
+	{"multi01", withBody(`INVITE sip:user@company.com SIP/2.0
+Contact: <sip:caller@host25.example.net>
+Via: SIP/2.0/UDP 192.0.2.25;branch=z9hG4bKkdjuw
+Max-Forwards: 70
+CSeq: 5 INVITE
+Call-ID: multi01.98asdh@192.0.2.1
+CSeq: 59 INVITE
+Call-ID: multi01.98asdh@192.0.2.2
+From: sip:caller@example.com;tag=3413415
+To: sip:user@example.com
+To: sip:other@example.net
+From: sip:caller@example.net;tag=2923420123
+Content-Type: application/sdp
+l: {length}
+Contact: <sip:caller@host36.example.net>
+Max-Forwards: 5
+
+`, tortureSdp), false},
+	{"mcl01", crlf(`OPTIONS sip:user@example.com SIP/2.0
+Via: SIP/2.0/UDP host5.example.net;branch=z9hG4bK293423
+To: <sip:user@example.com>
+From: <sip:other@example.net>;tag=3923942
+Call-ID: mcl01.fhn2323orihawfdoa3o4r52o3irsdf
+CSeq: 15932 OPTIONS
+Content-Length: 13
+Max-Forwards: 60
+Content-Length: 5
+Content-Type: text/plain
+
+There's no way to know how many octets are supposed to be here.
+`), false},
+	{"bcast", withBody(`SIP/2.0 200 OK
+Via: SIP/2.0/UDP 192.0.2.198;branch=z9hG4bK1324923
+Via: SIP/2.0/UDP 255.255.255.255;branch=z9hG4bK1saber23
+Call-ID: bcast.0384840201234ksdfak3j2erwedfsASdf
+CSeq: 35 INVITE
+From: sip:user@example.com;tag=11141343
+To: sip:user@example.edu;tag=2229
+Content-Length: {length}
+Content-Type: application/sdp
+Contact: <sip:user@host28.example.com>
+
+`, tortureSdp), true},
+	{"regaut01", crlf(`REGISTER sip:example.com SIP/2.0
+To: sip:j.user@example.com
+From: sip:j.user@example.com;tag=87321hj23128
+Max-Forwards: 8
+Call-ID: regaut01.0ha0isndaksdj
+CSeq: 9338 REGISTER
+Via: SIP/2.0/TCP 192.0.2.253;branch=z9hG4bKkdjuw
+Authorization: NoOneKnowsThisScheme opaque-data=here
+Content-Length:0
+
+`), true},
+	{"cparam01", crlf(`REGISTER sip:example.com SIP/2.0
+Via: SIP/2.0/UDP saturn.example.com:5060;branch=z9hG4bKkdjuw
+Max-Forwards: 70
+From: sip:watson@example.com;tag=DkfVgjkrtMwaerKKpe
+To: sip:watson@example.com
+Call-ID: cparam01.70710@saturn.example.com
+CSeq: 2 REGISTER
+Contact: sip:+19725552222@gw1.example.net;unknownparam
+l: 0
+
+`), true},
+	{"cparam02", crlf(`REGISTER sip:example.com SIP/2.0
+Via: SIP/2.0/UDP saturn.example.com:5060;branch=z9hG4bKkdjuw
+Max-Forwards: 70
+From: sip:watson@example.com;tag=838293
+To: sip:watson@example.com
+Call-ID: cparam02.70710@saturn.example.com
+CSeq: 3 REGISTER
+Contact: <sip:+19725552222@gw1.example.net;unknownparam>
+l: 0
+
+`), true},
+	{"regescrt", crlf(`REGISTER sip:example.com SIP/2.0
+To: sip:user@example.com
+From: sip:user@example.com;tag=8
+Max-Forwards: 70
+Call-ID: regescrt.k345asrl3fdbv@192.0.2.1
+CSeq: 14398234 REGISTER
+Via: SIP/2.0/UDP host5.example.com;branch=z9hG4bKkdjuw
+M: <sip:user@example.com?Route=%3Csip:sip.example.com%3E>
+L:0
+
+`), true},
+	{"sdp01", withBody(`INVITE sip:user@example.com SIP/2.0
+To: sip:j_user@example.com
+Contact: <sip:caller@host15.example.net>
+From: sip:caller@example.net;tag=234
+Max-Forwards: 5
+Call-ID: sdp01.ndaksdj9342dasdd
+Accept: text/nobodyKnowsThis
+CSeq: 8 INVITE
+Via: SIP/2.0/UDP 60.example.com;branch=z9hG4bKkdjuw
+Content-Length: {length}
+Content-Type: application/sdp
+
+`, `v=0
+o=mhandley 29739 7272939 IN IP4 192.0.2.5
+s=-
+c=IN IP4 192.0.2.5
+t=0 0
+m=audio 49217 RTP/AVP 0
+`), true},
+	{"inv2543", withBody(`INVITE sip:UserB@example.com SIP/2.0
+Via: SIP/2.0/UDP iftgw.example.com
+From: <sip:+13035551111@ift.client.example.net;user=phone>
+Record-Route: <sip:UserB@example.com;maddr=ss1.example.com>
+To: sip:+16505552222@ss1.example.net;user=phone
+Call-ID: inv2543.1717@ift.client.example.com
+CSeq: 56 INVITE
+Contact: <sip:+13035551111@ift.client.example.net;user=phone>
+Content-Type: application/sdp
+Content-Length: {length}
+
+`, tortureSdp), true},
+
+	// 摄像头和扫描器发送的畸形消息
+	{"empty", "", false},
+	{"crlf keep-alive", "\r\n\r\n", false},
+	{"start line only", "OPTIONS sip:user@example.com SIP/2.0\r\n\r\n", false},
+	{"header without colon", crlf(`OPTIONS sip:user@example.com SIP/2.0
+Via SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+
+`), false},
+	{"empty host", crlf(`OPTIONS sip:user@ SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+
+`), false},
+	{"negative content length", crlf(`OPTIONS sip:user@example.com SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+To: sip:user@example.com
+From: sip:caller@example.net;tag=1
+Call-ID: 1
+CSeq: 1 OPTIONS
+Content-Length: -5
+
+`), false},
+	{"unterminated uri", crlf(`OPTIONS sip:user@example.com SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+To: <sip:user@example.com
+From: sip:caller@example.net;tag=1
+Call-ID: 1
+CSeq: 1 OPTIONS
+
+`), false},
+	{"bad port", crlf(`OPTIONS sip:user@example.com:99999 SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+
+`), false},
+}
+
+func TestTortureMessages(t *testing.T) {
+	for _, c := range tortureMessages {
+		msg, _, err := parseMessage([]byte(c.message), len(c.message))
+		if c.valid && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: the message should be rejected", c.name)
+		} else if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("%s: the error should be a ParseError %v", c.name, err)
+			}
+		} else {
+			//解析成功的消息可以再次序列化和解析
+			data := msg.ToBytes()
+			if _, _, err = parseMessage(data, len(data)); err != nil {
+				t.Errorf("%s: the serialized message cannot be parsed %v", c.name, err)
+			}
+		}
+	}
+}
+
+func TestTortureValues(t *testing.T) {
+	find := func(name string) Message {
+		for _, c := range tortureMessages {
+			if c.name == name {
+				msg, _, err := parseMessage([]byte(c.message), len(c.message))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return msg
+			}
+		}
+		t.Fatalf("%s not found", name)
+		return nil
+	}
+
+	wsinv := find("wsinv")
+	if wsinv.To().Tag != "1918181833n" || wsinv.From().Tag != "98asjd8" || *wsinv.MaxForwards() != 68 {
+		t.Fatalf("bad wsinv tags %s %s", wsinv.To().Tag, wsinv.From().Tag)
+	}
+	if cseq := wsinv.CSeq(); cseq.Number != 9 || cseq.Method != INVITE {
+		t.Fatalf("bad wsinv cseq %v", cseq)
+	}
+	if vias := wsinv.GetHeader(ViaName); len(vias) != 3 || vias[1].(*Via).branch != "z9hG4bK9ikj8" || vias[2].(*Via).sendBy.Host != "192.168.255.111" {
+		t.Fatalf("bad wsinv vias %v", vias)
+	}
+	if contact := wsinv.Contact(); contact.Q != 0.33 {
+		t.Fatalf("bad wsinv contact %v", contact)
+	}
+	if header := wsinv.GetHeader("newfangledheader"); header[0].Value() != "newfangled value continued newfangled value" {
+		t.Fatalf("bad folded header %s", header[0].Value())
+	}
+	if len(wsinv.(*Request).Content()) != len(crlf(tortureSdp)) {
+		t.Fatalf("bad wsinv body")
+	}
+
+	intmeth := find("intmeth").(*Request)
+	if uri := intmeth.GetRequestLine().RequestUri; uri.User != "1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*" || uri.HostPort.Host != "example.com" {
+		t.Fatalf("bad intmeth uri %v", uri)
+	}
+	if find("esc01").ContentType() == nil {
+		t.Fatalf("the compact form C should be Content-Type")
+	}
+	if uri := find("semiuri").(*Request).GetRequestLine().RequestUri; uri.User != "user;par=u@example.net" || uri.ToString() != "sip:user;par=u%40example.net@example.com" {
+		t.Fatalf("bad semiuri user %s", uri.User)
+	}
+	if accept := find("semiuri").GetHeader(AcceptName); len(accept) != 6 {
+		t.Fatalf("bad semiuri accept %v", accept)
+	}
+	if reason := find("noreason").(*Response).GetReason(); reason != "" {
+		t.Fatalf("bad reason %s", reason)
+	}
+	if vias := find("transports").GetHeader(ViaName); len(vias) != 5 || vias[3].(*Via).transport != "UNKNOWN" {
+		t.Fatalf("bad transports %v", vias)
+	}
+	//RFC 4475 3.3.4 其他scheme的URI不影响解析, 由注册服务器返回400
+	for _, name := range []string{"unksm", "unksm2"} {
+		unksm := find(name)
+		if to := unksm.To().Address.Uri; to.GetScheme() != "isbn" || to.Opaque() != "2983792873" || to.ToString() != "isbn:2983792873" {
+			t.Fatalf("bad %s to %s", name, to.ToString())
+		} else if from := unksm.From(); from.Address.Uri.ToString() != "http://www.example.com" || from.Tag != "3234233" {
+			t.Fatalf("bad %s from %s", name, from.Address.Uri.ToString())
+		} else if contact := unksm.Contact().Address.Uri; contact.GetScheme() != "name" || contact.Equals(to) {
+			t.Fatalf("bad %s contact %s", name, contact.ToString())
+		}
+	}
+	if uri := find("regescrt").Contact().Address.Uri; uri.Headers["Route"] != "<sip:sip.example.com>" {
+		t.Fatalf("bad regescrt contact %s", uri.ToString())
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	msg := "OPTIONS sip:user@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw\r\n" +
+		"To: sip:user@example.com\r\n" +
+		"CSeq: x OPTIONS\r\n\r\n"
+	_, _, err := parseMessage([]byte(msg), len(msg))
+	parseError, ok := err.(*ParseError)
+	if !ok || parseError.Line != 4 || parseError.Offset != strings.Index(msg, "CSeq") {
+		t.Fatalf("bad parse error %v", err)
+	}
+
+	uri := &SipUri{User: "user"}
+	if uri.ToString() != "sip:user@" {
+		t.Fatalf("ToString should not panic with empty host")
+	}
+}
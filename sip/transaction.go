@@ -3,17 +3,24 @@ package sip
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
+	//RFC 3261 附录A 定时器的默认值, 单位毫秒
 	T1 = 500
 	T2 = 4000
 	T4 = 5000
+	//TimerD INVITE客户端事务在不可靠传输上等待重传应答的时间, 单位毫秒
+	TimerD = 32000
 
 	inviteClientStateCalling    = 1
 	inviteClientStateProceeding = 2
 	inviteClientStateCompleted  = 3
 	inviteClientStateTerminated = 4
+	//RFC 6026 收到2xx后进入Accepted状态, 接收分叉的2xx, Timer M超时后终止
+	inviteClientStateAccepted = 5
 
 	unInviteClientStateTrying     = 1
 	unInviteClientStateProceeding = 2
@@ -24,6 +31,8 @@ const (
 	inviteServerStateCompleted  = 2
 	inviteServerStateConfirmed  = 3
 	inviteServerStateTerminated = 4
+	//RFC 6026 发送2xx后进入Accepted状态, 吸收重传的INVITE, Timer L超时后终止
+	inviteServerStateAccepted = 5
 
 	unInviteServerStateTrying     = 1
 	unInviteServerStateProceeding = 2
@@ -31,6 +40,39 @@ const (
 	unInviteServerStateTerminated = 4
 )
 
+// Timers 事务定时器的基础值, 为0的字段使用默认值
+type Timers struct {
+	T1     time.Duration //RTT估计值
+	T2     time.Duration //非INVITE请求和INVITE应答的最大重传间隔
+	T4     time.Duration //消息在网络中的最大存活时间
+	TimerD time.Duration //INVITE客户端事务在不可靠传输上等待重传应答的时间
+}
+
+// DefaultTimers RFC 3261 附录A 的默认值
+var DefaultTimers = Timers{
+	T1:     T1 * time.Millisecond,
+	T2:     T2 * time.Millisecond,
+	T4:     T4 * time.Millisecond,
+	TimerD: TimerD * time.Millisecond,
+}
+
+// merge 为0的字段使用defaults中的值
+func (t Timers) merge(defaults Timers) Timers {
+	if t.T1 <= 0 {
+		t.T1 = defaults.T1
+	}
+	if t.T2 <= 0 {
+		t.T2 = defaults.T2
+	}
+	if t.T4 <= 0 {
+		t.T4 = defaults.T4
+	}
+	if t.TimerD <= 0 {
+		t.TimerD = defaults.TimerD
+	}
+	return t
+}
+
 type Transaction interface {
 	retransmit() bool // if return false, continue retransmit
 	timeout()
@@ -61,6 +103,7 @@ type transaction struct {
 	txTimeout                chan bool
 	//txTerminated             chan bool
 	dialog *Dialog
+	timers Timers
 }
 
 func (t *transaction) GetOriginalRequest() *Request {
@@ -71,6 +114,12 @@ func (t *transaction) GetDialog() *Dialog {
 	return t.dialog
 }
 
+func (t *transaction) setTimers(timers Timers) {
+	t.timers = timers
+	t.stateMachine.setTimers(&t.timers)
+	t.stateMachine.setTimerService(t.sipStack.timerService())
+}
+
 func sendMessage(conn net.Conn, data []byte, transaction Transaction) error {
 	_, err := conn.Write(data)
 	if err != nil {
@@ -84,14 +133,20 @@ type IStateMachine interface {
 	stopTimer()
 	getState() int
 	setState(state int)
+	setTcp(tcp bool)
+	setTimers(timers *Timers)
+	setTimerService(service TimerService)
 
 	setTransaction(transaction Transaction)
 }
 
 type StateMachine struct {
-	state       int
+	//state 事务状态, 收到消息的协程和定时器、发送请求的协程同时访问
+	state       int32
 	isTcp       bool
 	transaction Transaction
+	timers      *Timers
+	service     TimerService
 }
 
 func (s *StateMachine) setTransaction(transaction Transaction) {
@@ -99,7 +154,23 @@ func (s *StateMachine) setTransaction(transaction Transaction) {
 }
 
 func (s *StateMachine) getState() int {
-	return s.state
+	return int(atomic.LoadInt32(&s.state))
+}
+
+func (s *StateMachine) storeState(state int) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
+func (s *StateMachine) setTcp(tcp bool) {
+	s.isTcp = tcp
+}
+
+func (s *StateMachine) setTimers(timers *Timers) {
+	s.timers = timers
+}
+
+func (s *StateMachine) setTimerService(service TimerService) {
+	s.service = service
 }
 
 type InviteClientStateMachine struct {
@@ -107,18 +178,19 @@ type InviteClientStateMachine struct {
 	timerA *timerA
 	timerB *timerB
 	timerD *timerD
+	timerM *timerM
 }
 
 func (ic *InviteClientStateMachine) setState(state int) {
-	ic.state = state
+	ic.storeState(state)
 
 	if state == inviteClientStateCalling {
 		if !ic.isTcp {
 			ic.timerA = &timerA{}
-			ic.timerA.start(ic.transaction.retransmit)
+			ic.timerA.start(ic.service, ic.timers, ic.transaction.retransmit)
 		}
 		ic.timerB = &timerB{}
-		ic.timerB.start(ic.transaction.timeout)
+		ic.timerB.start(ic.service, ic.timers, ic.transaction.timeout)
 
 	} else if state == inviteClientStateProceeding {
 		if ic.timerA != nil {
@@ -134,8 +206,15 @@ func (ic *InviteClientStateMachine) setState(state int) {
 			ic.transaction.terminated()
 		} else {
 			ic.timerD = &timerD{}
-			ic.timerD.start(ic.transaction.terminated)
+			ic.timerD.start(ic.service, ic.timers, ic.transaction.terminated)
 		}
+	} else if state == inviteClientStateAccepted {
+		if ic.timerA != nil {
+			ic.timerA.stop()
+		}
+		ic.timerB.stop()
+		ic.timerM = &timerM{}
+		ic.timerM.start(ic.service, ic.timers, ic.transaction.terminated)
 	} else if state == inviteClientStateTerminated {
 		ic.stopTimer()
 	}
@@ -151,6 +230,9 @@ func (ic *InviteClientStateMachine) stopTimer() {
 	if ic.timerD != nil {
 		ic.timerD.stop()
 	}
+	if ic.timerM != nil {
+		ic.timerM.stop()
+	}
 }
 
 func (ic *InviteClientStateMachine) start() {
@@ -166,16 +248,16 @@ type UnInviteClientStateMachine struct {
 }
 
 func (ic *UnInviteClientStateMachine) setState2(state int) {
-	ic.state = state
+	ic.storeState(state)
 
 	if unInviteClientStateTrying == state {
 		if !ic.isTcp {
 			ic.timerE = &timerE{}
-			ic.timerE.start(ic.transaction.retransmit)
+			ic.timerE.start(ic.service, ic.timers, ic.transaction.retransmit)
 		}
 
 		ic.timerF = &timerF{}
-		ic.timerF.start(ic.transaction.timeout)
+		ic.timerF.start(ic.service, ic.timers, ic.transaction.timeout)
 	} else if unInviteClientStateProceeding == state {
 		if ic.timerE != nil {
 			ic.timerE.setToT2()
@@ -191,10 +273,11 @@ func (ic *UnInviteClientStateMachine) setState2(state int) {
 		}
 
 		if ic.isTcp {
-			ic.transaction.terminated()
+			//terminated会再次调用setState, 不能在持有锁时同步调用
+			go ic.transaction.terminated()
 		} else {
 			ic.timerK = &timerK{}
-			ic.timerK.start(ic.transaction.terminated)
+			ic.timerK.start(ic.service, ic.timers, ic.transaction.terminated)
 		}
 	} else if unInviteClientStateTerminated == state {
 		ic.stopTimer()
@@ -230,20 +313,21 @@ type InviteServerStateMachine struct {
 	timerG *timerG
 	timerH *timerH
 	timerI *timerI
+	timerL *timerL
 }
 
 func (i *InviteServerStateMachine) setState(state int) {
-	i.state = state
+	i.storeState(state)
 	if inviteServerStateProceeding == state {
 
 	} else if inviteServerStateCompleted == state {
 		if !i.isTcp {
 			//start timer G T1开始 翻倍递增 MIN(2*T1,T2)
 			i.timerG = &timerG{}
-			i.timerG.start(i.transaction.retransmit)
+			i.timerG.start(i.service, i.timers, i.transaction.retransmit)
 		}
 		i.timerH = &timerH{}
-		i.timerH.start(i.transaction.timeout)
+		i.timerH.start(i.service, i.timers, i.transaction.timeout)
 	} else if inviteServerStateConfirmed == state {
 		if i.timerG != nil {
 			i.timerG.stop()
@@ -256,8 +340,11 @@ func (i *InviteServerStateMachine) setState(state int) {
 			i.transaction.terminated()
 		} else {
 			i.timerI = &timerI{}
-			i.timerI.start(i.transaction.terminated)
+			i.timerI.start(i.service, i.timers, i.transaction.terminated)
 		}
+	} else if inviteServerStateAccepted == state {
+		i.timerL = &timerL{}
+		i.timerL.start(i.service, i.timers, i.transaction.terminated)
 	} else if inviteServerStateTerminated == state {
 		i.stopTimer()
 	}
@@ -273,6 +360,9 @@ func (i *InviteServerStateMachine) stopTimer() {
 	if i.timerI != nil {
 		i.timerI.stop()
 	}
+	if i.timerL != nil {
+		i.timerL.stop()
+	}
 }
 
 func (i *InviteServerStateMachine) start() {
@@ -285,7 +375,7 @@ type UnInviteServerStateMachine struct {
 }
 
 func (u *UnInviteServerStateMachine) setState(state int) {
-	u.state = state
+	u.storeState(state)
 	if unInviteServerStateTrying == state {
 
 	} else if unInviteServerStateProceeding == state {
@@ -295,7 +385,7 @@ func (u *UnInviteServerStateMachine) setState(state int) {
 			u.transaction.terminated()
 		} else {
 			u.timerJ = &timerJ{}
-			u.timerJ.start(u.transaction.terminated)
+			u.timerJ.start(u.service, u.timers, u.transaction.terminated)
 		}
 	} else if unInviteServerStateTerminated == state {
 		u.stopTimer()
@@ -2,11 +2,35 @@ package sip
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 )
 
 type ClientTransaction struct {
 	transaction
 	timeoutCtx context.Context
+	//timeoutCancel 事务结束时释放timeoutCtx, 发往下一个目标的事务使用相同的截止时间创建新的timeoutCtx
+	timeoutCancel context.CancelFunc
+	//RFC 3263 当前目标失败后依次尝试的目标
+	targets []*Hop
+
+	cancelMutex   sync.Mutex
+	cancelOnce    sync.Once
+	cancelRequest *Request
+
+	//每个早期对话(To tag)最后确认的RSeq
+	rseqMutex sync.Mutex
+	rseqs     map[string]uint32
+
+	//RFC 3261 13.2.2.4 INVITE分叉后每个To tag对应一个对话
+	forkMutex    sync.Mutex
+	forks        map[string]*Dialog
+	discardForks bool
+
+	//NewClientTransactionWithTimeout指定的定时器, 发往下一个目标时继续使用
+	timersOverride *Timers
+	rtt            rttSample
 }
 
 func isDialogCreated(method string) bool {
@@ -39,6 +63,61 @@ func (t *ClientTransaction) createAck(response *Response) *Request {
 	return request
 }
 
+// createCancel RFC 3261 9.1 CANCEL的Request-URI、Call-ID、From、To、CSeq number和Route与原请求相同, 只包含原请求的第一个Via
+func (t *ClientTransaction) createCancel() *Request {
+	requestLine := t.originalRequest.GetRequestLine()
+
+	request := NewRequest()
+	request.line = &RequestLine{CANCEL, requestLine.RequestUri.Clone(), SipVersion}
+	request.SetHeader(t.originalRequest.Via().Clone())
+	request.SetHeader(t.originalRequest.From().Clone())
+	request.SetHeader(t.originalRequest.To().Clone())
+	request.SetHeader(t.originalRequest.CallID().Clone())
+	request.SetHeader(&CSeq{Number: t.originalRequest.CSeq().Number, Method: CANCEL})
+	for _, route := range t.originalRequest.GetHeader(RouteName) {
+		request.AppendHeader(route.Clone())
+	}
+	request.SetHeader(defaultMaxForwardsHeader.Clone())
+	request.SetHeader(defaultContentLengthHeader.Clone())
+	if agent := t.originalRequest.UserAgent(); agent != nil {
+		request.SetHeader(agent.Clone())
+	}
+
+	return request
+}
+
+// Cancel 取消还没有收到最终应答的INVITE请求. 收到临时应答之前调用, CANCEL会在收到临时应答后发送.
+// INVITE的结果(通常是487)仍然通过原请求的回调返回
+func (t *ClientTransaction) Cancel() error {
+	if !t.isInvite {
+		return fmt.Errorf("only the INVITE request can be cancelled")
+	}
+
+	t.cancelMutex.Lock()
+	defer t.cancelMutex.Unlock()
+	if t.cancelRequest != nil {
+		return fmt.Errorf("the INVITE request has been cancelled")
+	}
+
+	state := t.stateMachine.getState()
+	if state >= inviteClientStateCompleted {
+		return fmt.Errorf("the INVITE request has received a final response")
+	}
+
+	t.cancelRequest = t.createCancel()
+	if state == inviteClientStateProceeding {
+		go t.sendCancel()
+	}
+	return nil
+}
+
+func (t *ClientTransaction) sendCancel() {
+	t.cancelOnce.Do(func() {
+		transaction := t.listeningPoint.newClientTransaction(t.cancelRequest, t.hop, nil, time.Time{})
+		transaction.Execute()
+	})
+}
+
 func (t *ClientTransaction) emit(response *Response, dialog *Dialog) {
 	//if response.GetStatusCode() < 200 {
 	//	t.provisionalResponse = response
@@ -49,6 +128,7 @@ func (t *ClientTransaction) emit(response *Response, dialog *Dialog) {
 }
 
 func (t *ClientTransaction) processResponse(response *Response) {
+	t.sampleRTT()
 	code := response.GetStatusCode()
 	toHeader := response.To()
 	state := t.stateMachine.getState()
@@ -64,10 +144,23 @@ func (t *ClientTransaction) processResponse(response *Response) {
 				return
 			}
 		}
-		if dialog, _ = t.sipStack.findDialog(id); dialog == nil {
+		//已经结束的分叉对话, 重传的2xx只需要重发ACK
+		if dialog, _ = t.sipStack.findDialog(id); dialog == nil && t.isInvite {
+			dialog = t.findFork(toHeader.Tag)
+		}
+		//没有Contact的临时应答不能建立早期对话
+		if dialog == nil && response.Contact() != nil {
 			dialog = createDialog(t.sipStack, t.listeningPoint, t.originalRequest, response, false)
-			t.dialog = dialog
+			if t.dialog == nil || t.dialog.state != dialogStateConfirmed {
+				t.dialog = dialog
+			}
 			t.sipStack.addDialog(id, dialog)
+		} else if dialog != nil && code >= 200 && dialog.state == dialogStateEarly {
+			//早期对话的route set以2xx应答为准
+			dialog.routeSet = createRouteSet(response, false)
+		}
+		if dialog != nil && t.isInvite {
+			t.addFork(toHeader.Tag, dialog)
 		}
 	} else if code == CallTransactionDoesNotExist {
 		if removeDialog := t.sipStack.removeDialog(response.GetDialogId(false)); removeDialog != nil {
@@ -77,29 +170,48 @@ func (t *ClientTransaction) processResponse(response *Response) {
 
 	if t.isInvite {
 		if code < 200 && state <= inviteClientStateProceeding {
+			//重传的可靠临时应答不通知TU
+			if !t.acknowledgeReliable(response, dialog) {
+				return
+			}
 			t.stateMachine.setState(inviteClientStateProceeding)
 			if dialog != nil {
 				//create early Dialog
 				dialog.state = dialogStateEarly
 			}
+			//收到临时应答之后才能发送CANCEL
+			t.cancelMutex.Lock()
+			if t.cancelRequest != nil {
+				go t.sendCancel()
+			}
+			t.cancelMutex.Unlock()
 			t.emit(response, dialog)
 		} else if code >= 300 {
 			if state <= inviteClientStateProceeding {
 				t.stateMachine.setState(inviteClientStateCompleted)
-				t.sipStack.removeDialog(response.GetDialogId(false))
+				//re-INVITE失败不影响已经确认的对话
+				id := response.GetDialogId(false)
+				if d, _ := t.sipStack.findDialog(id); d == nil || d.state != dialogStateConfirmed {
+					t.sipStack.removeDialog(id)
+				}
+				t.terminateEarlyForks()
 				t.responseEvent <- &ResponseEvent{response, nil, t}
 			}
 			//非2XX应答，事务还包含一个ACK请求，每一个重发的响应后发送ACK
 			//2XX应答，ACK是一个单独的事务，由TU自己发
 			ack := t.createAck(response)
 			sendMessage(t.conn, ack.ToBytes(), t)
-		} else if code/2 == 100 && state <= inviteClientStateProceeding {
-			t.stateMachine.setState(inviteClientStateTerminated)
+		} else if code >= 200 && state <= inviteClientStateProceeding {
+			t.stateMachine.setState(inviteClientStateAccepted)
 			if dialog != nil {
+				t.dialog = dialog
 				dialog.state = dialogStateConfirmed
+				dialog.updateSessionTimer(response)
 			}
 
 			t.emit(response, dialog)
+		} else if code >= 200 && state == inviteClientStateAccepted {
+			t.processForkedResponse(response, dialog)
 		}
 	} else {
 
@@ -111,6 +223,12 @@ func (t *ClientTransaction) processResponse(response *Response) {
 			t.emit(response, dialog)
 		} else if code >= 200 && (state <= unInviteClientStateProceeding) {
 			t.stateMachine.setState(unInviteClientStateCompleted)
+			//UPDATE的2xx刷新会话定时器
+			if UPDATE == cSeqHeader.Method && code/100 == 2 {
+				if d, _ := t.sipStack.findDialog(response.GetDialogId(false)); d != nil {
+					d.updateSessionTimer(response)
+				}
+			}
 			t.emit(response, dialog)
 		}
 	}
@@ -119,6 +237,7 @@ func (t *ClientTransaction) processResponse(response *Response) {
 func (t *ClientTransaction) retransmit() bool {
 	if (t.isInvite && t.stateMachine.getState() == inviteClientStateCalling) ||
 		(!t.isInvite && t.stateMachine.getState() <= unInviteClientStateProceeding) {
+		t.rtt.retransmit()
 		return sendMessage(t.conn, t.originalRequestBytes, t) != nil
 	}
 
@@ -132,6 +251,12 @@ func (t *ClientTransaction) ioException(err error) {
 
 func (t *ClientTransaction) terminated() {
 	t.sipStack.removeTransaction(t.id, false)
+	if t.isInvite {
+		t.terminateEarlyForks()
+	}
+	if t.timeoutCancel != nil {
+		t.timeoutCancel()
+	}
 	//t.txTerminated <- true
 	if t.isInvite {
 		t.stateMachine.setState(inviteClientStateTerminated)
@@ -145,11 +270,15 @@ func (t *ClientTransaction) timeout() {
 	t.terminated()
 }
 
+// Execute 同步发送请求, 返回最终应答. 临时应答在其他协程中回调, 忽略它们,
+// 避免和最终应答竞争evt
 func (t *ClientTransaction) Execute() (response *ResponseEvent, err error) {
 	var evt *ResponseEvent
 	var e error
 	t.SendRequest(func(event *ResponseEvent) {
-		evt = event
+		if event.Response.GetStatusCode() >= 200 {
+			evt = event
+		}
 	}, func(err *UACError) {
 		e = err
 	})
@@ -157,32 +286,107 @@ func (t *ClientTransaction) Execute() (response *ResponseEvent, err error) {
 	return evt, e
 }
 
+// switchToTCP 请求过大改用TCP发送, 重写Via. 连接失败返回false, 继续使用UDP
+func (t *ClientTransaction) switchToTCP(tcp *ListeningPoint) bool {
+	hop := &Hop{IP: t.hop.IP, Port: t.hop.Port, Transport: TCP, Host: t.hop.Host}
+	conn, err := tcp.getConn(hop)
+	if err != nil {
+		return false
+	}
+
+	t.originalRequest.SetHeader(tcp.createViaHeaderWithBranch(t.originalRequest.Via().branch))
+	t.originalRequestBytes = t.originalRequest.ToBytes()
+	t.listeningPoint = tcp
+	t.hop = hop
+	t.conn = conn
+	t.stateMachine.setTcp(true)
+	return true
+}
+
+// failover RFC 3263 4.3 当前目标传输失败、超时或者响应503时, 使用新的事务发往下一个目标.
+// 没有可用的目标返回false
+func (t *ClientTransaction) failover(onSuccess OnSuccess, onFailure OnFailure) bool {
+	if deadline := t.deadline(); !deadline.IsZero() && !time.Now().Before(deadline) {
+		return false
+	}
+
+	for i, hop := range t.targets {
+		listen := t.sipStack.findListeningPoint(hop.Transport, t.listeningPoint.IP)
+		if listen == nil {
+			continue
+		}
+
+		//新的目标是新的事务, 使用新的branch
+		request := t.originalRequest.shallowClone()
+		request.SetHeader(listen.createViaHeaderWithBranch(generateBranchId()))
+		next := listen.newClientTransaction(request, hop, t.targets[i+1:], t.deadline())
+		next.overrideTimers(t.timersOverride)
+		t.targets = nil
+		next.SendRequest(onSuccess, onFailure)
+		return true
+	}
+
+	return false
+}
+
+// retryFinalResponse 最终应答可以由新的事务重试时返回true, 结果通过新的事务回调
+func (t *ClientTransaction) retryFinalResponse(response *Response, onSuccess OnSuccess, onFailure OnFailure) bool {
+	switch response.GetStatusCode() {
+	case ServiceUnavailable:
+		return t.failover(onSuccess, onFailure)
+	case SessionIntervalTooSmall:
+		return t.retryWithMinSE(response, onSuccess, onFailure)
+	}
+	return false
+}
+
+// deadline 请求的截止时间, 没有设置超时时间时为0
+func (t *ClientTransaction) deadline() time.Time {
+	if t.timeoutCtx == nil {
+		return time.Time{}
+	}
+	deadline, _ := t.timeoutCtx.Deadline()
+	return deadline
+}
+
 func (t *ClientTransaction) SendRequest(onSuccess OnSuccess, onFailure OnFailure) {
 	if isDialogCreated(t.originalRequest.cSeq.Method) && t.originalRequest.Contact() == nil && t.listeningPoint.contact != nil {
 		t.originalRequest.SetHeader(t.listeningPoint.contact)
 	}
+	if t.isInvite && t.sipStack.Options.Enable100rel && !hasOptionTag(t.originalRequest, OptionTag100rel, SupportedName, SupportedShortName, RequireName) {
+		t.originalRequest.AppendHeader(&StrHeader{n: SupportedName, v: OptionTag100rel})
+	}
+	if isSessionRefresh(t.originalRequest.cSeq.Method) {
+		t.sipStack.addSessionTimer(t.originalRequest)
+	}
 	if err := t.originalRequest.CheckHeaders(); err != nil {
 		panic(err)
 	}
 
-	//通讯层发送消息
 	//启动状态机
-	conn, err := t.listeningPoint.getConn(t.hop)
-	if conn != nil {
-		t.conn = conn
-		t.originalRequestBytes = t.originalRequest.ToBytes()
+	//通讯层发送消息. 应答可能在发送返回之前到达, 状态机必须先启动
+	var err error
+	t.originalRequestBytes = t.originalRequest.ToBytes()
+	if tcp := t.listeningPoint.tcpForLargeRequest(len(t.originalRequestBytes)); tcp == nil || !t.switchToTCP(tcp) {
+		t.conn, err = t.listeningPoint.getConn(t.hop)
+	}
+	if err == nil {
+		t.stateMachine.start()
+		t.rtt.sent(t.sipStack.timerService().Now())
 		err = sendMessage(t.conn, t.originalRequestBytes, t)
 	}
 
 	if err != nil {
 		t.terminated()
+		if t.failover(onSuccess, onFailure) {
+			return
+		}
 		if onFailure != nil {
 			onFailure(newUACIOExceptionError(err))
 		}
 		return
 	}
 
-	t.stateMachine.start()
 	if onSuccess != nil || onFailure != nil {
 
 		var wait func()
@@ -196,15 +400,22 @@ func (t *ClientTransaction) SendRequest(onSuccess OnSuccess, onFailure OnFailure
 						if responseEvt.Response.GetStatusCode() < 200 {
 							go onSuccess(responseEvt)
 						} else {
-							onSuccess(responseEvt)
+							//503 RFC 3263 4.3 尝试下一个目标, 422 使用对端的Min-SE重试
+							if !t.retryFinalResponse(responseEvt.Response, onSuccess, onFailure) {
+								onSuccess(responseEvt)
+							}
 							return
 						}
 						break
 					case exception := <-t.ioError:
-						onFailure(newUACIOExceptionError(exception))
+						if !t.failover(onSuccess, onFailure) {
+							onFailure(newUACIOExceptionError(exception))
+						}
 						return
 					case <-t.txTimeout:
-						onFailure(newClientTransactionTimeoutError())
+						if !t.failover(onSuccess, onFailure) {
+							onFailure(newClientTransactionTimeoutError())
+						}
 						return
 					}
 				}
@@ -212,23 +423,34 @@ func (t *ClientTransaction) SendRequest(onSuccess OnSuccess, onFailure OnFailure
 
 		} else {
 			wait = func() {
+				done := t.timeoutCtx.Done()
 				for {
 					select {
 					case responseEvt := <-t.responseEvent:
-						//如果是临时响应,说明有多个响应包 才用协程回调
+						//如果是临时响应,说明有多个响应包 才用协程回调. 继续等待最终应答, CANCEL之后的487也通过这里返回
 						if responseEvt.Response.GetStatusCode() < 200 {
 							go onSuccess(responseEvt)
-						} else {
+							break
+						} else if !t.retryFinalResponse(responseEvt.Response, onSuccess, onFailure) {
 							onSuccess(responseEvt)
 						}
 						return
 					case exception := <-t.ioError:
-						onFailure(newUACIOExceptionError(exception))
+						if !t.failover(onSuccess, onFailure) {
+							onFailure(newUACIOExceptionError(exception))
+						}
 						return
 					case <-t.txTimeout:
-						onFailure(newClientTransactionTimeoutError())
+						if !t.failover(onSuccess, onFailure) {
+							onFailure(newClientTransactionTimeoutError())
+						}
 						return
-					case <-t.timeoutCtx.Done():
+					case <-done:
+						//事务结束时取消的timeoutCtx, 结果通过其他通道返回
+						if t.timeoutCtx.Err() != context.DeadlineExceeded {
+							done = nil
+							break
+						}
 						t.terminated()
 						onFailure(newRequestTimeoutExceptionError())
 						return
@@ -2,10 +2,61 @@ package sip
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
 type ServerTransaction struct {
 	transaction
+	reliable *reliableProvisional
+	//sessionModification 为1时UPDATE/re-INVITE 已经在对话中开始会话修改, 最终应答或者事务结束后结束
+	sessionModification int32
+	//trying 自动发送100 Trying的定时器, 发送期间持有tryingMutex, 避免覆盖TU的临时应答
+	tryingMutex sync.Mutex
+	trying      TimerHandle
+	//mergedKey 用于检测合并请求的键, 事务结束时删除
+	mergedKey string
+}
+
+// startTrying RFC 3261 17.2.1 TU在TryingDelay内没有应答INVITE时, 由事务发送100 Trying
+func (t *ServerTransaction) startTrying() {
+	if t.sipStack.Options.TryingDelay < 0 {
+		return
+	}
+
+	t.tryingMutex.Lock()
+	defer t.tryingMutex.Unlock()
+	t.trying = t.sipStack.timerService().AfterFunc(t.sipStack.Options.TryingDelay, t.sendTrying)
+}
+
+func (t *ServerTransaction) stopTrying() {
+	t.tryingMutex.Lock()
+	defer t.tryingMutex.Unlock()
+	if t.trying != nil {
+		t.trying.Stop()
+		t.trying = nil
+	}
+}
+
+// sendTrying TU已经应答或者事务离开Proceeding状态时不发送
+func (t *ServerTransaction) sendTrying() {
+	t.tryingMutex.Lock()
+	defer t.tryingMutex.Unlock()
+	if t.trying == nil {
+		return
+	}
+	t.trying.Stop()
+	t.trying = nil
+	if t.provisionalResponse != nil || inviteServerStateProceeding != t.stateMachine.getState() {
+		return
+	}
+
+	response := t.originalRequest.CreateResponse(Trying)
+	//RFC 3261 8.2.6.1 100应答需要携带请求的Timestamp
+	if timestamp := t.originalRequest.GetHeader(TimestampName); timestamp != nil {
+		response.SetHeader(timestamp[0].Clone())
+	}
+	t.sendProvisionalResponse(response)
 }
 
 func (t *ServerTransaction) sendProvisionalResponse(response *Response) {
@@ -15,6 +66,9 @@ func (t *ServerTransaction) sendProvisionalResponse(response *Response) {
 }
 
 func (t *ServerTransaction) SendResponse(response *Response) {
+	if t.isInvite {
+		t.stopTrying()
+	}
 	if isDialogCreated(response.cSeq.Method) && response.Contact() == nil && t.listeningPoint.contact != nil {
 		response.SetHeader(t.listeningPoint.contact)
 	}
@@ -24,6 +78,19 @@ func (t *ServerTransaction) SendResponse(response *Response) {
 
 	cSeqHeader := response.CSeq()
 	toHeader := response.To()
+	//可靠临时应答会建立早期对话
+	reliable := t.isReliableProvisional(response)
+	if reliable && toHeader.Tag == "" {
+		toHeader.Tag = GenerateTag()
+	}
+	if response.GetStatusCode() >= 200 && t.holdFinalResponse(response) {
+		return
+	}
+	//TU应答了对端的UPDATE/re-INVITE, 允许新的会话修改
+	if response.GetStatusCode() >= 200 {
+		t.endSessionModification()
+	}
+
 	var dialog *Dialog
 	if toHeader.Tag != "" && isDialogCreated(cSeqHeader.Method) {
 		if response.GetStatusCode() > 100 && response.GetStatusCode() < 300 {
@@ -36,10 +103,23 @@ func (t *ServerTransaction) SendResponse(response *Response) {
 		}
 	}
 
+	//INVITE/UPDATE的2xx协商会话定时器
+	if response.GetStatusCode()/100 == 2 && isSessionRefresh(cSeqHeader.Method) {
+		if dialog == nil {
+			dialog = t.dialog
+		}
+		if dialog != nil {
+			t.negotiateSessionTimer(response, dialog)
+			dialog.setLocalContent(response.ContentType(), response.Content())
+		}
+	}
+
 	if response.GetStatusCode() < 200 {
 		if !t.isInvite && unInviteServerStateTrying == t.stateMachine.getState() {
 			t.stateMachine.setState(unInviteServerStateProceeding)
 			t.sendProvisionalResponse(response)
+		} else if reliable && inviteServerStateProceeding == t.stateMachine.getState() {
+			t.sendReliableProvisional(response, dialog)
 		} else if t.isInvite && inviteServerStateProceeding == t.stateMachine.getState() {
 			//They are not sent reliably by the transaction layer (they are not retransmitted by it) and do not cause a change in the state of the server transaction.
 			//TU可以发送任意数量的临时应答，并且不会改变状态
@@ -60,8 +140,11 @@ func (t *ServerTransaction) SendResponse(response *Response) {
 			if contactHeader == nil {
 				panic("Contact StrHeader is mandatory for the OK to the INVITE")
 			}
-			dialog.state = dialogStateConfirmed
-			t.stateMachine.setState(inviteServerStateTerminated)
+			if dialog != nil {
+				dialog.state = dialogStateConfirmed
+				dialog.waitAck(response.CSeq().Number, t.finalResponseBytes, t.conn, isReliable(response.Via().transport), &t.timers)
+			}
+			t.stateMachine.setState(inviteServerStateAccepted)
 		}
 
 	} else if response.GetStatusCode() < 700 {
@@ -74,8 +157,10 @@ func (t *ServerTransaction) SendResponse(response *Response) {
 		if !t.isInvite {
 			t.stateMachine.setState(unInviteServerStateCompleted)
 		} else if inviteServerStateProceeding == t.stateMachine.getState() {
+			//re-INVITE失败不影响已经确认的对话
 			dialogId := response.GetDialogId(true)
-			if dialog = t.sipStack.removeDialog(dialogId); dialog != nil {
+			if dialog, _ = t.sipStack.findDialog(dialogId); dialog != nil && dialog.state != dialogStateConfirmed {
+				t.sipStack.removeDialog(dialogId)
 				dialog.state = dialogStateTerminated
 			}
 			//非2xx应答，事务还包含一个ACK请求 等待ACK
@@ -98,6 +183,17 @@ func (t *ServerTransaction) ioException(err error) {
 
 func (t *ServerTransaction) terminated() {
 	t.sipStack.removeTransaction(t.id, true)
+	t.removeMergedRequest()
+	//TU没有应答或者发送失败, 不能让对话一直拒绝新的会话修改
+	t.endSessionModification()
+	if t.isInvite {
+		t.stopTrying()
+	}
+	if t.reliable != nil {
+		t.reliable.mutex.Lock()
+		t.reliable.stopTimer()
+		t.reliable.mutex.Unlock()
+	}
 	if t.isInvite {
 		t.stateMachine.setState(inviteServerStateTerminated)
 	} else {
@@ -105,6 +201,17 @@ func (t *ServerTransaction) terminated() {
 	}
 }
 
+func (t *ServerTransaction) startSessionModification() {
+	atomic.StoreInt32(&t.sessionModification, 1)
+}
+
+// endSessionModification 最终应答和事务结束都会调用, 只结束一次
+func (t *ServerTransaction) endSessionModification() {
+	if atomic.CompareAndSwapInt32(&t.sessionModification, 1, 0) {
+		t.dialog.endIncoming()
+	}
+}
+
 func (t *ServerTransaction) timeout() {
 	t.txTimeout <- true
 	t.terminated()
@@ -112,7 +219,7 @@ func (t *ServerTransaction) timeout() {
 
 func (t *ServerTransaction) filterDialog(request *Request, dialog *Dialog) error {
 	switch request.GetRequestMethod() {
-	case ACK, BYE, INFO, NOTIFY:
+	case ACK, BYE, INFO, NOTIFY, PRACK, UPDATE:
 		if dialog == nil {
 			//send 481 Call transaction Does Not Exist
 			if ACK != request.GetRequestMethod() {
@@ -126,9 +233,19 @@ func (t *ServerTransaction) filterDialog(request *Request, dialog *Dialog) error
 	}
 
 	if dialog != nil {
+		//安全的Dialog不允许降级到非TLS/WSS传输
+		if dialog.secure && !isSecure(request.GetTransport()) {
+			if ACK != request.GetRequestMethod() {
+				response := request.CreateResponse(Forbidden)
+				t.SendResponse(response)
+			}
+
+			return fmt.Errorf("the secure dialog cannot be downgraded to %s", request.GetTransport())
+		}
+
 		if BYE == request.GetRequestMethod() {
 			t.sipStack.removeDialog(request.GetDialogId(true))
-			dialog.state = dialogStateTerminated
+			dialog.Terminated()
 		}
 
 		cSeqHeader := request.CSeq()
@@ -149,37 +266,131 @@ func (t *ServerTransaction) filterDialog(request *Request, dialog *Dialog) error
 	return nil
 }
 
+// processCancel RFC 3261 9.2 CANCEL和INVITE的branch相同(RFC 2543使用17.2.3的字段), 找到INVITE事务.
+// 对CANCEL响应200, INVITE还没有最终应答时响应487, 并通知TU
+func (t *ServerTransaction) processCancel(request *Request) {
+	find, _ := t.sipStack.findTransaction(request.inviteTransactionId(), true)
+	invite, ok := find.(*ServerTransaction)
+	if !ok || !invite.isInvite {
+		t.SendResponse(request.CreateResponse(CallTransactionDoesNotExist))
+		return
+	}
+
+	t.SendResponse(request.CreateResponse(OK))
+	if inviteServerStateProceeding != invite.stateMachine.getState() {
+		return
+	}
+
+	response := invite.originalRequest.CreateResponse(RequestTerminated)
+	//使用临时应答中的To tag
+	if invite.provisionalResponse != nil {
+		response.SetHeader(invite.provisionalResponse.To().Clone())
+	} else if response.To().Tag == "" {
+		to := response.To().Clone().(*To)
+		to.Tag = GenerateTag()
+		response.SetHeader(to)
+	}
+	invite.SendResponse(response)
+
+	if listener, ok := t.sipStack.EventListener.(CancelListener); ok {
+		go listener.OnCancel(&CancelEvent{request, invite})
+	}
+}
+
+// processReInvite RFC 3261 14.2 对话内的INVITE. 对话不存在响应481,
+// 存在未完成的会话修改时响应491/500, 否则刷新remote target并通知TU
+func (t *ServerTransaction) processReInvite(request *Request) {
+	d, _ := t.sipStack.findDialog(request.GetDialogId(true))
+	if d == nil {
+		t.SendResponse(request.CreateResponse(CallTransactionDoesNotExist))
+		return
+	} else if err := t.filterDialog(request, d); err != nil {
+		return
+	} else if !t.checkSessionInterval(request) {
+		return
+	} else if code := d.beginIncoming(); code != 0 {
+		t.SendResponse(rejectIncoming(request, code))
+		return
+	}
+
+	t.dialog = d
+	t.startSessionModification()
+	d.refreshTarget(request)
+	go t.sipStack.EventListener.OnRequest(&RequestEvent{request, d, t})
+}
+
 func (t *ServerTransaction) processRequest(request *Request) {
 	if t.isInvite {
 		if inviteServerStateProceeding > t.stateMachine.getState() {
 			t.stateMachine.setState(inviteServerStateProceeding)
-			//re-Invite
-			//if dialog, _ := t.sipStack.findDialog(request.GetDialogId(true)); dialog != nil {
-			//	if header := request.GetHeader(ContactName); header != nil {
-			//		header.(*Contact).Address.Uri
-			//	}
-			//}
-			go t.sipStack.EventListener.OnRequest(&RequestEvent{request, nil, t})
+			if !t.checkLoop(request) {
+				return
+			}
+			t.startTrying()
+			if request.To().Tag == "" {
+				if !t.checkSessionInterval(request) {
+					return
+				}
+				go t.sipStack.EventListener.OnRequest(&RequestEvent{request, nil, t})
+			} else {
+				t.processReInvite(request)
+			}
 		} else if inviteServerStateProceeding == t.stateMachine.getState() && t.provisionalResponseBytes != nil {
 			//If a Request retransmission is received while in the "Proceeding" state, the most recent provisional responseEvent that was received from the TU MUST be passed to the transport layer for retransmission.
 			sendMessage(t.conn, t.provisionalResponseBytes, t)
+		} else if inviteServerStateProceeding == t.stateMachine.getState() && request.GetRequestMethod() == INVITE {
+			//TU还没有应答, 对端已经在重传, 立即发送100 Trying
+			t.sendTrying()
+		} else if inviteServerStateAccepted == t.stateMachine.getState() {
+			//RFC 6026 吸收重传的INVITE, 2xx由对话重传. 使用INVITE的branch的ACK交给对话
+			if request.GetRequestMethod() == ACK {
+				t.sipStack.processAck(request)
+			}
 		} else if inviteServerStateCompleted == t.stateMachine.getState() {
 			//非2XX应答的ACK请求
 			if request.GetRequestMethod() == ACK {
-				t.stateMachine.setState(inviteServerStateConfirmed)
-				go t.sipStack.EventListener.OnRequest(&RequestEvent{request, nil, t})
+				if t.matchLegacyAck(request) {
+					t.stateMachine.setState(inviteServerStateConfirmed)
+					go t.sipStack.EventListener.OnRequest(&RequestEvent{request, nil, t})
+				}
 			} else if t.finalResponseBytes != nil {
 				sendMessage(t.conn, t.finalResponseBytes, t)
 			}
 		}
+	} else if CANCEL == request.GetRequestMethod() {
+		if unInviteServerStateTrying > t.stateMachine.getState() {
+			t.stateMachine.setState(unInviteServerStateTrying)
+			t.processCancel(request)
+		} else if t.finalResponseBytes != nil {
+			sendMessage(t.conn, t.finalResponseBytes, t)
+		}
+	} else if unInviteServerStateTrying > t.stateMachine.getState() && !t.checkLoop(request) {
+		//已经响应483/482
+		return
 	} else {
 		d, _ := t.sipStack.findDialog(request.GetDialogId(true))
 		if err := t.filterDialog(request, d); err != nil {
 			return
 		}
 
-		if unInviteServerStateTrying > t.stateMachine.getState() {
+		if unInviteServerStateTrying > t.stateMachine.getState() && PRACK == request.GetRequestMethod() {
+			t.stateMachine.setState(unInviteServerStateTrying)
+			t.processPrack(request, d)
+		} else if unInviteServerStateTrying > t.stateMachine.getState() {
 			t.stateMachine.setState(unInviteServerStateTrying)
+			t.dialog = d
+			if UPDATE == request.GetRequestMethod() {
+				if !t.checkSessionInterval(request) {
+					return
+				}
+				if code := d.beginIncoming(); code != 0 {
+					t.SendResponse(rejectIncoming(request, code))
+					return
+				}
+				t.startSessionModification()
+				d.refreshTarget(request)
+			}
+
 			go t.sipStack.EventListener.OnRequest(&RequestEvent{request, d, t})
 		} else if unInviteServerStateProceeding == t.stateMachine.getState() && t.provisionalResponseBytes != nil {
 			sendMessage(t.conn, t.provisionalResponseBytes, t)
@@ -2,30 +2,56 @@ package sip
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"runtime"
 	"strings"
-	"syscall"
 )
 
+const maxUDPPacketSize = 64 * 1024
+
 var (
 	UDP = "UDP"
 	TCP = "TCP"
+	TLS = "TLS"
+	WS  = "WS"
+	WSS = "WSS"
 )
 
+// isReliable 面向连接的传输层(TCP/TLS/WS/WSS)不需要事务层重传
+func isReliable(transport string) bool {
+	switch strings.ToUpper(transport) {
+	case TCP, TLS, WS, WSS:
+		return true
+	default:
+		return false
+	}
+}
+
+// isSecure TLS和WSS(RFC 7118)满足sips URI的要求
+func isSecure(transport string) bool {
+	switch strings.ToUpper(transport) {
+	case TLS, WSS:
+		return true
+	default:
+		return false
+	}
+}
+
 type transportHandler interface {
 	onConnect(conn net.Conn)
 	onDisconnect(conn net.Conn)
 	onPacket(con net.Conn, isTCP bool, data []byte, length int)
 }
 
-func reusePortControl(network, address string, c syscall.RawConn) error {
-	return c.Control(func(fd uintptr) {
-		if runtime.GOOS != "darwin" {
-			syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, 0x4, 1)
-		}
-	})
+// isIPv6Address IPv6的监听点只接收IPv6, 和同端口的IPv4监听点互不影响
+func isIPv6Address(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return strings.Contains(host, ":")
 }
 
 type ITransport interface {
@@ -58,7 +84,7 @@ type UDPTransport struct {
 
 func (u *UDPTransport) listen(addr string) error {
 	count := runtime.NumCPU()
-	if runtime.GOOS == "darwin" {
+	if !reusePortSupported {
 		count = 1
 	}
 
@@ -83,15 +109,18 @@ func (u *UDPTransport) recv(conn interface{}) {
 	udp := conn.(net.PacketConn)
 	defer udp.Close()
 
+	//每个socket复用一个最大UDP包大小的接收缓冲区, 只为收到的包拷贝实际长度
+	buffer := make([]byte, maxUDPPacketSize)
 	for u.ctx.Err() == nil {
-		p := make([]byte, 1500)
-		count, remote, err := udp.ReadFrom(p)
+		count, remote, err := udp.ReadFrom(buffer)
 		if err != nil {
 			fmt.Printf("udp recv failed: %v\n", err)
 			continue
 		}
 
 		if u.handler != nil {
+			p := make([]byte, count)
+			copy(p, buffer[:count])
 			c := &Conn{PacketConn: udp, local: udp.LocalAddr(), remote: remote}
 			u.handler.onPacket(c, false, p, count)
 		}
@@ -113,14 +142,14 @@ func (t *TCPServer) listen(addr string) error {
 		return err
 	}
 
-	go t.accept(listener.(*net.TCPListener))
+	go t.accept(listener)
 
 	return nil
 }
 
-func (t *TCPServer) accept(listener *net.TCPListener) {
+func (t *TCPServer) accept(listener net.Listener) {
 	for t.ctx.Err() == nil {
-		tcp, err := listener.AcceptTCP()
+		tcp, err := listener.Accept()
 		if err != nil {
 			fmt.Printf("accept tcp connection failed: %v\n", err)
 			continue
@@ -133,7 +162,7 @@ func (t *TCPServer) accept(listener *net.TCPListener) {
 }
 
 func (t *TCPServer) recv(conn interface{}) {
-	tcp := conn.(*net.TCPConn)
+	tcp := conn.(net.Conn)
 	defer func() {
 		if t.handler != nil {
 			t.handler.onDisconnect(tcp)
@@ -141,16 +170,29 @@ func (t *TCPServer) recv(conn interface{}) {
 		tcp.Close()
 	}()
 
+	t.recvStream(tcp)
+}
+
+// recvStream 按照Content-Length从字节流中切分消息, 出现帧错误后关闭连接
+func (t *transport) recvStream(conn net.Conn) {
+	framer := &streamFramer{}
+	p := make([]byte, 16000)
+
 	for t.ctx.Err() == nil {
-		p := make([]byte, 4000)
-		n, err := tcp.Read(p)
+		n, err := conn.Read(p)
 		if err != nil {
 			fmt.Printf("tcp recv failed: %v\n", err)
 			break
 		}
 
-		if t.handler != nil {
-			t.handler.onPacket(tcp, true, p, n)
+		err = framer.feed(p[:n], func(msg []byte) {
+			if t.handler != nil {
+				t.handler.onPacket(conn, true, msg, len(msg))
+			}
+		})
+		if err != nil {
+			fmt.Printf("tcp stream framing failed: %v\n", err)
+			break
 		}
 	}
 }
@@ -170,33 +212,192 @@ func (t *TCPClient) dial(addr string) (net.Conn, error) {
 		t.handler.onConnect(conn)
 	}
 
-	go t.recv(conn.(*net.TCPConn))
+	go t.recv(conn)
 	return conn, nil
 }
 
-func (t *TCPClient) recv(tcp *net.TCPConn) {
+func (t *TCPClient) recv(tcp net.Conn) {
 	defer func() {
 		if t.handler != nil {
 			t.handler.onDisconnect(tcp)
 		}
 		tcp.Close()
 	}()
-	p := make([]byte, 16000)
 
+	t.recvStream(tcp)
+}
+
+// TLSServer 在TCPServer的基础上完成TLS握手, 证书和客户端证书校验由tls.Config配置
+type TLSServer struct {
+	TCPServer
+	config *tls.Config
+}
+
+func (t *TLSServer) listen(addr string) error {
+	if t.config == nil || (len(t.config.Certificates) == 0 && t.config.GetCertificate == nil) {
+		return fmt.Errorf("the TLS listening point must contain a certificate")
+	}
+
+	lc := net.ListenConfig{
+		Control: reusePortControl,
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	listener, err := lc.Listen(t.ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go t.accept(tls.NewListener(listener, t.config))
+
+	return nil
+}
+
+type TLSClient struct {
+	TCPClient
+	config *tls.Config
+}
+
+// clientTLSConfig host用于SNI和证书校验, 如果tls.Config没有指定ServerName并且host是域名, 使用host作为ServerName
+func clientTLSConfig(config *tls.Config, host string) *tls.Config {
+	if config != nil {
+		config = config.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if config.ServerName == "" && net.ParseIP(host) == nil {
+		config.ServerName = host
+	}
+	return config
+}
+
+func (t *TLSClient) dial(host string, addr string) (net.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, clientTLSConfig(t.config, host))
+	if err != nil {
+		return nil, err
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	if t.handler != nil {
+		t.handler.onConnect(conn)
+	}
+
+	go t.recv(conn)
+	return conn, nil
+}
+
+// WSServer RFC 7118 SIP over WebSocket, config不为空时为WSS
+type WSServer struct {
+	transport
+	config *tls.Config
+}
+
+func (t *WSServer) listen(addr string) error {
+	lc := net.ListenConfig{
+		Control: reusePortControl,
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	listener, err := lc.Listen(t.ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if t.config != nil {
+		listener = tls.NewListener(listener, t.config)
+	}
+
+	go t.accept(listener)
+	return nil
+}
+
+func (t *WSServer) accept(listener net.Listener) {
 	for t.ctx.Err() == nil {
-		n, err := tcp.Read(p)
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("tcp recv failed: %v\n", err)
+			fmt.Printf("accept websocket connection failed: %v\n", err)
+			continue
+		}
+
+		go t.upgrade(conn)
+	}
+}
+
+func (t *WSServer) upgrade(conn net.Conn) {
+	ws, err := acceptWebSocket(conn)
+	if err != nil {
+		fmt.Printf("websocket handshake failed: %v\n", err)
+		conn.Close()
+		return
+	}
+
+	if t.handler != nil {
+		t.handler.onConnect(ws)
+	}
+	t.recv(ws)
+}
+
+func (t *WSServer) recv(conn interface{}) {
+	t.recvWebSocket(conn.(*wsConn))
+}
+
+func (t *transport) recvWebSocket(ws *wsConn) {
+	defer func() {
+		if t.handler != nil {
+			t.handler.onDisconnect(ws)
+		}
+		ws.Close()
+	}()
+
+	for t.ctx.Err() == nil {
+		p, err := ws.readMessage()
+		if err != nil {
+			fmt.Printf("websocket recv failed: %v\n", err)
 			break
 		}
 
-		if t.handler.onPacket != nil {
-			t.handler.onPacket(tcp, true, p, n)
+		if t.handler != nil {
+			t.handler.onPacket(ws, true, p, len(p))
 		}
 	}
 }
 
-func createServer(transport string, addr string) (ITransport, error) {
+type WSClient struct {
+	transport
+	config *tls.Config
+}
+
+func (t *WSClient) dial(host string, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if t.config != nil {
+		conn, err = tls.Dial("tcp", addr, clientTLSConfig(t.config, host))
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//Host使用域名, 和TLS校验的名称一致
+	_, port, _ := net.SplitHostPort(addr)
+	ws, err := dialWebSocket(conn, net.JoinHostPort(host, port))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	if t.handler != nil {
+		t.handler.onConnect(ws)
+	}
+
+	go t.recvWebSocket(ws)
+	return ws, nil
+}
+
+func createServer(transport string, addr string, config *tls.Config) (ITransport, error) {
 	var server ITransport
 	switch strings.ToUpper(transport) {
 	case "UDP":
@@ -205,6 +406,18 @@ func createServer(transport string, addr string) (ITransport, error) {
 	case "TCP":
 		server = &TCPServer{}
 		break
+	case "TLS":
+		server = &TLSServer{config: config}
+		break
+	case "WS":
+		server = &WSServer{}
+		break
+	case "WSS":
+		if config == nil {
+			return nil, fmt.Errorf("the WSS listening point must contain a certificate")
+		}
+		server = &WSServer{config: config}
+		break
 	}
 
 	if server == nil {
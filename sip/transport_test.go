@@ -1,7 +1,18 @@
 package sip
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUDPTransport(t *testing.T) {
@@ -10,3 +21,421 @@ func TestUDPTransport(t *testing.T) {
 	err := transport.listen("127.0.0.1:5069")
 	println(err)
 }
+
+func TestWebSocketConn(t *testing.T) {
+	client, server := net.Pipe()
+	accepted := make(chan *wsConn, 1)
+	go func() {
+		ws, err := acceptWebSocket(server)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- ws
+	}()
+
+	ws, err := dialWebSocket(client, "127.0.0.1:5066")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverWs := <-accepted
+	if serverWs == nil {
+		t.FailNow()
+	}
+
+	//net.Pipe的地址不是TCPAddr
+	listen := &ListeningPoint{tcpSessions: CreateSafeMap(1), wsAliases: CreateSafeMap(1)}
+	listen.onConnect(serverWs)
+	listen.onDisconnect(serverWs)
+	if listen.tcpSessions.Size() != 0 {
+		t.Fatalf("the connection should be removed")
+	}
+
+	msg := []byte("OPTIONS sip:127.0.0.1;transport=ws SIP/2.0\r\n\r\n")
+	go ws.Write(msg)
+	recv, err := serverWs.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != string(msg) {
+		t.Fatalf("bad websocket message %s", recv)
+	}
+
+	go serverWs.Write(msg)
+	if recv, err = ws.readMessage(); err != nil || string(recv) != string(msg) {
+		t.Fatalf("bad websocket message %s %v", recv, err)
+	}
+
+	//缓冲区小于消息, 剩余部分在下次Read返回
+	go serverWs.Write(msg)
+	buffer := make([]byte, 16)
+	recv = recv[:0]
+	for len(recv) < len(msg) {
+		n, err := ws.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recv = append(recv, buffer[:n]...)
+	}
+	if string(recv) != string(msg) {
+		t.Fatalf("the message larger than the buffer should not be truncated %s", recv)
+	}
+}
+
+func TestWebSocketServer(t *testing.T) {
+	//RFC 7118 transport=ws, sips URI使用WSS
+	if uri, _ := parseUri("sip:1000@df7jal23ls0d.invalid;transport=ws"); uriTransport(uri, "") != WS {
+		t.Fatalf("the transport of ;transport=ws should be WS")
+	} else if uri, _ = parseUri("sips:1000@df7jal23ls0d.invalid;transport=ws"); uriTransport(uri, "") != WSS {
+		t.Fatalf("the transport of sips ;transport=ws should be WSS")
+	}
+
+	recorder := &requestRecorder{requests: make(chan *RequestEvent, 8)}
+	listen := &ListeningPoint{IP: "127.0.0.1", Port: freePort(t), Transport: WS}
+	stack := &Stack{Listens: []*ListeningPoint{listen}, EventListener: recorder, Resolver: &StaticResolver{}}
+	stack.Options.TryingDelay = -1
+	if err := stack.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stack.Stop()
+
+	addr := joinHostPort(listen.IP, listen.Port)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := dialWebSocket(conn, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readMessage := func() string {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := client.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(msg)
+	}
+
+	//浏览器使用.invalid域名注册
+	register := "REGISTER sip:127.0.0.1;transport=ws SIP/2.0\r\n" +
+		"Via: SIP/2.0/WS df7jal23ls0d.invalid;branch=z9hG4bK-1\r\n" +
+		"From: <sip:1000@127.0.0.1>;tag=1\r\n" +
+		"To: <sip:1000@127.0.0.1>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 REGISTER\r\n" +
+		"Contact: <sip:1000@df7jal23ls0d.invalid;transport=ws>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if _, err = client.Write([]byte(register)); err != nil {
+		t.Fatal(err)
+	}
+	var event *RequestEvent
+	select {
+	case event = <-recorder.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the REGISTER over websocket should be received")
+	}
+	event.ServerTransaction.SendResponse(event.Request.CreateResponse(OK))
+	if response := readMessage(); !strings.HasPrefix(response, "SIP/2.0 200") || !strings.Contains(response, "Via: SIP/2.0/WS df7jal23ls0d.invalid;") {
+		t.Fatalf("bad response %s", response)
+	}
+
+	//发往注册的Contact的请求复用浏览器建立的连接
+	contact := event.Request.Contact().Address.Uri
+	from := &From{Address: &Address{Uri: NewSipUri("2000", "127.0.0.1", 0)}}
+	options := listen.NewEmptyRequestMessage(OPTIONS, contact, from, &To{Address: &Address{Uri: contact}})
+	transaction, err := listen.NewClientTransaction(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan *ResponseEvent, 1)
+	go func() {
+		event, _ := transaction.Execute()
+		results <- event
+	}()
+
+	request := readMessage()
+	if !strings.HasPrefix(request, "OPTIONS sip:1000@df7jal23ls0d.invalid;transport=ws SIP/2.0\r\n") || !strings.Contains(request, "Via: SIP/2.0/WS "+addr+";") {
+		t.Fatalf("bad request %s", request)
+	}
+	if _, err = client.Write(parseTestRequest(t, request).CreateResponse(OK).ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-results:
+		if event == nil || event.Response.GetStatusCode() != OK {
+			t.Fatalf("the response over websocket should be returned")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the response over websocket should be returned")
+	}
+}
+
+func TestStreamFramer(t *testing.T) {
+	body := "<?xml version=\"1.0\"?>\r\n<Query>\r\n<CmdType>Catalog</CmdType>\r\n</Query>\r\n"
+	msg := "MESSAGE sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP 192.168.1.108:5060;branch=z9hG4bK-1\r\n" +
+		"From: <sip:34020000001110000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000002000000001@3402000000>\r\n" +
+		"Call-ID: 1\r\n" +
+		"CSeq: 1 MESSAGE\r\n" +
+		"content-length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+
+	var msgs []string
+	framer := &streamFramer{}
+	handler := func(data []byte) {
+		msgs = append(msgs, string(data))
+	}
+
+	//一个消息分多次到达, 中间夹杂保活的CRLF
+	stream := "\r\n\r\n" + msg + msg + "\r\n" + msg
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if err := framer.feed([]byte(stream[i:end]), handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if m != msg {
+			t.Fatalf("bad message %s", m)
+		}
+	}
+
+	//一次读取多个消息, 最后一个不完整. 切分消息只移动offset, 追加数据时整理buffer
+	msgs = msgs[:0]
+	framer = &streamFramer{}
+	pipelined := strings.Repeat(msg, 100) + msg[:len(msg)/2]
+	if err := framer.feed([]byte(pipelined), handler); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 100 || framer.offset != 100*len(msg) {
+		t.Fatalf("expected 100 messages, got %d offset %d", len(msgs), framer.offset)
+	}
+	if err := framer.feed([]byte(msg[len(msg)/2:]), handler); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 101 || msgs[100] != msg || framer.offset != 0 || len(framer.buffer) != 0 {
+		t.Fatalf("the incomplete message should be reassembled %d", len(msgs))
+	}
+
+	//流上缺少Content-Length
+	framer = &streamFramer{}
+	if err := framer.feed([]byte("OPTIONS sip:127.0.0.1 SIP/2.0\r\nCSeq: 1 OPTIONS\r\n\r\n"), handler); err == nil {
+		t.Fatal("the Content-Length header is mandatory")
+	}
+}
+
+// newTestCert parent为空时生成自签名的CA证书
+func newTestCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	} else {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// streamRecorder 记录面向连接的传输层收到的消息和断开的连接
+type streamRecorder struct {
+	packets      chan string
+	disconnected chan net.Conn
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{packets: make(chan string, 4), disconnected: make(chan net.Conn, 4)}
+}
+
+func (r *streamRecorder) onConnect(conn net.Conn) {}
+
+func (r *streamRecorder) onDisconnect(conn net.Conn) {
+	r.disconnected <- conn
+}
+
+func (r *streamRecorder) onPacket(conn net.Conn, isTCP bool, data []byte, length int) {
+	r.packets <- string(data[:length])
+}
+
+func TestTLSTransport(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "gsip test CA"}}, nil)
+	serverCert := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	clientCert := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "34020000002000000001"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	//服务端要求客户端证书, 记录SNI
+	serverNames := make(chan string, 4)
+	server := &TLSServer{config: &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverNames <- hello.ServerName
+			return &serverCert, nil
+		},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}}
+	recorder := newStreamRecorder()
+	server.setHandler(recorder)
+	addr := joinHostPort("127.0.0.1", freePort(t))
+	if err := server.listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	msg := "OPTIONS sips:localhost SIP/2.0\r\n" +
+		"Via: SIP/2.0/TLS 127.0.0.1:5061;branch=z9hG4bK-1\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	client := &TLSClient{config: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}
+	client.setHandler(newStreamRecorder())
+	conn, err := client.dial("localhost", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if recv := <-recorder.packets; recv != msg {
+		t.Fatalf("bad message %s", recv)
+	}
+	if name := <-serverNames; name != "localhost" {
+		t.Fatalf("the SNI should be the host of the URI, got %s", name)
+	}
+
+	//客户端没有证书, 服务端关闭连接
+	clientRecorder := newStreamRecorder()
+	client = &TLSClient{config: &tls.Config{RootCAs: pool}}
+	client.setHandler(clientRecorder)
+	if conn, err = client.dial("localhost", addr); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(msg))
+	select {
+	case <-clientRecorder.disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection without a client certificate should be closed")
+	}
+	if len(recorder.packets) != 0 {
+		t.Fatalf("the message without a client certificate should be dropped")
+	}
+
+	//证书和域名不匹配
+	client = &TLSClient{config: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}
+	client.setHandler(newStreamRecorder())
+	if conn, err = client.dial("sip.example.com", addr); err == nil {
+		conn.Close()
+		t.Fatalf("the certificate of localhost should not be accepted for sip.example.com")
+	}
+}
+
+func TestLargeRequestOverTCP(t *testing.T) {
+	stack := newTestStack(t)
+	stack.Options.UDPThreshold = DefaultUDPThreshold
+	tcpConn := &recordConn{}
+	tcp := &ListeningPoint{IP: "192.168.1.108", Port: 5060, Transport: TCP, sipStack: stack.Stack, tcpSessions: CreateSafeMap(1)}
+	tcp.tcpSessions.Add(generateTcpConnectKey("192.168.1.100", 5060), tcpConn)
+	stack.Listens = append(stack.Listens, tcp)
+
+	newMessage := func(size int) *Request {
+		uri := NewSipUri("34020000001320000001", "192.168.1.100", 5060)
+		from := &From{Address: &Address{Uri: NewSipUri("34020000002000000001", "3402000000", 0)}}
+		to := &To{Address: &Address{Uri: uri.Clone()}}
+		contentType := ContentType("Application/MANSCDP+xml")
+		return stack.listen.NewRequestMessage(MESSAGE, uri, from, to, &contentType, []byte(strings.Repeat("0", size)))
+	}
+	if stack.listen.tcpForLargeRequest(DefaultUDPThreshold) != nil || stack.listen.tcpForLargeRequest(DefaultUDPThreshold+1) != tcp {
+		t.Fatalf("only the request over the threshold should be sent over TCP")
+	}
+
+	//超过阈值的请求通过TCP发送, Via改为TCP, branch不变
+	request := newMessage(2 * DefaultUDPThreshold)
+	transaction, err := stack.listen.NewClientTransaction(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := request.Via().branch
+	transaction.SendRequest(nil, nil)
+	if sent := tcpConn.sent(); len(sent) != 1 || !strings.Contains(sent[0], "Via: SIP/2.0/TCP 192.168.1.108:5060;") || !strings.Contains(sent[0], "branch="+branch) {
+		t.Fatalf("the large request should be sent over TCP %v", sent)
+	}
+	//TCP不重传
+	stack.clock.Advance(10 * time.Second)
+	if len(tcpConn.sent()) != 1 || len(stack.conn.sent()) != 0 {
+		t.Fatalf("the request over TCP should not be retransmitted")
+	}
+
+	//TCP上的非INVITE事务收到最终应答后直接结束, 状态机不能在持有锁时同步结束事务
+	response := request.CreateResponse(OK).ToBytes()
+	if err = processMessage(tcp, stack.Stack, tcpConn, true, response, len(response)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, ok := stack.findTransaction(transaction.id, false); !ok {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("the transaction over TCP should be terminated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//无状态发送的请求同样切换到TCP
+	request = newMessage(2 * DefaultUDPThreshold)
+	if err = stack.listen.SendRequest(request); err != nil {
+		t.Fatal(err)
+	} else if sent := tcpConn.sent(); len(sent) != 2 || !strings.Contains(sent[1], "Via: SIP/2.0/TCP") {
+		t.Fatalf("the large stateless request should be sent over TCP %v", sent)
+	}
+
+	//小于阈值的请求仍然使用UDP
+	request = newMessage(100)
+	if transaction, err = stack.listen.NewClientTransaction(request); err != nil {
+		t.Fatal(err)
+	}
+	transaction.SendRequest(nil, nil)
+	if sent := stack.conn.sent(); len(sent) != 1 || !strings.Contains(sent[0], "Via: SIP/2.0/UDP") {
+		t.Fatalf("the small request should be sent over UDP %v", sent)
+	}
+}
@@ -0,0 +1,162 @@
+package sip
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// RFC 3311 UPDATE以及对话内的offer/answer冲突处理, re-INVITE使用相同的规则.
+// 会话定时器(session_timer.go)也通过这里刷新会话
+
+// maxGlareRetries 收到491后最多重试的次数
+const maxGlareRetries = 3
+
+// beginOutgoing 本端发起会话修改, 同一时间只能有一个未完成的会话修改
+func (d *Dialog) beginOutgoing() error {
+	d.sessionMutex.Lock()
+	defer d.sessionMutex.Unlock()
+	if d.outgoingPending || d.incomingPending {
+		return fmt.Errorf("the dialog has a pending session modification")
+	}
+	d.outgoingPending = true
+	return nil
+}
+
+func (d *Dialog) endOutgoing() {
+	d.sessionMutex.Lock()
+	d.outgoingPending = false
+	d.sessionMutex.Unlock()
+}
+
+// beginIncoming 对端发起会话修改. 本端的请求还没有完成时返回491(glare),
+// 对端上一个请求还没有应答时返回500, 否则返回0
+func (d *Dialog) beginIncoming() int {
+	d.sessionMutex.Lock()
+	defer d.sessionMutex.Unlock()
+	if d.outgoingPending {
+		return RequestPending
+	} else if d.incomingPending {
+		return ServerInternalError
+	}
+	d.incomingPending = true
+	return 0
+}
+
+func (d *Dialog) endIncoming() {
+	d.sessionMutex.Lock()
+	d.incomingPending = false
+	d.sessionMutex.Unlock()
+}
+
+// glareRetryInterval RFC 3261 14.1 Call-ID的生成者(UAC)等待2.1-4秒, 否则等待0-2秒, 单位10ms
+func (d *Dialog) glareRetryInterval() time.Duration {
+	if d.isUAC {
+		return time.Duration(210+rand.Intn(190)) * 10 * time.Millisecond
+	}
+	return time.Duration(rand.Intn(200)) * 10 * time.Millisecond
+}
+
+// rejectIncoming 会话修改冲突时的应答, 500需要携带Retry-After
+func rejectIncoming(request *Request, code int) *Response {
+	response := request.CreateResponse(code)
+	if code == ServerInternalError {
+		response.SetHeader(&StrHeader{n: RetryAfterName, v: strconv.Itoa(rand.Intn(11))})
+	}
+	return response
+}
+
+// refreshTarget 目标刷新请求和它的2xx应答中的Contact更新remote target
+func (d *Dialog) refreshTarget(msg Message) {
+	if contact := msg.Contact(); contact != nil && contact.Address != nil && contact.Address.Uri != nil {
+		d.remoteTarget = contact.Address.Uri
+	}
+}
+
+// SendUpdate 在早期或者确认的对话中发送UPDATE, body为空时只刷新目标.
+// 发生glare(491)时等待随机时间后重试
+func (d *Dialog) SendUpdate(contentType *ContentType, body []byte) (*ResponseEvent, error) {
+	return d.modifySession(UPDATE, contentType, body)
+}
+
+// SendReInvite 在确认的对话中发送re-INVITE, 2xx应答后自动发送ACK.
+// 发生glare(491)时等待随机时间后重试
+func (d *Dialog) SendReInvite(contentType *ContentType, body []byte) (*ResponseEvent, error) {
+	if d.state != dialogStateConfirmed {
+		return nil, fmt.Errorf("re-INVITE requires a confirmed dialog")
+	}
+	return d.modifySession(INVITE, contentType, body)
+}
+
+func (d *Dialog) modifySession(method string, contentType *ContentType, body []byte) (*ResponseEvent, error) {
+	for attempt := 0; ; attempt++ {
+		if err := d.beginOutgoing(); err != nil {
+			return nil, err
+		}
+
+		event, err := d.sendSessionRequest(method, contentType, body)
+		d.endOutgoing()
+		if err != nil || attempt >= maxGlareRetries {
+			return event, err
+		}
+
+		//RFC 4028 7.4 会话间隔太小, 使用对端的Min-SE立即重试
+		if minSE := getMinSE(event.Response); event.Response.GetStatusCode() == SessionIntervalTooSmall && minSE > 0 {
+			d.timerMutex.Lock()
+			d.sessionInterval = time.Duration(minSE) * time.Second
+			d.timerMutex.Unlock()
+			continue
+		} else if event.Response.GetStatusCode() != RequestPending {
+			return event, err
+		}
+
+		//使用Stack的定时器等待, 测试时可以由FakeClock驱动. Stack停止后定时器不再执行
+		retry := make(chan struct{})
+		d.sipStack.timerService().AfterFunc(d.glareRetryInterval(), func() {
+			close(retry)
+		})
+		select {
+		case <-retry:
+		case <-d.sipStack.stopped():
+			return event, fmt.Errorf("the stack has been stopped")
+		}
+	}
+}
+
+func (d *Dialog) sendSessionRequest(method string, contentType *ContentType, body []byte) (*ResponseEvent, error) {
+	request, err := d.CreateRequest(method)
+	if err != nil {
+		return nil, err
+	}
+
+	//UPDATE/re-INVITE是目标刷新请求, 必须携带Contact
+	if d.listeningPoint.contact != nil {
+		request.SetHeader(d.listeningPoint.contact)
+	}
+	if contentType != nil {
+		request.SetContent(contentType, body)
+	} else {
+		request.SetHeader(defaultContentLengthHeader.Clone())
+	}
+
+	transaction, err := d.listeningPoint.NewClientTransaction(request)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := transaction.Execute()
+	if err != nil || event.Response.GetStatusCode()/100 != 2 {
+		return event, err
+	}
+
+	d.refreshTarget(event.Response)
+	//被拒绝的offer不能作为之后会话刷新的会话描述
+	if contentType != nil {
+		d.setLocalContent(contentType, body)
+	}
+	if INVITE == method {
+		err = d.SendAck(d.CreateAck(request.CSeq().Number))
+	}
+	return event, err
+}
@@ -0,0 +1,416 @@
+package sip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// RFC 3261 19.1 SIP/SIPS URI, RFC 3966 tel URI.
+// tel URI也使用SipUri表示, 只有User(电话号码)和Params, 这样Request-URI、From/To和Contact可以携带任意一种URI
+
+const (
+	TelScheme = "tel"
+
+	UserParam  = "user"
+	UserPhone  = "phone"
+	PhoneParam = "phone-context"
+)
+
+// ParseUri 解析sip、sips和tel URI. user、password、参数和头部的转义字符被还原
+func ParseUri(str string) (*SipUri, error) {
+	return parseUri(str)
+}
+
+// 转义时允许不转义的字符, RFC 3261 25.1
+const (
+	mark            = "-_.!~*'()"
+	userUnreserved  = "&=+$,;?/"
+	passUnreserved  = "&=+$,"
+	paramUnreserved = "[]/:&+$"
+	hnvUnreserved   = "[]/?:+$"
+	visualSeparator = "-.()"
+)
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(mark, c) >= 0
+}
+
+// writeEscaped 不在unreserved和allowed中的字符转义为%HH
+func writeEscaped(buffer *bytes.Buffer, s string, allowed string) {
+	const hex = "0123456789ABCDEF"
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) || strings.IndexByte(allowed, c) >= 0 {
+			continue
+		}
+		buffer.WriteString(s[start:i])
+		buffer.WriteByte('%')
+		buffer.WriteByte(hex[c>>4])
+		buffer.WriteByte(hex[c&0xF])
+		start = i + 1
+	}
+	buffer.WriteString(s[start:])
+}
+
+func escape(s string, allowed string) string {
+	var buffer bytes.Buffer
+	writeEscaped(&buffer, s, allowed)
+	return buffer.String()
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// unescape 还原%HH, 没有转义字符时返回原字符串
+func unescape(s string) (string, error) {
+	if strings.IndexByte(s, '%') < 0 {
+		return s, nil
+	}
+
+	var buffer bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			buffer.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("the escaped sequence is invalid %s", s)
+		}
+		h, ok1 := unhex(s[i+1])
+		l, ok2 := unhex(s[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("the escaped sequence is invalid %s", s)
+		}
+		buffer.WriteByte(h<<4 | l)
+		i += 2
+	}
+	return buffer.String(), nil
+}
+
+// unescapeParams 参数名和值都没有转义字符时返回原map
+func unescapeParams(params map[string]string) (map[string]string, error) {
+	escaped := false
+	for k, v := range params {
+		if strings.IndexByte(k, '%') >= 0 || strings.IndexByte(v, '%') >= 0 {
+			escaped = true
+			break
+		}
+	}
+	if !escaped {
+		return params, nil
+	}
+
+	unescaped := make(map[string]string, len(params))
+	for k, v := range params {
+		key, err := unescape(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := unescape(v)
+		if err != nil {
+			return nil, err
+		}
+		unescaped[key] = value
+	}
+	return unescaped, nil
+}
+
+func writeEscapedParams(buffer *bytes.Buffer, m map[string]string, separator string, allowed string) {
+	first := true
+	for k, v := range m {
+		if !first {
+			buffer.WriteString(separator)
+		}
+		first = false
+		writeEscaped(buffer, k, allowed)
+		if v != "" {
+			buffer.WriteString("=")
+			writeEscaped(buffer, v, allowed)
+		}
+	}
+}
+
+// findParam 参数名不区分大小写
+func findParam(params map[string]string, name string) (string, bool) {
+	if v, ok := params[name]; ok {
+		return v, true
+	}
+	for k, v := range params {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// isValidHost RFC 3261 25.1 hostname、IPv4地址或者IPv6地址, 兼容主机名中的下划线
+func isValidHost(host string) bool {
+	if strings.Contains(host, ":") {
+		return net.ParseIP(host) != nil
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return host != ""
+}
+
+func (uri *SipUri) IsTel() bool {
+	return uri.scheme == TelScheme
+}
+
+// IsAbsolute 地址中sip、sips和tel之外的absoluteURI, 例如RFC 4475 3.3.4的isbn:和http:
+func (uri *SipUri) IsAbsolute() bool {
+	return uri.opaque != ""
+}
+
+// Opaque absoluteURI冒号之后的内容, 没有还原转义字符
+func (uri *SipUri) Opaque() string {
+	return uri.opaque
+}
+
+// Equals RFC 3261 19.1.4 比较两个URI:
+// userinfo区分大小写, 其他部分不区分大小写, 参数和头部的顺序无关.
+// user、ttl、method、maddr和transport参数只出现在一个URI中时不相等, 其他参数只比较两个URI都有的.
+// 头部必须完全相同. tel URI按照RFC 3966 4比较
+func (uri *SipUri) Equals(other *SipUri) bool {
+	if other == nil || uri.GetScheme() != other.GetScheme() {
+		return false
+	} else if uri.IsTel() {
+		t1, _ := uri.TelUri()
+		t2, _ := other.TelUri()
+		return t1.Equals(t2)
+	} else if uri.IsAbsolute() || other.IsAbsolute() {
+		return uri.opaque == other.opaque
+	}
+
+	if uri.User != other.User || uri.Password != other.Password ||
+		!strings.EqualFold(uri.HostPort.Host, other.HostPort.Host) || uri.HostPort.Port != other.HostPort.Port {
+		return false
+	}
+
+	compare := func(a, b map[string]string) bool {
+		for k, v := range a {
+			if v2, ok := findParam(b, k); ok {
+				if !strings.EqualFold(v, v2) {
+					return false
+				}
+				continue
+			}
+			switch strings.ToLower(k) {
+			case UserParam, "ttl", "method", "maddr", "transport":
+				return false
+			}
+		}
+		return true
+	}
+	if !compare(uri.Params, other.Params) || !compare(other.Params, uri.Params) {
+		return false
+	}
+
+	if len(uri.Headers) != len(other.Headers) {
+		return false
+	}
+	for k, v := range uri.Headers {
+		if v2, ok := findParam(other.Headers, k); !ok || v != v2 {
+			return false
+		}
+	}
+	return true
+}
+
+// TelUri RFC 3966 电话号码. Number是全局号码(以+开始)或者本地号码, 可以包含可视分隔符-.().
+// 本地号码必须有phone-context参数
+type TelUri struct {
+	Number string
+	Params map[string]string
+}
+
+func NewTelUri(number string) *TelUri {
+	return &TelUri{Number: number}
+}
+
+func (t *TelUri) IsGlobal() bool {
+	return strings.HasPrefix(t.Number, "+")
+}
+
+// parseTelSubscriber 解析telephone-subscriber, 即tel:之后的部分或者user=phone的SIP URI的user
+func parseTelSubscriber(str string) (*TelUri, error) {
+	tel := &TelUri{Number: str}
+	if index := strings.Index(str, ";"); index >= 0 {
+		params, err := ParseParams(str[index+1:], ";")
+		if err != nil {
+			return nil, err
+		} else if params, err = unescapeParams(params); err != nil {
+			return nil, err
+		}
+		tel.Number, tel.Params = str[:index], params
+	}
+
+	digits := 0
+	number := strings.TrimPrefix(tel.Number, "+")
+	for i := 0; i < len(number); i++ {
+		c := number[i]
+		if '0' <= c && c <= '9' {
+			digits++
+		} else if strings.IndexByte(visualSeparator, c) >= 0 {
+			continue
+		} else if tel.IsGlobal() {
+			return nil, fmt.Errorf("the global number is invalid %s", str)
+		} else if _, ok := unhex(c); ok || c == '*' || c == '#' {
+			digits++
+		} else {
+			return nil, fmt.Errorf("the local number is invalid %s", str)
+		}
+	}
+	if digits == 0 {
+		return nil, fmt.Errorf("the tel URI must contain a number %s", str)
+	} else if _, ok := findParam(tel.Params, PhoneParam); !ok && !tel.IsGlobal() {
+		return nil, fmt.Errorf("the local number must contain the phone-context %s", str)
+	}
+	return tel, nil
+}
+
+func ParseTelUri(str string) (*TelUri, error) {
+	if len(str) < 4 || !strings.EqualFold(str[:4], "tel:") {
+		return nil, fmt.Errorf("the tel URI prefix must be tel")
+	}
+	return parseTelSubscriber(str[4:])
+}
+
+// writeSubscriber RFC 3966 3 ext和isub在最前面, 然后是phone-context, 其他参数按照名称排序
+func (t *TelUri) writeSubscriber(buffer *bytes.Buffer) {
+	buffer.WriteString(t.Number)
+	names := make([]string, 0, len(t.Params))
+	for k := range t.Params {
+		names = append(names, k)
+	}
+	rank := func(name string) int {
+		switch strings.ToLower(name) {
+		case "ext", "isub":
+			return 0
+		case PhoneParam:
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ri, rj := rank(names[i]), rank(names[j]); ri != rj {
+			return ri < rj
+		}
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	for _, k := range names {
+		buffer.WriteString(";")
+		writeEscaped(buffer, k, paramUnreserved)
+		if v := t.Params[k]; v != "" {
+			buffer.WriteString("=")
+			writeEscaped(buffer, v, paramUnreserved)
+		}
+	}
+}
+
+func (t *TelUri) ToString() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("tel:")
+	t.writeSubscriber(&buffer)
+	return buffer.String()
+}
+
+func (t *TelUri) Clone() *TelUri {
+	clone := *t
+	if t.Params != nil {
+		clone.Params = deepCopy(t.Params)
+	}
+	return &clone
+}
+
+// Equals RFC 3966 4 去掉可视分隔符后比较号码, 参数必须相同, 不区分大小写
+func (t *TelUri) Equals(other *TelUri) bool {
+	if t == nil || other == nil {
+		return t == other
+	} else if t.IsGlobal() != other.IsGlobal() || !strings.EqualFold(telDigits(t.Number), telDigits(other.Number)) {
+		return false
+	} else if len(t.Params) != len(other.Params) {
+		return false
+	}
+
+	for k, v := range t.Params {
+		v2, ok := findParam(other.Params, k)
+		if !ok {
+			return false
+		}
+		switch strings.ToLower(k) {
+		case "ext", "isub", PhoneParam:
+			v, v2 = telDigits(v), telDigits(v2)
+		}
+		if !strings.EqualFold(v, v2) {
+			return false
+		}
+	}
+	return true
+}
+
+func telDigits(number string) string {
+	if strings.IndexAny(number, visualSeparator) < 0 {
+		return number
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(visualSeparator, r) {
+			return -1
+		}
+		return r
+	}, number)
+}
+
+// ToUri 转换为可以作为Request-URI、From/To和Contact的URI
+func (t *TelUri) ToUri() *SipUri {
+	uri := &SipUri{User: t.Number, scheme: TelScheme}
+	if t.Params != nil {
+		uri.Params = deepCopy(t.Params)
+	}
+	return uri
+}
+
+// ToSipUri RFC 3261 19.1.6 tel URI转换为user=phone的SIP URI, 号码和参数作为user,
+// 例如tel:+358-555-1234567;postd=pp22转换为sip:+358-555-1234567;postd=pp22@foo.com;user=phone
+func (t *TelUri) ToSipUri(host string, port int) *SipUri {
+	var buffer bytes.Buffer
+	t.writeSubscriber(&buffer)
+	uri := NewSipUri(buffer.String(), host, port)
+	uri.Params = map[string]string{UserParam: UserPhone}
+	return uri
+}
+
+// TelUri tel URI或者user=phone的SIP URI转换为TelUri
+func (uri *SipUri) TelUri() (*TelUri, bool) {
+	if uri.IsTel() {
+		tel := &TelUri{Number: uri.User}
+		if uri.Params != nil {
+			tel.Params = deepCopy(uri.Params)
+		}
+		return tel, true
+	}
+
+	if user, ok := findParam(uri.Params, UserParam); !ok || !strings.EqualFold(user, UserPhone) {
+		return nil, false
+	}
+	tel, err := parseTelSubscriber(uri.User)
+	return tel, err == nil
+}
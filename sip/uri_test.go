@@ -0,0 +1,184 @@
+package sip
+
+import (
+	"testing"
+)
+
+func TestParseUri(t *testing.T) {
+	corpus := []struct {
+		uri      string
+		expected string //为空表示和uri相同
+	}{
+		{"sip:34020000001320000001@192.168.1.108:5060", ""},
+		{"SIPS:alice@atlanta.com", "sips:alice@atlanta.com"},
+		{"sip:alice:secret@atlanta.com;transport=tcp", ""},
+		{"sip:alice@atlanta.com?subject=project%20x", ""},
+		{"sip:%61lice@atlanta.com;n%61me=v%61lue", "sip:alice@atlanta.com;name=value"},
+		{"sip:sips%3Auser%40example.com@example.net", ""},
+		{"sip:I%20have%20spaces@example.net", ""},
+		{"sip:+1-212-555-1212:1234@gateway.com;user=phone", ""},
+		{"tel:+1-201-555-0123", ""},
+		{"TEL:+358-555-1234567;postd=pp22;isub=1411", "tel:+358-555-1234567;isub=1411;postd=pp22"},
+		{"tel:7042;phone-context=example.com", ""},
+		{"tel:863-1234;ext=24;phone-context=+1-914-555", ""},
+	}
+	for _, c := range corpus {
+		uri, err := ParseUri(c.uri)
+		if err != nil {
+			t.Fatalf("%s: %v", c.uri, err)
+		}
+		expected := c.expected
+		if expected == "" {
+			expected = c.uri
+		}
+		if uri.ToString() != expected {
+			t.Fatalf("%s: %s, expected %s", c.uri, uri.ToString(), expected)
+		}
+		//序列化之后可以还原
+		if parsed, err := ParseUri(uri.ToString()); err != nil || !parsed.Equals(uri) {
+			t.Fatalf("%s: the formatted URI %s is different", c.uri, uri.ToString())
+		}
+	}
+
+	if uri, _ := ParseUri("sip:sips%3Auser%40example.com@example.net"); uri.User != "sips:user@example.com" {
+		t.Fatalf("bad unescaped user %s", uri.User)
+	}
+	if uri, _ := ParseUri("sip:alice@atlanta.com?subject=project%20x&priority=urgent"); uri.Headers["subject"] != "project x" || len(uri.Params) != 0 {
+		t.Fatalf("bad headers %v %v", uri.Headers, uri.Params)
+	}
+
+	for _, uri := range []string{
+		"sip:%zzlice@atlanta.com",
+		"sip:alice@atlanta.com;x=%4",
+		"tel:7042",
+		"tel:+1-201-555-0123a",
+		"tel:+--",
+		"tel:",
+		"mailto:alice@atlanta.com",
+	} {
+		if _, err := ParseUri(uri); err == nil {
+			t.Fatalf("%s should be rejected", uri)
+		}
+	}
+}
+
+func TestUriEquals(t *testing.T) {
+	//RFC 3261 19.1.4
+	equivalent := [][2]string{
+		{"sip:%61lice@atlanta.com;transport=TCP", "sip:alice@AtLanTa.CoM;Transport=tcp"},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com;newparam=5"},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com;security=on"},
+		{"sip:carol@chicago.com;newparam=5", "sip:carol@chicago.com;security=on"},
+		{"sip:biloxi.com;transport=tcp;method=REGISTER?to=sip:bob%40biloxi.com", "sip:biloxi.com;method=REGISTER;transport=tcp?to=sip:bob%40biloxi.com"},
+		{"sip:alice@atlanta.com?subject=project%20x&priority=urgent", "sip:alice@atlanta.com?priority=urgent&subject=project%20x"},
+		{"tel:+1-201-555-0123", "tel:+1(201)555.0123"},
+		{"tel:7042;phone-context=example.com", "tel:7042;Phone-Context=EXAMPLE.COM"},
+	}
+	different := [][2]string{
+		{"SIP:ALICE@AtLanTa.CoM;Transport=udp", "sip:alice@AtLanTa.CoM;Transport=UDP"},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com:5060"},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com;transport=udp"},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com:6000;transport=tcp"},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com?Subject=next%20meeting"},
+		{"sip:carol@chicago.com?Subject=next%20meeting", "sip:carol@chicago.com?Subject=NEXT%20MEETING"},
+		{"sip:bob@phone21.boxesbybob.com", "sip:bob@192.0.2.4"},
+		{"sip:carol@chicago.com;security=on", "sip:carol@chicago.com;security=off"},
+		{"sip:alice@atlanta.com", "sips:alice@atlanta.com"},
+		{"sip:+1-201-555-0123@example.com;user=phone", "tel:+1-201-555-0123"},
+		{"tel:+1-201-555-0123", "tel:+1-201-555-0123;ext=1"},
+		{"tel:7042;phone-context=example.com", "tel:7042;phone-context=example.net"},
+	}
+
+	for i, pairs := range [][][2]string{equivalent, different} {
+		for _, pair := range pairs {
+			a, err := ParseUri(pair[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ParseUri(pair[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Equals(b) != (i == 0) || b.Equals(a) != (i == 0) {
+				t.Fatalf("%s and %s should be equivalent: %v", pair[0], pair[1], i == 0)
+			}
+		}
+	}
+}
+
+func TestTelSipConversion(t *testing.T) {
+	//RFC 3261 19.1.6
+	tel, err := ParseTelUri("tel:+358-555-1234567;postd=pp22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sip := tel.ToSipUri("foo.com", 0)
+	if sip.ToString() != "sip:+358-555-1234567;postd=pp22@foo.com;user=phone" {
+		t.Fatalf("bad sip URI %s", sip.ToString())
+	}
+
+	parsed, err := ParseUri(sip.ToString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted, ok := parsed.TelUri(); !ok || !converted.Equals(tel) {
+		t.Fatalf("the sip URI with user=phone should be converted to %s", tel.ToString())
+	}
+	if _, ok := NewSipUri("+358-555-1234567", "foo.com", 0).TelUri(); ok {
+		t.Fatalf("the sip URI without user=phone is not a telephone number")
+	}
+
+	uri := NewTelUri("+1-201-555-0123").ToUri()
+	if !uri.IsTel() || uri.ToString() != "tel:+1-201-555-0123" {
+		t.Fatalf("bad tel URI %s", uri.ToString())
+	}
+	if converted, ok := uri.TelUri(); !ok || converted.Number != "+1-201-555-0123" {
+		t.Fatalf("bad converted tel URI")
+	}
+
+	stack := &Stack{}
+	if _, err := stack.findNextHops(uri, UDP); err == nil {
+		t.Fatalf("the tel URI cannot be resolved")
+	}
+}
+
+func TestTelUriInMessage(t *testing.T) {
+	data := crlf(`INVITE tel:+1-201-555-0123 SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw
+From: "Alice" <tel:+1-201-555-0100>;tag=1
+To: <tel:7042;phone-context=example.com>
+Call-ID: tel.1@192.0.2.1
+CSeq: 1 INVITE
+Contact: <sip:+1-201-555-0100@192.0.2.1;user=phone>
+Max-Forwards: 70
+Content-Length: 0
+
+`)
+
+	for _, parse := range []func([]byte, int) (Message, bool, error){parseMessage, parseMessageLazy} {
+		msg, _, err := parse([]byte(data), len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := msg.(*Request)
+		if uri := request.GetRequestLine().RequestUri; !uri.IsTel() || uri.User != "+1-201-555-0123" {
+			t.Fatalf("bad Request-URI %s", uri.ToString())
+		}
+		if !request.From().Address.Uri.IsTel() || request.From().Tag != "1" {
+			t.Fatalf("bad From %s", request.From().Value())
+		}
+		if to := request.To().Address.Uri; !to.IsTel() || to.Params[PhoneParam] != "example.com" {
+			t.Fatalf("bad To %s", request.To().Value())
+		}
+		if tel, ok := request.Contact().Address.Uri.TelUri(); !ok || tel.Number != "+1-201-555-0100" {
+			t.Fatalf("bad Contact %s", request.Contact().Value())
+		}
+
+		data := request.ToBytes()
+		forwarded := parseTestRequest(t, string(data))
+		if !forwarded.GetRequestLine().RequestUri.Equals(request.GetRequestLine().RequestUri) ||
+			!forwarded.To().Address.Uri.Equals(request.To().Address.Uri) {
+			t.Fatalf("bad forwarded request %s", data)
+		}
+	}
+}
@@ -2,9 +2,10 @@ package sip
 
 import (
 	"encoding/hex"
-	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
+	"strings"
 )
 
 func RandStr(length int) string {
@@ -35,14 +36,24 @@ func GenerateTag() string {
 	return RandStr(12)
 }
 
+// joinHostPort 生成可以用于net包的地址, IPv6地址加上中括号
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
 func generateTcpConnectKey(host string, port int) string {
-	return fmt.Sprintf("%s:%d", host, port)
+	return joinHostPort(host, port)
 }
 
+// getHostPort 其他类型的地址(例如net.Pipe)按host:port解析, 不能解析时为空
 func getHostPort(addr net.Addr) Hop {
-	if _, ok := addr.(*net.UDPAddr); ok {
-		return Hop{addr.(*net.UDPAddr).IP.String(), addr.(*net.UDPAddr).Port, UDP}
-	} else {
-		return Hop{addr.(*net.TCPAddr).IP.String(), addr.(*net.TCPAddr).Port, TCP}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return Hop{IP: udpAddr.IP.String(), Port: udpAddr.Port, Transport: UDP}
+	} else if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return Hop{IP: tcpAddr.IP.String(), Port: tcpAddr.Port, Transport: TCP}
 	}
+
+	host, port, _ := net.SplitHostPort(addr.String())
+	p, _ := strconv.Atoi(port)
+	return Hop{IP: host, Port: p, Transport: TCP}
 }
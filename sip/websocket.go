@@ -0,0 +1,292 @@
+package sip
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RFC 6455 WebSocket的最小实现, 仅用于承载RFC 7118 SIP over WebSocket
+// 每个WebSocket消息(text/binary)对应一个完整的SIP消息
+
+const (
+	wsGUID          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsSubProtocol   = "sip"
+	wsMaxMessageLen = 64 * 1024
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	//客户端发送的帧必须掩码, 服务端发送的帧不能掩码
+	client bool
+	mutex  sync.Mutex
+	//对端Contact/Via中的.invalid域名, 用于发往浏览器的请求复用该连接
+	aliases []string
+	//Read没有读完的消息
+	pending []byte
+}
+
+func computeAcceptKey(key string) string {
+	hash := sha1.New()
+	hash.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptWebSocket 服务端完成握手, 客户端必须协商sip子协议
+func acceptWebSocket(conn net.Conn) (*wsConn, error) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if request.Method != http.MethodGet || key == "" ||
+		!headerContainsToken(request.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(request.Header, "Connection", "Upgrade") {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return nil, fmt.Errorf("bad websocket handshake request")
+	}
+
+	if !headerContainsToken(request.Header, "Sec-WebSocket-Protocol", wsSubProtocol) {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return nil, fmt.Errorf("the websocket client must negotiate the sip subprotocol")
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + wsSubProtocol + "\r\n\r\n"
+	if _, err = conn.Write([]byte(response)); err != nil {
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, reader: reader}, nil
+}
+
+// dialWebSocket 客户端在已经建立的TCP/TLS连接上完成握手
+func dialWebSocket(conn net.Conn, host string) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := "GET / HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + wsSubProtocol + "\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("the websocket handshake failed %s", response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(key) {
+		return nil, fmt.Errorf("bad Sec-WebSocket-Accept")
+	}
+	if !headerContainsToken(response.Header, "Sec-WebSocket-Protocol", wsSubProtocol) {
+		return nil, fmt.Errorf("the websocket server does not support the sip subprotocol")
+	}
+
+	return &wsConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	length := len(payload)
+	if length < 126 {
+		header[1] = byte(length)
+	} else if length <= 0xFFFF {
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	} else {
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	data := payload
+	if c.client {
+		header[1] |= 0x80
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+		header = append(header, mask...)
+		data = make([]byte, length)
+		for i := 0; i < length; i++ {
+			data[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	if _, err := c.Conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	} else if length == 127 {
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > wsMaxMessageLen {
+		return false, 0, nil, fmt.Errorf("the websocket frame is too large %d", length)
+	}
+	//客户端发送的帧必须掩码
+	if !c.client && !masked {
+		return false, 0, nil, fmt.Errorf("the websocket client frame must be masked")
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// readMessage 读取一个完整的数据消息, 处理分片和控制帧
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err = c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, fmt.Errorf("expected a websocket continuation frame")
+			}
+			started = true
+			message = payload
+		case wsOpContinuation:
+			if !started {
+				return nil, fmt.Errorf("unexpected websocket continuation frame")
+			}
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+
+		if len(message) > wsMaxMessageLen {
+			return nil, fmt.Errorf("the websocket message is too large %d", len(message))
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// Read 消息大于b时, 剩余部分在下次Read返回. 接收协程使用readMessage按消息读取
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = message
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write 一个SIP消息作为一个text帧发送
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpText, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}